@@ -31,25 +31,25 @@ const STEMS = [
 	{ name: "Original", file: "base.mp3", icon: Music, requiresDemucs: false },
 	{
 		name: "Vocals",
-		file: "mdx_extra_q/base/vocals.wav",
+		file: "demucs/vocals.wav",
 		icon: Mic,
 		requiresDemucs: true,
 	},
 	{
 		name: "Drums",
-		file: "mdx_extra_q/base/drums.wav",
+		file: "demucs/drums.wav",
 		icon: Drum,
 		requiresDemucs: true,
 	},
 	{
 		name: "Bass",
-		file: "mdx_extra_q/base/bass.wav",
+		file: "demucs/bass.wav",
 		icon: Guitar,
 		requiresDemucs: true,
 	},
 	{
 		name: "Other",
-		file: "mdx_extra_q/base/other.wav",
+		file: "demucs/other.wav",
 		icon: Layers,
 		requiresDemucs: true,
 	},
@@ -118,6 +118,9 @@ export default function TrackPage() {
 					} else if (event.status === "failed") {
 						updatedTrack.demucs_status = "failed";
 						updatedTrack.demucs_error = event.error;
+					} else if (event.status === "purged") {
+						updatedTrack.demucs_status = "purged";
+						updatedTrack.demucs_progress = 0;
 					}
 				}
 
@@ -59,6 +59,9 @@ export function useTracks() {
 					} else if (event.status === "failed") {
 						updatedTrack.demucs_status = "failed";
 						updatedTrack.demucs_error = event.error;
+					} else if (event.status === "purged") {
+						updatedTrack.demucs_status = "purged";
+						updatedTrack.demucs_progress = 0;
 					}
 				}
 
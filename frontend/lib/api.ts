@@ -1,5 +1,6 @@
 export interface SetupPlaylistRequest {
 	playlist_id: string;
+	auto_demucs?: boolean;
 }
 
 export interface SetupPlaylistResponse {
@@ -15,17 +16,43 @@ export interface TrackState {
 	download_status: "pending" | "in_progress" | "completed" | "failed";
 	download_progress: number;
 	download_error?: string;
-	demucs_status: "pending" | "in_progress" | "completed" | "failed";
+	demucs_status: "pending" | "in_progress" | "completed" | "failed" | "purged";
 	demucs_progress: number;
 	demucs_error?: string;
+	youtube_video_id?: string;
+	youtube_title?: string;
+	updated_at: string;
+	download_attempts: number;
+	demucs_attempts: number;
 }
 
 export interface ProgressEvent {
 	track_id: string;
-	type: "download" | "demucs";
-	status: "pending" | "downloading" | "processing" | "completed" | "failed";
+	type: "download" | "demucs" | "playlist";
+	status: "queued" | "pending" | "downloading" | "processing" | "in_progress" | "completed" | "failed" | "purged";
 	progress: number;
 	error?: string;
+	stage?: string;
+	queue_position?: number;
+	remaining_seconds?: number;
+	// Set on "playlist" events, which carry a playlist's totals
+	playlist_id?: string;
+	completed?: number;
+	failed?: number;
+	total?: number;
+}
+
+export interface StageCounts {
+	pending: number;
+	in_progress: number;
+	failed: number;
+}
+
+export interface QueuesResponse {
+	download: StageCounts;
+	demucs: StageCounts;
+	download_queue_depth: number;
+	demucs_queue_depth: number;
 }
 
 // Default to localhost:8080 if not specified
@@ -73,6 +100,14 @@ export const api = {
 		return handleResponse<TrackState[]>(response);
 	},
 
+	/**
+	 * Fetch how backed up the download and Demucs stages are.
+	 */
+	async getQueues(): Promise<QueuesResponse> {
+		const response = await fetch(`${API_BASE_URL}/queues`);
+		return handleResponse<QueuesResponse>(response);
+	},
+
 	/**
 	 * Get the EventSource function for progress updates.
 	 * Returns a function that connects to the SSE stream.
@@ -82,6 +117,14 @@ export const api = {
 		return new EventSource(`${API_BASE_URL}/progress/stream`);
 	},
 
+	/**
+	 * Open a WebSocket carrying the same progress events as the SSE stream.
+	 * Send {"subscribe_playlist": id} to follow one playlist ("" for all).
+	 */
+	createProgressSocket(): WebSocket {
+		return new WebSocket(`${API_BASE_URL.replace(/^http/, "ws")}/progress/ws`);
+	},
+
 	/**
 	 * Fetch a single track by ID.
 	 */
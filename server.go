@@ -2,10 +2,13 @@ package main
 
 import (
 	"flag"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"separate/server/api"
 	"separate/server/core"
@@ -15,60 +18,203 @@ import (
 )
 
 const (
-	numWorkers       = 8
-	numDemucsWorkers = 1 // Demucs is slow, process one at a time
+	defaultNumWorkers       = 8
+	defaultNumDemucsWorkers = 1 // Demucs is slow, process one at a time
+	defaultDBPath           = "./queue.db"
 )
 
-func enableCORS(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+// newCORSMiddleware builds middleware that answers preflight requests and sets CORS
+// headers for allowedOrigins, a comma-separated list of origins. Empty or "*" allows
+// any origin; otherwise only listed origins get CORS headers and the browser blocks the rest.
+func newCORSMiddleware(allowedOrigins string) func(http.Handler) http.Handler {
+	allowAll, origins := parseAllowedOrigins(allowedOrigins)
 
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			switch {
+			case allowAll:
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			case origins[origin]:
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Add("Vary", "Origin")
+			}
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key")
+
+			// Preflight: answer directly, the browser only needs the headers
+			if r.Method == http.MethodOptions {
+				w.Header().Set("Access-Control-Max-Age", "600")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// parseAllowedOrigins parses ALLOWED_ORIGINS into whether every origin is
+// allowed and, if not, the set of allowed ones
+func parseAllowedOrigins(allowedOrigins string) (allowAll bool, origins map[string]bool) {
+	allowAll = strings.TrimSpace(allowedOrigins) == "" || strings.TrimSpace(allowedOrigins) == "*"
+	origins = make(map[string]bool)
+	for _, origin := range strings.Split(allowedOrigins, ",") {
+		if origin = strings.TrimRight(strings.TrimSpace(origin), "/"); origin != "" {
+			origins[origin] = true
 		}
+	}
+	return allowAll, origins
+}
 
-		next.ServeHTTP(w, r)
-	})
+// setupLogger installs a JSON slog logger as the default; LOG_LEVEL picks the
+// minimum level (debug, info, warn, error; default info)
+func setupLogger() {
+	var level slog.Level
+	if envLevel := os.Getenv("LOG_LEVEL"); envLevel != "" {
+		if err := level.UnmarshalText([]byte(envLevel)); err != nil {
+			fatal("Invalid LOG_LEVEL", "value", envLevel)
+		}
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+}
+
+// fatal logs at error level and exits, standing in for log.Fatal
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// envEnabled reports whether an environment variable is set to "true" or "1"
+func envEnabled(name string) bool {
+	value := os.Getenv(name)
+	return strings.ToLower(value) == "true" || value == "1"
+}
+
+// envPositiveInt reads a positive integer from an environment variable, or returns fallback if unset
+func envPositiveInt(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		fatal("Environment variable must be an integer >= 1", "name", name, "value", value)
+	}
+	return n
+}
+
+// envBool reads a boolean environment variable ("true"/"1" or "false"/"0"), or returns fallback if unset
+func envBool(name string, fallback bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		fatal("Environment variable must be true or false", "name", name, "value", value)
+	}
+	return enabled
 }
 
 func main() {
+	setupLogger()
+
 	// Parse command-line flags
 	disableWorkers := flag.Bool("disable-workers", false, "Disable background workers for downloads and processing (for UI testing)")
 	flag.Parse()
 
 	// Check environment variable as well
-	if envDisable := os.Getenv("DISABLE_WORKERS"); envDisable != "" {
-		if strings.ToLower(envDisable) == "true" || envDisable == "1" {
-			*disableWorkers = true
-		}
+	if envEnabled("DISABLE_WORKERS") {
+		*disableWorkers = true
 	}
 
 	if *disableWorkers {
-		log.Println("⚠️  Workers disabled - no downloads or processing will occur")
+		slog.Warn("Workers disabled - no downloads or processing will occur")
+	}
+
+	// Configuration
+	serverConfig := models.ServerConfig{
+		SpotifyClientID:         os.Getenv("SPOTIFY_CLIENT_ID"),
+		SpotifyClientSecret:     os.Getenv("SPOTIFY_CLIENT_SECRET"),
+		Port:                    os.Getenv("PORT"),
+		NumWorkers:              envPositiveInt("NUM_WORKERS", defaultNumWorkers),
+		NumDemucsWorkers:        envPositiveInt("NUM_DEMUCS_WORKERS", defaultNumDemucsWorkers),
+		DBPath:                  os.Getenv("DB_PATH"),
+		MaxDownloadsPerPlaylist: envPositiveInt("MAX_DOWNLOADS_PER_PLAYLIST", 0), // Unset leaves playlists unlimited
+		AutoDemucs:              envBool("AUTO_DEMUCS", true),
+		MaxJobAttempts:          envPositiveInt("MAX_JOB_ATTEMPTS", worker.DefaultMaxAttempts),
+	}
+	if serverConfig.Port == "" {
+		serverConfig.Port = "8080"
+	}
+	if serverConfig.DBPath == "" {
+		serverConfig.DBPath = defaultDBPath
 	}
 
 	// Initialize database
-	database, err := db.InitDB("./queue.db")
+	database, err := db.InitDB(serverConfig.DBPath)
 	if err != nil {
-		log.Fatal("Failed to initialize database:", err)
+		fatal("Failed to initialize database", "path", serverConfig.DBPath, "error", err)
 	}
 	defer database.Close()
 
-	// Configuration
+	// Resolve the songs directory once so every path, including the Demucs mount, agrees
+	if err := worker.SetSongsDir(os.Getenv("SONGS_DIR")); err != nil {
+		fatal("Invalid SONGS_DIR", "error", err)
+	}
+	serverConfig.SongsDir = worker.SongsDir()
+	if err := os.MkdirAll(serverConfig.SongsDir, 0755); err != nil {
+		fatal("Failed to create songs directory", "path", serverConfig.SongsDir, "error", err)
+	}
+	slog.Info("Storing tracks", "path", serverConfig.SongsDir)
+
+	// LIBRARY_DIR adds a browsable {artist}/{album}/{title}.mp3 tree of symlinks into SONGS_DIR
+	if err := worker.SetLibraryDir(os.Getenv("LIBRARY_DIR")); err != nil {
+		fatal("Invalid LIBRARY_DIR", "error", err)
+	}
+	if dir := worker.LibraryDir(); dir != "" {
+		slog.Info("Linking downloads into library", "path", dir)
+	}
+
 	config := models.SpotifyConfig{
-		ClientID:     os.Getenv("SPOTIFY_CLIENT_ID"),
-		ClientSecret: os.Getenv("SPOTIFY_CLIENT_SECRET"),
+		ClientID:     serverConfig.SpotifyClientID,
+		ClientSecret: serverConfig.SpotifyClientSecret,
+		Market:       os.Getenv("SPOTIFY_MARKET"),
+		RedirectURI:  os.Getenv("SPOTIFY_REDIRECT_URI"),
 	}
 
 	if config.ClientID == "" || config.ClientSecret == "" {
-		log.Fatal("SPOTIFY_CLIENT_ID and SPOTIFY_CLIENT_SECRET environment variables must be set")
+		fatal("SPOTIFY_CLIENT_ID and SPOTIFY_CLIENT_SECRET environment variables must be set")
+	}
+
+	// Optional outbound proxy for both Spotify and yt-dlp (opt-in via HTTP_PROXY_URL)
+	var spotifyOpts []core.SpotifyClientOption
+	proxyURL := os.Getenv("HTTP_PROXY_URL")
+	if proxyURL != "" {
+		parsed, err := url.Parse(proxyURL)
+		if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			fatal("Invalid HTTP_PROXY_URL", "value", proxyURL)
+		}
+		spotifyOpts = append(spotifyOpts, core.WithProxy(parsed))
+		slog.Info("Routing Spotify and yt-dlp traffic through proxy", "proxy", parsed.Redacted())
+	}
+	ytDlpConfig := worker.YtDlpConfig{ProxyURL: proxyURL}
+	if envTimeout := os.Getenv("YTDLP_TIMEOUT"); envTimeout != "" {
+		timeout, err := time.ParseDuration(envTimeout)
+		if err != nil || timeout <= 0 {
+			fatal("Invalid YTDLP_TIMEOUT: must be a positive duration like 10m", "value", envTimeout)
+		}
+		ytDlpConfig.DownloadTimeout = timeout
 	}
+	worker.ConfigureYtDlp(ytDlpConfig)
+
+	// A Spotify user login (for Liked Songs) survives restarts via the database
+	spotifyOpts = append(spotifyOpts, core.WithRefreshTokenStore(database))
+	spotify := core.NewSpotifyClient(config, spotifyOpts...)
 
 	// Initialize queues
-	downloadQueue := make(chan *models.DownloadJob, 1000)
+	downloadQueue := worker.NewDownloadQueue(1000)
 	demucsQueue := make(chan *models.DemucsJob, 1000)
 
 	// Initialize progress broadcaster
@@ -76,79 +222,52 @@ func main() {
 
 	// Initialize worker manager (even if disabled, for handler compatibility)
 	workerManager := worker.NewWorkerManager(database, progress, demucsQueue)
+	workerManager.SetMaxDownloadsPerPlaylist(serverConfig.MaxDownloadsPerPlaylist)
+	workerManager.SetAutoDemucs(serverConfig.AutoDemucs)
+	workerManager.SetMaxAttempts(serverConfig.MaxJobAttempts)
+	if !serverConfig.AutoDemucs {
+		slog.Info("Automatic separation disabled; separate tracks on demand")
+	}
 
-	// Only start workers if not disabled
-	if !*disableWorkers {
-		// Verify download status against files (Phase 1 sanity check)
-		log.Println("Verifying download status against files...")
-		checkFileExists := func(trackID string) bool {
-			_, err := os.Stat("songs/" + trackID + "/base.mp3")
-			return err == nil
-		}
-		if err := database.VerifyDownloadStatus(checkFileExists); err != nil {
-			log.Printf("Warning: Failed to verify download status: %v", err)
-		}
+	// DEMUCS_MODE=local runs DEMUCS_COMMAND (default "demucs") on the host instead of in Docker.
+	// DEMUCS_MEMORY_LIMIT (e.g. "6g") caps the container; demucs needs 6-7GB per job.
+	// DEMUCS_CONTAINER_NAME lets several servers share a host; DEMUCS_IMAGE pins a version.
+	if err := worker.ConfigureDemucs(worker.DemucsConfig{
+		Mode:          os.Getenv("DEMUCS_MODE"),
+		LocalCommand:  os.Getenv("DEMUCS_COMMAND"),
+		UseGPU:        envEnabled("DEMUCS_USE_GPU"),
+		MemoryLimit:   os.Getenv("DEMUCS_MEMORY_LIMIT"),
+		ContainerName: os.Getenv("DEMUCS_CONTAINER_NAME"),
+		Image:         os.Getenv("DEMUCS_IMAGE"),
+	}); err != nil {
+		fatal("Invalid Demucs configuration", "error", err)
+	}
 
-		// Load pending jobs from database
-		pendingDownloads, err := database.GetPendingDownloadJobs()
-		if err != nil {
-			log.Printf("Warning: Failed to load pending jobs: %v", err)
+	// Catch missing external tools now rather than as exec errors on every job
+	for _, dependency := range worker.Preflight() {
+		if dependency.OK {
+			slog.Info("Detected dependency", "name", dependency.Name, "version", dependency.Version)
+		} else if *disableWorkers {
+			slog.Warn("Dependency missing; jobs will fail once workers are enabled", "name", dependency.Name, "error", dependency.Error)
 		} else {
-			log.Printf("Loading %d pending jobs from database", len(pendingDownloads))
-			// We need to fetch metadata for these tracks effectively.
-			// For simplicity, we might just re-queue them if we had full metadata.
-			// However, GetPendingDownloadJobs only returns IDs.
-			// We probably need to fetch metadata again or store it fully.
-			// The original code fetched it from Spotify again.
-
-			if len(pendingDownloads) > 0 {
-				token, err := core.GetAccessToken(config)
-				if err == nil {
-					for _, trackID := range pendingDownloads {
-						track, err := core.GetTrackMetadata(trackID, token)
-						if err != nil {
-							log.Printf("Failed to fetch metadata for %s: %v", trackID, err)
-							continue
-						}
-						downloadQueue <- &models.DownloadJob{Track: *track}
-					}
-				} else {
-					log.Printf("Failed to get token for reloading jobs: %v", err)
-				}
-			}
-		}
-
-		// Load pending Demucs jobs
-		pendingDemucs, err := database.GetPendingDemucsJobs()
-		if err != nil {
-			log.Printf("Warning: Failed to load pending Demucs jobs: %v", err)
-		} else {
-			if len(pendingDemucs) > 0 {
-				log.Printf("Queued %d tracks for Demucs processing", len(pendingDemucs))
-				for _, track := range pendingDemucs {
-					demucsQueue <- &models.DemucsJob{
-						Track:     track,
-						InputPath: "songs/" + track.ID + "/base.mp3",
-					}
-				}
-			}
+			fatal("Required dependency missing; install it or run with DISABLE_WORKERS=true", "name", dependency.Name, "error", dependency.Error)
 		}
+	}
 
-		// Start download worker pool
-		for i := 0; i < numWorkers; i++ {
-			go workerManager.DownloadWorker(downloadQueue)
-		}
-		log.Printf("Started %d download workers", numWorkers)
+	// Only start workers if not disabled
+	if !*disableWorkers {
+		// Check the database against the songs directory and re-queue unfinished jobs
+		workerManager.ResumeJobs(downloadQueue, spotify)
 
-		// Start Demucs worker pool
-		for i := 0; i < numDemucsWorkers; i++ {
-			go workerManager.DemucsWorker(demucsQueue)
-		}
-		log.Printf("Started %d Demucs workers", numDemucsWorkers)
+		// Start download and Demucs worker pools
+		workerManager.StartWorkers(downloadQueue, serverConfig.NumWorkers, serverConfig.NumDemucsWorkers)
 	} else {
 		// Start dummy workers that drain queues without processing
 		go func() {
-			for range downloadQueue {
+			for {
+				if _, ok := downloadQueue.Next(); !ok {
+					return
+				}
 				// Discard job
 			}
 		}()
@@ -157,30 +276,84 @@ func main() {
 				// Discard job
 			}
 		}()
-		log.Println("Started queue drain workers (no processing)")
+		slog.Info("Started queue drain workers (no processing)")
 	}
 
 	// Initialize API handlers
-	apiHandler := api.NewHandler(database, progress, downloadQueue, config)
+	apiHandler := api.NewHandler(database, progress, downloadQueue, workerManager, spotify)
 
-	// Register handlers
-	// Register handlers with CORS middleware
-	http.Handle("/setup-playlist", enableCORS(http.HandlerFunc(apiHandler.SetupPlaylistHandler)))
-	http.Handle("/tracks", enableCORS(http.HandlerFunc(apiHandler.TracksHandler)))
-	http.Handle("/tracks/", enableCORS(http.HandlerFunc(apiHandler.GetTrackHandler))) // Note: Trailing slash is important for subtree matching, but for specific ID we might need careful handling
-	http.Handle("/progress/stream", enableCORS(http.HandlerFunc(apiHandler.ProgressStreamHandler)))
+	// Optional SSE write coalescing (e.g. SSE_FLUSH_INTERVAL=50ms)
+	if envInterval := os.Getenv("SSE_FLUSH_INTERVAL"); envInterval != "" {
+		interval, err := time.ParseDuration(envInterval)
+		if err != nil {
+			fatal("Invalid SSE_FLUSH_INTERVAL", "value", envInterval, "error", err)
+		}
+		apiHandler.SSEFlushInterval = interval
+	}
+
+	// Playlist metadata cache lifetime (PLAYLIST_CACHE_TTL, default 5m; 0 disables it)
+	if envTTL := os.Getenv("PLAYLIST_CACHE_TTL"); envTTL != "" {
+		ttl, err := time.ParseDuration(envTTL)
+		if err != nil {
+			fatal("Invalid PLAYLIST_CACHE_TTL", "value", envTTL, "error", err)
+		}
+		apiHandler.PlaylistCache = core.NewMetadataCache(ttl)
+	}
+
+	// Register handlers. Patterns carry the method, so the mux answers a wrong one
+	// with 405 and reads path parameters such as {id} for the handlers.
+	// Optional API key (API_KEY) guards everything except the health check
+	requireAPIKey := api.RequireAPIKey(os.Getenv("API_KEY"))
+	mux := http.NewServeMux()
+	route := func(pattern string, handler http.HandlerFunc) {
+		mux.Handle(pattern, requireAPIKey(handler))
+	}
+	route("POST /setup-playlist", apiHandler.SetupPlaylistHandler)
+	route("POST /setup-album", apiHandler.SetupAlbumHandler)
+	route("POST /preview-playlist", apiHandler.PreviewPlaylistHandler)
+	route("POST /search", apiHandler.SearchHandler)
+	route("POST /setup-liked", apiHandler.SetupLikedHandler)
+	route("GET /auth/login", apiHandler.LoginHandler)
+	// Spotify redirects the browser here without an API key; the state cookie set by /auth/login guards it
+	mux.HandleFunc("GET /auth/callback", apiHandler.CallbackHandler)
+	route("GET /tracks", apiHandler.TracksHandler)
+	route("POST /tracks", apiHandler.AddTrackHandler)
+	route("GET /tracks/{id}", apiHandler.GetTrackHandler)
+	route("DELETE /tracks/{id}", apiHandler.DeleteTrackHandler)
+	route("POST /tracks/{id}/cancel", apiHandler.CancelTrackHandler)
+	route("POST /tracks/{id}/retry", apiHandler.RetryTrackHandler)
+	route("POST /tracks/{id}/source", apiHandler.SetTrackSourceHandler)
+	route("POST /tracks/{id}/separate", apiHandler.SeparateTrackHandler)
+	route("POST /tracks/{id}/purge-stems", apiHandler.PurgeStemsHandler)
+	route("GET /tracks/{id}/stems.zip", apiHandler.StemsZipHandler)
+	route("GET /tracks/{id}/audio/{stem}", apiHandler.AudioHandler) // GET patterns match HEAD too
+	mux.HandleFunc("GET /healthz", apiHandler.HealthHandler)
+	route("GET /metrics", apiHandler.MetricsHandler)
+	route("GET /queues", apiHandler.QueuesHandler)
+	route("GET /stats", apiHandler.StatsHandler)
+	route("GET /playlists", apiHandler.PlaylistsHandler)
+	route("POST /playlists/{id}/redownload", apiHandler.RedownloadPlaylistHandler)
+	route("POST /playlists/{id}/purge-stems", apiHandler.PurgePlaylistStemsHandler)
+	route("POST /retry-failed", apiHandler.RetryFailedHandler)
+	route("POST /admin/unstick", apiHandler.UnstickHandler)
+	route("GET /progress/stream", apiHandler.ProgressStreamHandler)
+	route("GET /progress/ws", apiHandler.ProgressWebSocketHandler)
 
 	// Serve static files
-	fs := http.FileServer(http.Dir("./songs"))
-	http.Handle("/songs/", http.StripPrefix("/songs/", enableCORS(fs)))
+	fs := http.FileServer(http.Dir(serverConfig.SongsDir))
+	mux.Handle("GET /songs/", http.StripPrefix("/songs/", requireAPIKey(fs)))
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	// CORS (ALLOWED_ORIGINS, default "*") wraps the whole mux: preflight OPTIONS
+	// requests match none of the method patterns above
+	enableCORS := newCORSMiddleware(os.Getenv("ALLOWED_ORIGINS"))
+	// Browsers don't apply CORS to WebSockets, so the progress socket checks the same origins itself
+	if allowAll, origins := parseAllowedOrigins(os.Getenv("ALLOWED_ORIGINS")); !allowAll {
+		apiHandler.AllowWebSocketOrigin = func(origin string) bool { return origins[origin] }
 	}
 
-	log.Printf("Server starting on port %s", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatal(err)
+	slog.Info("Server starting", "port", serverConfig.Port)
+	// Every route is logged with its status and latency
+	if err := http.ListenAndServe(":"+serverConfig.Port, api.LogRequests(enableCORS(mux))); err != nil {
+		fatal("Server stopped", "error", err)
 	}
 }
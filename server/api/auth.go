@@ -0,0 +1,122 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"separate/server/core"
+	"separate/server/models"
+	"separate/server/worker"
+)
+
+const (
+	// oauthStateCookie carries the login state between /auth/login and /auth/callback
+	oauthStateCookie = "spotify_oauth_state"
+	oauthStateMaxAge = 600 // seconds to finish logging in
+
+	// likedCollectionID groups Liked Songs the way a playlist ID groups its tracks
+	likedCollectionID = "liked"
+)
+
+// LoginHandler starts the Spotify authorization-code flow by redirecting the
+// browser to Spotify's consent page
+func (h *Handler) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	stateBytes := make([]byte, 16)
+	if _, err := rand.Read(stateBytes); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "Failed to generate login state")
+		return
+	}
+	state := hex.EncodeToString(stateBytes)
+
+	authorizeURL, err := h.Spotify.AuthorizeURL(state)
+	if err != nil {
+		writeJSONError(w, http.StatusServiceUnavailable, fmt.Sprintf("Spotify login unavailable: %v", err))
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    state,
+		Path:     "/auth",
+		MaxAge:   oauthStateMaxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode, // Sent on Spotify's top-level redirect back
+	})
+	http.Redirect(w, r, authorizeURL, http.StatusFound)
+}
+
+// CallbackHandler completes the login: it checks the state against the cookie
+// set by LoginHandler and exchanges the code for user tokens
+func (h *Handler) CallbackHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if denied := query.Get("error"); denied != "" {
+		writeJSONError(w, http.StatusForbidden, fmt.Sprintf("Spotify login failed: %s", denied))
+		return
+	}
+
+	cookie, err := r.Cookie(oauthStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(query.Get("state"))) != 1 {
+		writeJSONError(w, http.StatusBadRequest, "Login state mismatch; start again at /auth/login")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookie, Path: "/auth", MaxAge: -1})
+
+	code := query.Get("code")
+	if code == "" {
+		writeJSONError(w, http.StatusBadRequest, "code is required")
+		return
+	}
+
+	tokenResp, err := h.Spotify.ExchangeCode(r.Context(), code)
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("Failed to exchange authorization code: %v", err))
+		return
+	}
+
+	slog.Info("Spotify user logged in", "scope", tokenResp.Scope)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.AuthCallbackResponse{Authorized: true, Scope: tokenResp.Scope})
+}
+
+// SetupLikedHandler queues downloads for the logged-in user's Liked Songs
+func (h *Handler) SetupLikedHandler(w http.ResponseWriter, r *http.Request) {
+	// The body is optional; it only carries separation options and auto_demucs
+	var req models.SetupLikedRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	if err := worker.ValidateSeparationOptions(req.SeparationOptions); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	token, err := h.Spotify.UserAccessToken(r.Context())
+	if errors.Is(err, core.ErrUserNotAuthorized) {
+		writeJSONError(w, http.StatusUnauthorized, "Log in with Spotify at /auth/login first")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("Failed to get Spotify user token: %v", err))
+		return
+	}
+
+	metadata, err := h.Spotify.GetSavedTracks(r.Context(), token)
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("Failed to fetch saved tracks: %v", err))
+		return
+	}
+
+	if !h.queueCollection(w, likedCollectionID, metadata, req.SeparationOptions, req.AutoDemucs) {
+		return
+	}
+	slog.Info("Setup liked songs, downloads queued", "tracks", metadata.TotalTracks)
+}
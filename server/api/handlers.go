@@ -1,171 +1,1245 @@
 package api
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"hash/fnv"
+	"io"
+	"log/slog"
 	"net/http"
 	"os"
-	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"separate/server/core"
 	"separate/server/db"
 	"separate/server/models"
+	"separate/server/worker"
 )
 
+// sseFlushThreshold is how many buffered bytes force an early flush when SSE buffering is enabled
+const sseFlushThreshold = 2048
+
 type Handler struct {
-	DB            *db.DB
-	Progress      *core.ProgressBroadcaster
-	JobQueue      chan *models.DownloadJob
-	SpotifyConfig models.SpotifyConfig
+	DB       *db.DB
+	Progress *core.ProgressBroadcaster
+	JobQueue *worker.DownloadQueue
+	Workers  *worker.WorkerManager
+	Spotify  *core.SpotifyClient
+
+	// SSEFlushInterval coalesces SSE writes and flushes them at most this often.
+	// Zero flushes every event immediately.
+	SSEFlushInterval time.Duration
+
+	// PlaylistCache reuses recently fetched playlist metadata; nil disables it
+	PlaylistCache *core.MetadataCache
+
+	// AllowWebSocketOrigin reports whether a browser on origin may open the
+	// progress WebSocket, which CORS doesn't cover; nil allows any origin
+	AllowWebSocketOrigin func(origin string) bool
+
+	stats  statsCache
+	health healthCache
 }
 
-func NewHandler(db *db.DB, progress *core.ProgressBroadcaster, jobQueue chan *models.DownloadJob, config models.SpotifyConfig) *Handler {
+func NewHandler(db *db.DB, progress *core.ProgressBroadcaster, jobQueue *worker.DownloadQueue, workers *worker.WorkerManager, spotify *core.SpotifyClient) *Handler {
 	return &Handler{
-		DB:            db,
-		Progress:      progress,
-		JobQueue:      jobQueue,
-		SpotifyConfig: config,
+		DB:       db,
+		Progress: progress,
+		JobQueue: jobQueue,
+		Workers:  workers,
+		Spotify:  spotify,
+
+		PlaylistCache: core.NewMetadataCache(core.DefaultPlaylistCacheTTL),
+	}
+}
+
+// errorResponse is the JSON body of every API error
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// writeJSONError writes {"error": message} with the given status code
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: message})
+}
+
+// writeTrackLookupError reports a failed GetTrack as 404 if the track is missing, 500 otherwise
+func writeTrackLookupError(w http.ResponseWriter, err error) {
+	if errors.Is(err, db.ErrTrackNotFound) {
+		writeJSONError(w, http.StatusNotFound, "Track not found")
+		return
 	}
+	writeJSONError(w, http.StatusInternalServerError, "Database error")
 }
 
 // SetupPlaylistHandler creates directories for all tracks in a Spotify playlist
 func (h *Handler) SetupPlaylistHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	var req models.SetupPlaylistRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
 		return
 	}
 
-	var req models.SetupPlaylistRequest
+	if req.PlaylistID == "" {
+		writeJSONError(w, http.StatusBadRequest, "playlist_id is required")
+		return
+	}
+
+	playlistID, err := core.ParsePlaylistID(req.PlaylistID)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	req.PlaylistID = playlistID
+
+	if err := worker.ValidateSeparationOptions(req.SeparationOptions); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	metadata, ok := h.fetchPlaylist(r.Context(), w, req.PlaylistID)
+	if !ok {
+		return
+	}
+
+	if !h.queueCollection(w, req.PlaylistID, metadata, req.SeparationOptions, req.AutoDemucs) {
+		return
+	}
+	slog.Info("Setup playlist, downloads queued", "playlist_id", req.PlaylistID, "name", metadata.Name, "tracks", metadata.TotalTracks)
+}
+
+// SetupAlbumHandler creates directories and queues downloads for all tracks in a Spotify album
+func (h *Handler) SetupAlbumHandler(w http.ResponseWriter, r *http.Request) {
+	var req models.SetupAlbumRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	if req.AlbumID == "" {
+		writeJSONError(w, http.StatusBadRequest, "album_id is required")
+		return
+	}
+
+	albumID, err := core.ParseAlbumID(req.AlbumID)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	req.AlbumID = albumID
+
+	if err := worker.ValidateSeparationOptions(req.SeparationOptions); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	token, err := h.Spotify.GetAccessToken(r.Context())
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("Failed to get Spotify access token: %v", err))
+		return
+	}
+
+	metadata, err := h.Spotify.GetAlbumMetadataWithToken(r.Context(), req.AlbumID, token)
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("Failed to fetch album: %v", err))
+		return
+	}
+
+	// Album tracks are grouped under the album ID so playlist-scoped features work for albums too
+	if !h.queueCollection(w, req.AlbumID, metadata, req.SeparationOptions, req.AutoDemucs) {
+		return
+	}
+	slog.Info("Setup album, downloads queued", "album_id", req.AlbumID, "name", metadata.Name, "tracks", metadata.TotalTracks)
+}
+
+// PreviewPlaylistHandler returns the YouTube video each track of a playlist would be
+// downloaded from, so bad matches can be caught before anything is downloaded
+func (h *Handler) PreviewPlaylistHandler(w http.ResponseWriter, r *http.Request) {
+	var req models.PreviewPlaylistRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
 		return
 	}
 
 	if req.PlaylistID == "" {
-		http.Error(w, "playlist_id is required", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "playlist_id is required")
 		return
 	}
 
-	// Update config with playlist ID (volatile, but needed for token fetching if strictly bound)
-	// Actually, GetPlaylistMetadataWithToken just needs a token.
-	// We'll get a token using client credentials.
-	token, err := core.GetAccessToken(h.SpotifyConfig)
+	playlistID, err := core.ParsePlaylistID(req.PlaylistID)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get Spotify access token: %v", err), http.StatusInternalServerError)
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	metadata, ok := h.fetchPlaylist(r.Context(), w, playlistID)
+	if !ok {
+		return
+	}
+
+	// Searches stop if the client goes away
+	previews := worker.PreviewMatches(r.Context(), metadata.Tracks)
+	slog.Info("Previewed playlist matches", "playlist_id", playlistID, "tracks", len(previews))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(previews)
+}
+
+// defaultSearchLimit is how many candidates a search returns when the request doesn't say
+const defaultSearchLimit = 5
+
+// SearchHandler searches Spotify for tracks so a client can pick one to add
+// without knowing its ID
+func (h *Handler) SearchHandler(w http.ResponseWriter, r *http.Request) {
+	var req models.SearchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
 		return
 	}
 
-	// Fetch playlist metadata using cached token
-	metadata, err := core.GetPlaylistMetadataWithToken(req.PlaylistID, token)
+	req.Query = strings.TrimSpace(req.Query)
+	if req.Query == "" {
+		writeJSONError(w, http.StatusBadRequest, "query is required")
+		return
+	}
+	if req.Limit == 0 {
+		req.Limit = defaultSearchLimit
+	}
+	if req.Limit < 1 || req.Limit > core.MaxSearchLimit {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", core.MaxSearchLimit))
+		return
+	}
+
+	token, err := h.Spotify.GetAccessToken(r.Context())
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("Failed to get Spotify access token: %v", err))
+		return
+	}
+
+	tracks, err := h.Spotify.SearchTracks(r.Context(), req.Query, req.Limit, token)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to fetch playlist: %v", err), http.StatusInternalServerError)
+		writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("Failed to search Spotify: %v", err))
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tracks)
+}
+
+// fetchPlaylist returns a playlist's metadata, from PlaylistCache when it was
+// fetched recently. It reports false if an error response was written instead.
+func (h *Handler) fetchPlaylist(ctx context.Context, w http.ResponseWriter, playlistID string) (*models.PlaylistMetadata, bool) {
+	if metadata, ok := h.PlaylistCache.Get(playlistID); ok {
+		slog.Debug("Using cached playlist metadata", "playlist_id", playlistID)
+		return metadata, true
+	}
+
+	token, err := h.Spotify.GetAccessToken(ctx)
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("Failed to get Spotify access token: %v", err))
+		return nil, false
+	}
+
+	metadata, err := h.Spotify.GetPlaylistMetadataWithToken(ctx, playlistID, token)
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("Failed to fetch playlist: %v", err))
+		return nil, false
+	}
+	h.PlaylistCache.Set(playlistID, metadata)
+	return metadata, true
+}
+
+// queueCollection creates track directories, saves the tracks under collectionID,
+// enqueues their downloads and writes the setup response. It reports false if an
+// error response was written instead. A non-nil autoDemucs overrides AUTO_DEMUCS.
+func (h *Handler) queueCollection(w http.ResponseWriter, collectionID string, metadata *models.PlaylistMetadata, separation models.SeparationOptions, autoDemucs *bool) bool {
 	// Create directory structure for each track
 	trackIDs := make([]string, 0, len(metadata.Tracks))
 	for _, track := range metadata.Tracks {
-		trackDir := filepath.Join("songs", track.ID)
+		trackDir := worker.TrackDir(track.ID)
 		if err := os.MkdirAll(trackDir, 0755); err != nil {
-			http.Error(w, fmt.Sprintf("Failed to create directory: %v", err), http.StatusInternalServerError)
-			return
+			writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to create directory: %v", err))
+			return false
 		}
 		trackIDs = append(trackIDs, track.ID)
 	}
 
-	// Save to DB
-	err = h.DB.SavePlaylistTracks(req.PlaylistID, metadata.Tracks)
+	// Look up tracks shared with collections set up earlier before saving adds the new ones
+	statuses, err := h.DB.GetExistingStatuses(trackIDs)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Database error: %v", err), http.StatusInternalServerError)
-		return
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Database error: %v", err))
+		return false
 	}
 
-	// Enqueue download jobs for each track
+	// Save to DB
+	if err := h.DB.SavePlaylistTracks(collectionID, metadata.Tracks); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Database error: %v", err))
+		return false
+	}
+
+	// Enqueue download jobs for each new or still-pending track, and tell clients
+	// right away so rows don't sit silent until a worker gets to them. Tracks
+	// already downloaded, downloading or failed are left as they are, as are
+	// pending tracks another collection already has a job for.
+	alreadyDownloaded := 0
+	var queue []models.TrackMetadata
 	for _, track := range metadata.Tracks {
-		h.JobQueue <- &models.DownloadJob{Track: track}
+		if status, exists := statuses[track.ID]; exists && status != "pending" {
+			if status == "completed" {
+				alreadyDownloaded++
+			}
+			continue
+		}
+		if h.hasDownloadJob(track.ID) {
+			continue
+		}
+		queue = append(queue, track)
+	}
+
+	opts := models.JobOptions{PlaylistID: collectionID, Separation: separation, AutoDemucs: autoDemucs}
+	if err := h.DB.SetJobOptions(trackIDsOf(queue), opts); err != nil {
+		slog.Warn("Failed to save job options", "playlist_id", collectionID, "error", err)
+	}
+	for _, track := range queue {
+		position := h.JobQueue.Enqueue(downloadJob(track, opts, models.PriorityHigh))
+		h.Progress.SendEvent(models.ProgressEvent{
+			TrackID:       track.ID,
+			Type:          "download",
+			Status:        "queued",
+			QueuePosition: position,
+		})
 	}
 
 	// Return response immediately
 	response := models.SetupPlaylistResponse{
-		PlaylistName: metadata.Name,
-		TotalTracks:  metadata.TotalTracks,
-		TrackIDs:     trackIDs,
+		PlaylistName:      metadata.Name,
+		TotalTracks:       metadata.TotalTracks,
+		TrackIDs:          trackIDs,
+		SkippedTracks:     metadata.SkippedTracks,
+		AlreadyDownloaded: alreadyDownloaded,
+	}
+
+	if metadata.SkippedTracks > 0 {
+		slog.Info("Skipped local/unavailable tracks and episodes", "playlist_id", collectionID, "skipped", metadata.SkippedTracks)
+	}
+	if alreadyDownloaded > 0 {
+		slog.Info("Skipped already downloaded tracks", "playlist_id", collectionID, "already_downloaded", alreadyDownloaded)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
+	return true
+}
 
-	log.Printf("Setup playlist: %s (%d tracks), downloads queued", metadata.Name, metadata.TotalTracks)
+// hasDownloadJob reports whether trackID's download is already queued, parked
+// or running, so queueing it again would download it twice
+func (h *Handler) hasDownloadJob(trackID string) bool {
+	return h.JobQueue.Position(trackID) > 0 || h.Workers.HasJob(trackID)
 }
 
-// TracksHandler returns current state snapshot of all tracks
+// AddTrackHandler queues a single Spotify track for download without a playlist.
+// A track that already exists is returned as is with 200 rather than re-queued;
+// a new one is returned with 202 once its download is queued.
+func (h *Handler) AddTrackHandler(w http.ResponseWriter, r *http.Request) {
+	var req models.AddTrackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	if req.TrackID == "" {
+		writeJSONError(w, http.StatusBadRequest, "track_id is required")
+		return
+	}
+
+	trackID, err := core.ParseTrackID(req.TrackID)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := worker.ValidateSeparationOptions(req.SeparationOptions); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Skip Spotify entirely for tracks we already have
+	if existing, err := h.DB.GetTrack(trackID); err == nil {
+		existing.ActiveJob = h.Workers.ActiveJobs()[trackID]
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(existing)
+		return
+	} else if !errors.Is(err, db.ErrTrackNotFound) {
+		writeTrackLookupError(w, err)
+		return
+	}
+
+	token, err := h.Spotify.GetAccessToken(r.Context())
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("Failed to get Spotify access token: %v", err))
+		return
+	}
+
+	metadata, err := h.Spotify.GetTrackMetadata(r.Context(), trackID, token)
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("Failed to fetch track: %v", err))
+		return
+	}
+
+	if err := os.MkdirAll(worker.TrackDir(metadata.ID), 0755); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to create directory: %v", err))
+		return
+	}
+
+	created, err := h.DB.SaveTrack(*metadata)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Database error: %v", err))
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		// A concurrent request for the same track may have saved it first; only the one that created it queues
+		opts := models.JobOptions{Separation: req.SeparationOptions, AutoDemucs: req.AutoDemucs}
+		if err := h.DB.SetJobOptions([]string{metadata.ID}, opts); err != nil {
+			slog.Warn("Failed to save job options", "track_id", metadata.ID, "error", err)
+		}
+		position := h.JobQueue.Enqueue(downloadJob(*metadata, opts, models.PriorityHigh))
+		h.Progress.SendEvent(models.ProgressEvent{
+			TrackID:       metadata.ID,
+			Type:          "download",
+			Status:        "queued",
+			QueuePosition: position,
+		})
+		status = http.StatusAccepted
+		slog.Info("Added track, download queued", "track_id", metadata.ID, "name", metadata.Name)
+	}
+
+	track, err := h.DB.GetTrack(metadata.ID)
+	if err != nil {
+		writeTrackLookupError(w, err)
+		return
+	}
+	track.ActiveJob = h.Workers.ActiveJobs()[track.TrackID]
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(track)
+}
+
+// TracksHandler returns current state snapshot of all tracks, optionally filtered by
+// ?download_status=, ?demucs_status=, ?playlist_id= and ?q= (name/artist substring)
 func (h *Handler) TracksHandler(w http.ResponseWriter, r *http.Request) {
-	tracks, err := h.DB.GetAllTracks()
+	// Pollers revalidate with If-None-Match and get a 304 until a track changes
+	etag, err := h.tracksETag(r.URL.RawQuery)
 	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
+		writeJSONError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
+	query := r.URL.Query()
+	filter := models.TrackFilter{
+		DownloadStatus: query.Get("download_status"),
+		DemucsStatus:   query.Get("demucs_status"),
+		PlaylistID:     query.Get("playlist_id"),
+		Query:          query.Get("q"),
+	}
+
+	tracks, err := h.DB.QueryTracks(filter)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if tracks == nil {
+		tracks = []models.TrackState{} // Encode an empty filter result as [] rather than null
+	}
+
+	// The database only knows what was marked in_progress; the workers know what is running
+	activeJobs := h.Workers.ActiveJobs()
+	for i := range tracks {
+		tracks[i].ActiveJob = activeJobs[tracks[i].TrackID]
+		h.addLiveProgress(&tracks[i])
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(tracks)
 }
 
+// MetricsHandler exposes queue depths, track status counts and job counters
+// in the Prometheus text exposition format
+func (h *Handler) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	counts, err := h.DB.CountByStatus()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP splitter_queue_depth Jobs waiting in each in-memory queue.")
+	fmt.Fprintln(w, "# TYPE splitter_queue_depth gauge")
+	fmt.Fprintf(w, "splitter_queue_depth{queue=\"download\"} %d\n", h.JobQueue.Len())
+	fmt.Fprintf(w, "splitter_queue_depth{queue=\"demucs\"} %d\n", h.Workers.DemucsQueueDepth())
+
+	fmt.Fprintln(w, "# HELP splitter_tracks Tracks in the database by stage and status.")
+	fmt.Fprintln(w, "# TYPE splitter_tracks gauge")
+	for _, stage := range []string{"download", "demucs"} {
+		statuses := make([]string, 0, len(counts[stage]))
+		for status := range counts[stage] {
+			statuses = append(statuses, status)
+		}
+		sort.Strings(statuses)
+		for _, status := range statuses {
+			fmt.Fprintf(w, "splitter_tracks{stage=%q,status=%q} %d\n", stage, status, counts[stage][status])
+		}
+	}
+
+	jobs := h.Workers.JobCounts()
+	fmt.Fprintln(w, "# HELP splitter_jobs_processed_total Jobs finished since the server started.")
+	fmt.Fprintln(w, "# TYPE splitter_jobs_processed_total counter")
+	fmt.Fprintf(w, "splitter_jobs_processed_total{stage=\"download\",result=\"completed\"} %d\n", jobs.DownloadsCompleted)
+	fmt.Fprintf(w, "splitter_jobs_processed_total{stage=\"download\",result=\"failed\"} %d\n", jobs.DownloadsFailed)
+	fmt.Fprintf(w, "splitter_jobs_processed_total{stage=\"demucs\",result=\"completed\"} %d\n", jobs.DemucsCompleted)
+	fmt.Fprintf(w, "splitter_jobs_processed_total{stage=\"demucs\",result=\"failed\"} %d\n", jobs.DemucsFailed)
+
+	fmt.Fprintln(w, "# HELP splitter_spotify_token_refreshes_total Spotify client-credentials tokens fetched since the server started.")
+	fmt.Fprintln(w, "# TYPE splitter_spotify_token_refreshes_total counter")
+	fmt.Fprintf(w, "splitter_spotify_token_refreshes_total %d\n", h.Spotify.TokenRefreshes())
+}
+
+// QueuesHandler reports how backed up each stage is. Unlike /metrics it is
+// plain JSON, meant for the UI to poll.
+func (h *Handler) QueuesHandler(w http.ResponseWriter, r *http.Request) {
+	counts, err := h.DB.CountByStatus()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	stage := func(kind string) models.StageCounts {
+		return models.StageCounts{
+			Pending:    counts[kind]["pending"],
+			InProgress: counts[kind]["in_progress"],
+			Failed:     counts[kind]["failed"],
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.QueuesResponse{
+		Download:           stage("download"),
+		Demucs:             stage("demucs"),
+		DownloadQueueDepth: h.JobQueue.Len(),
+		DemucsQueueDepth:   h.Workers.DemucsQueueDepth(),
+	})
+}
+
+// PlaylistsHandler returns each set-up playlist with aggregate download and Demucs status
+func (h *Handler) PlaylistsHandler(w http.ResponseWriter, r *http.Request) {
+	summaries, err := h.DB.GetPlaylistSummaries(h.Workers.AutoDemucs())
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summaries)
+}
+
+// RedownloadPlaylistHandler wipes the downloaded audio and stems for every track
+// in a playlist, resets them to pending and queues fresh downloads. Tracks that
+// also belong to another playlist are left alone.
+func (h *Handler) RedownloadPlaylistHandler(w http.ResponseWriter, r *http.Request) {
+	playlistID := r.PathValue("id")
+
+	trackIDs, err := h.DB.GetPlaylistTrackIDs(playlistID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if len(trackIDs) == 0 {
+		writeJSONError(w, http.StatusNotFound, "Playlist not found")
+		return
+	}
+	shared, err := h.DB.GetSharedTrackIDs(playlistID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	// Every track is checked before anything is touched, so a conflict leaves
+	// the whole playlist as it was
+	var tracks []*models.TrackState
+	for trackID := range trackIDs {
+		if shared[trackID] {
+			continue
+		}
+		// The reset covers every unshared track, so one that can't be read
+		// would be left pending with nothing queued to download it
+		track, err := h.DB.GetTrack(trackID)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Database error reading track %s: %v", trackID, err))
+			return
+		}
+		// Wiping files under a running or queued worker job would corrupt its output
+		if h.Workers.IsActive(trackID) || h.Workers.HasDemucsJob(trackID) {
+			writeJSONError(w, http.StatusConflict, "Playlist has tracks currently being processed")
+			return
+		}
+		tracks = append(tracks, track)
+	}
+	metadata := h.refetchMetadata(r.Context(), tracks)
+	options := h.jobOptions(tracks)
+
+	if err := h.DB.ResetPlaylistForRedownload(playlistID); err != nil {
+		if errors.Is(err, db.ErrJobInProgress) {
+			writeJSONError(w, http.StatusConflict, "Playlist has tracks currently being processed")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Database error: %v", err))
+		return
+	}
+
+	response := models.RedownloadResponse{PlaylistID: playlistID, SharedTracks: len(shared)}
+	for _, track := range tracks {
+		// IDs come from the database, so they are real track directories
+		if err := os.RemoveAll(worker.TrackDir(track.TrackID)); err != nil {
+			slog.Error("Failed to remove track files", "track_id", track.TrackID, "error", err)
+		}
+		response.ResetTracks++
+
+		// A track already on the queue downloads again when it gets its turn
+		if h.JobQueue.Position(track.TrackID) > 0 {
+			continue
+		}
+		opts := options[track.TrackID]
+		opts.PlaylistID = playlistID
+		h.JobQueue.Enqueue(downloadJob(metadata[track.TrackID], opts, models.PriorityHigh))
+		response.QueuedTracks++
+	}
+
+	slog.Info("Re-downloading playlist", "playlist_id", playlistID,
+		"reset", response.ResetTracks, "queued", response.QueuedTracks, "shared", response.SharedTracks)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(response)
+}
+
+// jobAttempts returns how many times a track's "download" or "demucs" job has run
+func jobAttempts(track *models.TrackState, kind string) int {
+	if kind == "download" {
+		return track.DownloadAttempts
+	}
+	return track.DemucsAttempts
+}
+
+// jobOptions returns the options tracks were queued with, keyed by track ID.
+// Tracks without any run with the defaults.
+func (h *Handler) jobOptions(tracks []*models.TrackState) map[string]models.JobOptions {
+	trackIDs := make([]string, len(tracks))
+	for i, track := range tracks {
+		trackIDs[i] = track.TrackID
+	}
+	options, err := h.DB.GetJobOptions(trackIDs)
+	if err != nil {
+		slog.Warn("Failed to load job options, using defaults", "tracks", len(trackIDs), "error", err)
+		return map[string]models.JobOptions{}
+	}
+	return options
+}
+
+// downloadJob builds a track's download job with the options it was queued with
+func downloadJob(track models.TrackMetadata, opts models.JobOptions, priority int) *models.DownloadJob {
+	return &models.DownloadJob{
+		Track:      track,
+		Separation: opts.Separation,
+		Priority:   priority,
+		PlaylistID: opts.PlaylistID,
+		AutoDemucs: opts.AutoDemucs,
+	}
+}
+
+// demucsJob builds a downloaded track's Demucs job with the options it was queued with
+func demucsJob(track models.TrackMetadata, opts models.JobOptions) *models.DemucsJob {
+	return &models.DemucsJob{
+		Track:             track,
+		InputPath:         worker.BaseAudioPath(track.ID),
+		SeparationOptions: opts.Separation,
+	}
+}
+
+// trackIDsOf returns the IDs of tracks
+func trackIDsOf(tracks []models.TrackMetadata) []string {
+	trackIDs := make([]string, len(tracks))
+	for i, track := range tracks {
+		trackIDs[i] = track.ID
+	}
+	return trackIDs
+}
+
+// failedKind returns which of a failed track's jobs to retry, "download" or "demucs"
+func failedKind(track *models.TrackState) string {
+	if track.DownloadStatus == "failed" {
+		return "download"
+	}
+	return "demucs"
+}
+
+// metadataFromState rebuilds the track metadata needed to queue a job from its stored state
+func metadataFromState(track *models.TrackState) models.TrackMetadata {
+	return models.TrackMetadata{
+		ID:      track.TrackID,
+		Name:    track.Name,
+		Artists: strings.Split(track.Artists, ", "),
+	}
+}
+
+// refetchMetadata returns the Spotify metadata of tracks being queued again, keyed
+// by track ID. The database keeps only names and artists, and a job without the
+// album, duration, ISRC and cover art matches, validates and tags its track
+// worse. Tracks Spotify doesn't return, or all of them if it fails, fall back to
+// their stored state.
+func (h *Handler) refetchMetadata(ctx context.Context, tracks []*models.TrackState) map[string]models.TrackMetadata {
+	metadata := make(map[string]models.TrackMetadata, len(tracks))
+	trackIDs := make([]string, len(tracks))
+	for i, track := range tracks {
+		metadata[track.TrackID] = metadataFromState(track)
+		trackIDs[i] = track.TrackID
+	}
+	if len(trackIDs) == 0 {
+		return metadata
+	}
+
+	token, err := h.Spotify.GetAccessToken(ctx)
+	if err == nil {
+		var fetched []models.TrackMetadata
+		fetched, err = h.Spotify.GetTracksMetadata(ctx, trackIDs, token)
+		for _, track := range fetched {
+			metadata[track.ID] = track
+		}
+	}
+	if err != nil {
+		slog.Warn("Failed to refetch track metadata, using stored names", "tracks", len(trackIDs), "error", err)
+	}
+	return metadata
+}
+
 // GetTrackHandler returns metadata for a single track
 func (h *Handler) GetTrackHandler(w http.ResponseWriter, r *http.Request) {
-	// Extract track ID from URL path (assuming /tracks/{id})
-	// Since we are using standard net/http, we might need to parse it manually if using StripPrefix or similar,
-	// but here we will assume it's passed as a query param or parse it from path if using main router.
-	// Actually, let's assume the router in main.go handles the path pattern or we parse it here.
-	// For simplicity with standard mux, we'll strip prefix in main.go or simple parsing:
-	// Path: /tracks/<id>
+	id := r.PathValue("id")
+
+	track, err := h.DB.GetTrack(id)
+	if err != nil {
+		writeTrackLookupError(w, err)
+		return
+	}
+	track.ActiveJob = h.Workers.ActiveJobs()[id]
+	h.addLiveProgress(track)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(track)
+}
+
+// tracksETag returns a weak ETag for the track list at rawQuery. It is built
+// from the filters, the latest database change, the live progress version and
+// the jobs workers hold, rather than a hash of the response, so a matching
+// request is answered without querying the tracks.
+func (h *Handler) tracksETag(rawQuery string) (string, error) {
+	maxUpdatedAt, count, err := h.DB.GetMaxUpdatedAt()
+	if err != nil {
+		return "", err
+	}
+	// A job can start or stop without touching its row, which changes active_job
+	activeJobs := h.Workers.ActiveJobs()
+	trackIDs := make([]string, 0, len(activeJobs))
+	for trackID := range activeJobs {
+		trackIDs = append(trackIDs, trackID)
+	}
+	sort.Strings(trackIDs)
+
+	// Timestamps contain spaces, which ETags can't, so hash the parts
+	hash := fnv.New64a()
+	fmt.Fprintf(hash, "%s|%s|%d|%d", rawQuery, maxUpdatedAt, count, h.Progress.ProgressVersion())
+	for _, trackID := range trackIDs {
+		fmt.Fprintf(hash, "|%s=%s", trackID, activeJobs[trackID])
+	}
+	return fmt.Sprintf(`W/"%x"`, hash.Sum64()), nil
+}
+
+// etagMatches reports whether an If-None-Match header matches etag, using the
+// weak comparison RFC 9110 prescribes for If-None-Match
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// addLiveProgress fills in the progress of a track's running jobs, which the
+// database leaves at 0, from the latest progress events
+func (h *Handler) addLiveProgress(track *models.TrackState) {
+	if track.DownloadStatus == "in_progress" {
+		if progress, ok := h.Progress.Progress(track.TrackID, "download"); ok {
+			track.DownloadProgress = progress
+		}
+	}
+	if track.DemucsStatus == "in_progress" {
+		if progress, ok := h.Progress.Progress(track.TrackID, "demucs"); ok {
+			track.DemucsProgress = progress
+		}
+	}
+}
+
+// DeleteTrackHandler removes a track, its playlist associations and its files
+func (h *Handler) DeleteTrackHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	track, err := h.DB.GetTrack(id)
+	if err != nil {
+		writeTrackLookupError(w, err)
+		return
+	}
+
+	// Deleting mid-flight would leave a worker writing into a removed directory
+	if track.DownloadStatus == "in_progress" || track.DemucsStatus == "in_progress" || h.Workers.IsActive(id) {
+		writeJSONError(w, http.StatusConflict, "Track is currently being processed")
+		return
+	}
+
+	if err := h.DB.DeleteTrack(id); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Database error: %v", err))
+		return
+	}
+
+	// The ID was just matched against the database, so it is a real track directory
+	if err := os.RemoveAll(worker.TrackDir(track.TrackID)); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to remove files: %v", err))
+		return
+	}
+
+	slog.Info("Deleted track", "track_id", track.TrackID, "track", track.Name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RetryTrackHandler resets a failed download or Demucs job to pending and re-queues it.
+// A job that has used up its attempts is only retried with ?force=true.
+func (h *Handler) RetryTrackHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	track, err := h.DB.GetTrack(id)
+	if err != nil {
+		writeTrackLookupError(w, err)
+		return
+	}
+
+	var kind string
+	switch {
+	case track.DownloadStatus == "in_progress" || track.DemucsStatus == "in_progress":
+		writeJSONError(w, http.StatusConflict, "Track is currently being processed")
+		return
+	case track.DownloadStatus == "failed":
+		kind = "download"
+	case track.DemucsStatus == "failed":
+		kind = "demucs"
+	default:
+		writeJSONError(w, http.StatusBadRequest, "Track has no failed job to retry")
+		return
+	}
+
+	if attempts := jobAttempts(track, kind); attempts >= h.Workers.MaxAttempts() && r.URL.Query().Get("force") != "true" {
+		writeJSONError(w, http.StatusConflict, fmt.Sprintf("Track has failed %d times; retry with ?force=true to try again", attempts))
+		return
+	}
+
+	// Fetched before the reset so the track isn't left pending with no job while Spotify answers
+	metadata := h.refetchMetadata(r.Context(), []*models.TrackState{track})[id]
+	opts := h.jobOptions([]*models.TrackState{track})[id]
+
+	if err := h.DB.ResetForRetry(id, kind); err != nil {
+		if errors.Is(err, db.ErrTrackNotFound) {
+			writeTrackLookupError(w, err)
+			return
+		}
+		if errors.Is(err, db.ErrJobInProgress) {
+			writeJSONError(w, http.StatusConflict, "Track is currently being processed")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Database error: %v", err))
+		return
+	}
+
+	if kind == "download" {
+		h.JobQueue.Enqueue(downloadJob(metadata, opts, models.PriorityHigh))
+	} else {
+		h.Workers.QueueDemucs(demucsJob(metadata, opts))
+	}
+
+	track, err = h.DB.GetTrack(id)
+	if err != nil {
+		writeTrackLookupError(w, err)
+		return
+	}
+
+	slog.Info("Retrying track", "track_id", track.TrackID, "worker_type", kind)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(track)
+}
+
+// SetTrackSourceHandler pins the YouTube video a track is downloaded from, for when
+// the search picked the wrong one, and downloads the track again from that video
+func (h *Handler) SetTrackSourceHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	var req models.TrackSourceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	if req.YouTubeURL == "" {
+		writeJSONError(w, http.StatusBadRequest, "youtube_url is required")
+		return
+	}
+
+	sourceURL, err := worker.ParseYouTubeURL(req.YouTubeURL)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	track, err := h.DB.GetTrack(id)
+	if err != nil {
+		writeTrackLookupError(w, err)
+		return
+	}
+	// A queued separation still needs the audio this request removes
+	if h.Workers.IsActive(id) || h.Workers.HasDemucsJob(id) {
+		writeJSONError(w, http.StatusConflict, "Track is currently being processed")
+		return
+	}
+	metadata := h.refetchMetadata(r.Context(), []*models.TrackState{track})[id]
+	opts := h.jobOptions([]*models.TrackState{track})[id]
+
+	if err := h.DB.SetSourceURL(id, sourceURL); err != nil {
+		if errors.Is(err, db.ErrJobInProgress) {
+			writeJSONError(w, http.StatusConflict, "Track is currently being processed")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Database error: %v", err))
+		return
+	}
+
+	// The old audio and stems came from the wrong video
+	if err := os.RemoveAll(worker.TrackDir(id)); err != nil {
+		slog.Error("Failed to remove track files", "track_id", id, "error", err)
+	}
+
+	// A download still waiting on the queue or parked for its playlist reads
+	// the new source when it runs
+	if !h.hasDownloadJob(id) {
+		h.JobQueue.Enqueue(downloadJob(metadata, opts, models.PriorityHigh))
+	}
+
+	track, err = h.DB.GetTrack(id)
+	if err != nil {
+		writeTrackLookupError(w, err)
+		return
+	}
+
+	slog.Info("Set track source", "track_id", id, "source_url", sourceURL)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(track)
+}
+
+// SeparateTrackHandler re-runs Demucs on an already downloaded track with new
+// separation options, e.g. to try another model without downloading again. An
+// empty body uses the defaults.
+func (h *Handler) SeparateTrackHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
 
-	id := filepath.Base(r.URL.Path)
-	if id == "" || id == "tracks" {
-		http.Error(w, "Track ID required", http.StatusBadRequest)
+	var opts models.SeparationOptions
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil && !errors.Is(err, io.EOF) {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	if err := worker.ValidateSeparationOptions(opts); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
 	track, err := h.DB.GetTrack(id)
 	if err != nil {
-		http.Error(w, "Track not found", http.StatusNotFound)
+		writeTrackLookupError(w, err)
+		return
+	}
+	// A separation already on the Demucs queue is still pending in the database
+	if track.DownloadStatus == "in_progress" || track.DemucsStatus == "in_progress" ||
+		h.hasDownloadJob(id) || h.Workers.HasDemucsJob(id) {
+		writeJSONError(w, http.StatusConflict, "Track is currently being processed")
 		return
 	}
 
+	inputPath := worker.BaseAudioPath(id)
+	if _, err := os.Stat(inputPath); err != nil {
+		writeJSONError(w, http.StatusNotFound, "Track has not been downloaded")
+		return
+	}
+	metadata := h.refetchMetadata(r.Context(), []*models.TrackState{track})[id]
+	// Later retries separate the track the same way
+	stored := h.jobOptions([]*models.TrackState{track})[id]
+	stored.Separation = opts
+	if err := h.DB.SetJobOptions([]string{id}, stored); err != nil {
+		slog.Warn("Failed to save job options", "track_id", id, "error", err)
+	}
+
+	if err := h.DB.ResetForRetry(id, "demucs"); err != nil {
+		if errors.Is(err, db.ErrTrackNotFound) {
+			writeTrackLookupError(w, err)
+			return
+		}
+		if errors.Is(err, db.ErrJobInProgress) {
+			writeJSONError(w, http.StatusConflict, "Track is currently being processed")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Database error: %v", err))
+		return
+	}
+
+	h.Workers.QueueDemucs(&models.DemucsJob{
+		Track:             metadata,
+		InputPath:         inputPath,
+		SeparationOptions: opts,
+	})
+
+	track, err = h.DB.GetTrack(id)
+	if err != nil {
+		writeTrackLookupError(w, err)
+		return
+	}
+
+	slog.Info("Re-running separation", "track_id", id, "model", opts.Model, "two_stems", opts.TwoStems, "shifts", opts.Shifts)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
 	json.NewEncoder(w).Encode(track)
 }
 
+// CancelTrackHandler stops the download or Demucs job currently running for a track.
+// The worker records the job as failed with "cancelled by user".
+func (h *Handler) CancelTrackHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	if _, err := h.DB.GetTrack(id); err != nil {
+		writeTrackLookupError(w, err)
+		return
+	}
+
+	if !h.Workers.Cancel(id) {
+		writeJSONError(w, http.StatusConflict, "Track has no running job to cancel")
+		return
+	}
+
+	slog.Info("Cancel requested", "track_id", id)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// RetryFailedHandler resets every failed download or Demucs job, or only those
+// of one playlist with ?playlist_id=, and queues them again. Jobs that have used
+// up their attempts are skipped; retry them one by one with ?force=true.
+func (h *Handler) RetryFailedHandler(w http.ResponseWriter, r *http.Request) {
+	playlistID := r.URL.Query().Get("playlist_id")
+	tracks, err := h.DB.GetFailedTracks(playlistID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Database error: %v", err))
+		return
+	}
+
+	response := models.RetryFailedResponse{PlaylistID: playlistID}
+	var retries []*models.TrackState
+	for i := range tracks {
+		track := &tracks[i]
+		// A worker or a queued job already has it
+		if h.Workers.IsActive(track.TrackID) || h.JobQueue.Position(track.TrackID) > 0 {
+			continue
+		}
+		if jobAttempts(track, failedKind(track)) >= h.Workers.MaxAttempts() {
+			response.Exhausted++
+			continue
+		}
+		retries = append(retries, track)
+	}
+
+	// One batch lookup for the lot rather than a request per track
+	metadata := h.refetchMetadata(r.Context(), retries)
+	options := h.jobOptions(retries)
+	for _, track := range retries {
+		kind := failedKind(track)
+		// Only the request that flips the failure queues the job, so concurrent
+		// retries can't queue a track twice
+		reset, err := h.DB.ResetFailedForRetry(track.TrackID, kind)
+		if err != nil {
+			slog.Error("Failed to reset track", "track_id", track.TrackID, "worker_type", kind, "error", err)
+			continue
+		}
+		if !reset {
+			continue
+		}
+
+		opts := options[track.TrackID]
+		if playlistID != "" {
+			opts.PlaylistID = playlistID
+		}
+		if kind == "download" {
+			h.JobQueue.Enqueue(downloadJob(metadata[track.TrackID], opts, models.PriorityLow))
+			response.RequeuedDownloads++
+		} else {
+			h.Workers.QueueDemucs(demucsJob(metadata[track.TrackID], opts))
+			response.RequeuedDemucs++
+		}
+	}
+	response.Requeued = response.RequeuedDownloads + response.RequeuedDemucs
+
+	slog.Info("Retrying failed tracks", "playlist_id", playlistID,
+		"downloads", response.RequeuedDownloads, "demucs", response.RequeuedDemucs, "exhausted", response.Exhausted)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(response)
+}
+
+// UnstickHandler resets tracks left in_progress with no worker attached and re-queues them
+func (h *Handler) UnstickHandler(w http.ResponseWriter, r *http.Request) {
+	tracks, err := h.DB.GetInProgressTracks()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Database error: %v", err))
+		return
+	}
+
+	var stuck []*models.TrackState
+	for i := range tracks {
+		if !h.Workers.IsActive(tracks[i].TrackID) {
+			stuck = append(stuck, &tracks[i])
+		}
+	}
+
+	var response models.UnstickResponse
+	metadata := h.refetchMetadata(r.Context(), stuck)
+	options := h.jobOptions(stuck)
+	for _, track := range stuck {
+		if track.DownloadStatus == "in_progress" {
+			if err := h.DB.UpdateDownloadStatus(track.TrackID, "pending", ""); err != nil {
+				slog.Error("Failed to reset track", "track_id", track.TrackID, "worker_type", "download", "error", err)
+				continue
+			}
+			h.JobQueue.Enqueue(downloadJob(metadata[track.TrackID], options[track.TrackID], models.PriorityHigh))
+			response.ResetDownloads++
+		} else if track.DemucsStatus == "in_progress" {
+			if err := h.DB.UpdateDemucsStatus(track.TrackID, "pending", ""); err != nil {
+				slog.Error("Failed to reset track", "track_id", track.TrackID, "worker_type", "demucs", "error", err)
+				continue
+			}
+			h.Workers.QueueDemucs(demucsJob(metadata[track.TrackID], options[track.TrackID]))
+			response.ResetDemucs++
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+
+	slog.Info("Unstuck jobs", "downloads", response.ResetDownloads, "demucs", response.ResetDemucs)
+}
+
+// snapshotEvents converts stored track state into progress events for replay to new subscribers
+func snapshotEvents(tracks []models.TrackState) []models.ProgressEvent {
+	events := make([]models.ProgressEvent, 0, len(tracks)*2)
+	for _, track := range tracks {
+		downloadStatus := track.DownloadStatus
+		if downloadStatus == "in_progress" {
+			downloadStatus = "downloading"
+		}
+		demucsStatus := track.DemucsStatus
+		if demucsStatus == "in_progress" {
+			demucsStatus = "processing"
+		}
+
+		events = append(events,
+			models.ProgressEvent{
+				TrackID:  track.TrackID,
+				Type:     "download",
+				Status:   downloadStatus,
+				Progress: track.DownloadProgress,
+				Error:    track.DownloadError,
+			},
+			models.ProgressEvent{
+				TrackID:  track.TrackID,
+				Type:     "demucs",
+				Status:   demucsStatus,
+				Progress: track.DemucsProgress,
+				Error:    track.DemucsError,
+			},
+		)
+	}
+	return events
+}
+
 // ProgressStreamHandler streams progress updates via SSE
 // Supports optional ?playlist_id=<id> query parameter to filter events
+// and ?snapshot=true to receive the current state of every track before live events
 func (h *Handler) ProgressStreamHandler(w http.ResponseWriter, r *http.Request) {
 	// Set SSE headers
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	// Check for playlist filter
-	var trackIDFilter map[string]bool
-	playlistID := r.URL.Query().Get("playlist_id")
-	if playlistID != "" {
-		var err error
-		trackIDFilter, err = h.DB.GetPlaylistTrackIDs(playlistID)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to get playlist tracks: %v", err), http.StatusInternalServerError)
-			return
-		}
-		log.Printf("Client subscribed to playlist %s with %d tracks", playlistID, len(trackIDFilter))
+	clientChan, ok := h.registerProgressClient(w, r)
+	if !ok {
+		return
 	}
 
-	// Create client channel with optional filter
-	clientChan := h.Progress.RegisterClient(trackIDFilter)
-
 	// Cleanup on disconnect
 	defer func() {
 		h.Progress.UnregisterClient(clientChan)
 	}()
 
+	// Buffer writes when a flush interval is configured; otherwise flush every event
+	buf := bufio.NewWriter(w)
+	flusher, _ := w.(http.Flusher)
+	flush := func() {
+		buf.Flush()
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	// Send the headers now so the client (and request logging) sees the stream open
+	flush()
+
+	var flushTick <-chan time.Time
+	if h.SSEFlushInterval > 0 {
+		ticker := time.NewTicker(h.SSEFlushInterval)
+		defer ticker.Stop()
+		flushTick = ticker.C
+	}
+
 	// Stream updates
 	for {
 		select {
@@ -174,12 +1248,72 @@ func (h *Handler) ProgressStreamHandler(w http.ResponseWriter, r *http.Request)
 			if err != nil {
 				continue
 			}
-			fmt.Fprintf(w, "data: %s\n\n", data)
-			if f, ok := w.(http.Flusher); ok {
-				f.Flush()
+			fmt.Fprintf(buf, "data: %s\n\n", data)
+
+			// Terminal events and full buffers are never held back
+			if flushTick == nil || isTerminalStatus(event.Status) || buf.Buffered() >= sseFlushThreshold {
+				flush()
+			}
+		case <-flushTick:
+			if buf.Buffered() > 0 {
+				flush()
 			}
 		case <-r.Context().Done():
 			return
 		}
 	}
 }
+
+// errPlaylistNotFound is returned for a progress subscription to a playlist with no tracks
+var errPlaylistNotFound = errors.New("playlist not found")
+
+// playlistTrackFilter returns the broadcaster filter for a playlist's tracks and
+// totals, or nil (all events) for an empty playlistID
+func (h *Handler) playlistTrackFilter(playlistID string) (map[string]bool, error) {
+	if playlistID == "" {
+		return nil, nil
+	}
+	trackIDFilter, err := h.DB.GetPlaylistTrackIDs(playlistID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get playlist tracks: %w", err)
+	}
+	// An empty filter would silently stream nothing, so reject unknown playlists up front
+	if len(trackIDFilter) == 0 {
+		return nil, errPlaylistNotFound
+	}
+	slog.Debug("Client subscribed to playlist", "playlist_id", playlistID, "tracks", len(trackIDFilter))
+
+	// Lets the playlist's own "playlist" events through
+	trackIDFilter[playlistID] = true
+	return trackIDFilter, nil
+}
+
+// registerProgressClient registers a progress stream client for the request's
+// ?playlist_id= filter, seeded with the current state of every track if
+// ?snapshot=true. It writes the error response and reports false on failure.
+func (h *Handler) registerProgressClient(w http.ResponseWriter, r *http.Request) (chan models.ProgressEvent, bool) {
+	trackIDFilter, err := h.playlistTrackFilter(r.URL.Query().Get("playlist_id"))
+	if errors.Is(err, errPlaylistNotFound) {
+		writeJSONError(w, http.StatusNotFound, "Playlist not found")
+		return nil, false
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Database error: %v", err))
+		return nil, false
+	}
+
+	if r.URL.Query().Get("snapshot") != "true" {
+		return h.Progress.RegisterClient(trackIDFilter), true
+	}
+	tracks, err := h.DB.GetAllTracks()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "Database error")
+		return nil, false
+	}
+	return h.Progress.RegisterClientWithSnapshot(trackIDFilter, snapshotEvents(tracks)), true
+}
+
+// isTerminalStatus reports whether a progress status ends a job
+func isTerminalStatus(status string) bool {
+	return status == "completed" || status == "failed"
+}
@@ -0,0 +1,218 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"separate/server/core"
+	"separate/server/db"
+	"separate/server/models"
+	"separate/server/worker"
+)
+
+// roundTripFunc lets a function stand in for Spotify
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// newTestHandler returns a Handler over a fresh database and songs directory,
+// with no workers running and a Spotify client that rejects every request
+func newTestHandler(t *testing.T) *Handler {
+	t.Helper()
+	original := worker.SongsDir()
+	if err := worker.SetSongsDir(filepath.Join(t.TempDir(), "songs")); err != nil {
+		t.Fatalf("SetSongsDir failed: %v", err)
+	}
+	t.Cleanup(func() { worker.SetSongsDir(original) })
+
+	database, err := db.InitDB(filepath.Join(t.TempDir(), "queue.db"))
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	progress := core.NewProgressBroadcaster()
+	workers := worker.NewWorkerManager(database, progress, make(chan *models.DemucsJob, 10))
+	spotify := core.NewSpotifyClient(models.SpotifyConfig{}, core.WithHTTPClient(&http.Client{
+		Transport: roundTripFunc(func(*http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusBadRequest, Body: io.NopCloser(strings.NewReader("{}"))}, nil
+		}),
+	}))
+	return NewHandler(database, progress, worker.NewDownloadQueue(100), workers, spotify)
+}
+
+func TestQueueCollectionSkipsTracksAlreadyQueued(t *testing.T) {
+	h := newTestHandler(t)
+
+	track := func(id string) models.TrackMetadata {
+		return models.TrackMetadata{ID: id, Name: id, Artists: []string{"Artist"}}
+	}
+	first := &models.PlaylistMetadata{Name: "First", Tracks: []models.TrackMetadata{track("a"), track("shared")}}
+	second := &models.PlaylistMetadata{Name: "Second", Tracks: []models.TrackMetadata{track("shared"), track("b")}}
+
+	for id, playlist := range map[string]*models.PlaylistMetadata{"p1": first, "p2": second} {
+		if !h.queueCollection(httptest.NewRecorder(), id, playlist, models.SeparationOptions{}, nil) {
+			t.Fatalf("queueCollection failed for %s", id)
+		}
+	}
+
+	// The shared track is still pending from the first playlist, but it must be
+	// downloaded once
+	if depth := h.JobQueue.Len(); depth != 3 {
+		t.Errorf("Expected 3 queued downloads, got %d", depth)
+	}
+}
+
+func TestRetryFailedKeepsJobOptions(t *testing.T) {
+	h := newTestHandler(t)
+
+	autoDemucs := false
+	playlist := &models.PlaylistMetadata{Tracks: []models.TrackMetadata{{ID: "a", Name: "A", Artists: []string{"Artist"}}}}
+	if !h.queueCollection(httptest.NewRecorder(), "p1", playlist, models.SeparationOptions{TwoStems: "vocals"}, &autoDemucs) {
+		t.Fatal("queueCollection failed")
+	}
+	// The first download runs and fails
+	h.JobQueue.Next()
+	h.DB.UpdateDownloadStatus("a", "failed", "network error")
+
+	recorder := httptest.NewRecorder()
+	h.RetryFailedHandler(recorder, httptest.NewRequest("POST", "/retry-failed", nil))
+	if recorder.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d: %s", recorder.Code, recorder.Body)
+	}
+
+	if h.JobQueue.Len() != 1 {
+		t.Fatalf("Expected the download to be queued again, got %d jobs", h.JobQueue.Len())
+	}
+	job, _ := h.JobQueue.Next()
+	if job.PlaylistID != "p1" || job.Separation.TwoStems != "vocals" || job.AutoDemucs == nil || *job.AutoDemucs {
+		t.Errorf("Expected the retry to keep p1, two_stems=vocals and auto_demucs=false, got %+v", job)
+	}
+	// Spotify failed, so the stored name is used
+	if job.Track.Name != "A" {
+		t.Errorf("Expected the stored metadata as a fallback, got %+v", job.Track)
+	}
+}
+
+func TestSeparateRejectsQueuedSeparation(t *testing.T) {
+	h := newTestHandler(t)
+
+	autoDemucs := false
+	playlist := &models.PlaylistMetadata{Tracks: []models.TrackMetadata{{ID: "a", Name: "A", Artists: []string{"Artist"}}}}
+	if !h.queueCollection(httptest.NewRecorder(), "p1", playlist, models.SeparationOptions{}, &autoDemucs) {
+		t.Fatal("queueCollection failed")
+	}
+	h.JobQueue.Next()
+	h.DB.UpdateDownloadStatus("a", "completed", "")
+	if err := os.MkdirAll(worker.TrackDir("a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(worker.BaseAudioPath("a"), []byte("audio"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	separate := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/tracks/a/separate", strings.NewReader(`{"two_stems":"vocals"}`))
+		r.SetPathValue("id", "a")
+		recorder := httptest.NewRecorder()
+		h.SeparateTrackHandler(recorder, r)
+		return recorder
+	}
+	if recorder := separate(); recorder.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d: %s", recorder.Code, recorder.Body)
+	}
+	// The first separation is still waiting for a worker
+	if recorder := separate(); recorder.Code != http.StatusConflict {
+		t.Fatalf("Expected 409 while a separation is queued, got %d: %s", recorder.Code, recorder.Body)
+	}
+	if depth := h.Workers.DemucsQueueDepth(); depth != 1 {
+		t.Errorf("Expected one queued separation, got %d", depth)
+	}
+}
+
+func TestSetTrackSourceQueuesPendingTrack(t *testing.T) {
+	h := newTestHandler(t)
+
+	playlist := &models.PlaylistMetadata{Tracks: []models.TrackMetadata{{ID: "a", Name: "A", Artists: []string{"Artist"}}}}
+	if !h.queueCollection(httptest.NewRecorder(), "p1", playlist, models.SeparationOptions{}, nil) {
+		t.Fatal("queueCollection failed")
+	}
+	setSource := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("PUT", "/tracks/a/source", strings.NewReader(`{"youtube_url":"https://www.youtube.com/watch?v=dQw4w9WgXcQ"}`))
+		r.SetPathValue("id", "a")
+		recorder := httptest.NewRecorder()
+		h.SetTrackSourceHandler(recorder, r)
+		return recorder
+	}
+
+	// Still on the queue: the waiting job picks up the new source
+	if recorder := setSource(); recorder.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d: %s", recorder.Code, recorder.Body)
+	}
+	if h.JobQueue.Len() != 1 {
+		t.Fatalf("Expected the queued download to be reused, got %d jobs", h.JobQueue.Len())
+	}
+
+	// Pending but off the queue, e.g. lost to a restart: queue it again
+	h.JobQueue.Next()
+	if recorder := setSource(); recorder.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d: %s", recorder.Code, recorder.Body)
+	}
+	if h.JobQueue.Len() != 1 {
+		t.Fatalf("Expected the download to be queued, got %d jobs", h.JobQueue.Len())
+	}
+}
+
+func TestSetTrackSourceRejectsQueuedSeparation(t *testing.T) {
+	h := newTestHandler(t)
+
+	autoDemucs := false
+	playlist := &models.PlaylistMetadata{Tracks: []models.TrackMetadata{{ID: "a", Name: "A", Artists: []string{"Artist"}}}}
+	if !h.queueCollection(httptest.NewRecorder(), "p1", playlist, models.SeparationOptions{}, &autoDemucs) {
+		t.Fatal("queueCollection failed")
+	}
+	h.JobQueue.Next()
+	h.DB.UpdateDownloadStatus("a", "completed", "")
+	if err := os.MkdirAll(worker.TrackDir("a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(worker.BaseAudioPath("a"), []byte("audio"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h.Workers.QueueDemucs(&models.DemucsJob{Track: models.TrackMetadata{ID: "a"}, InputPath: worker.BaseAudioPath("a")})
+
+	r := httptest.NewRequest("PUT", "/tracks/a/source", strings.NewReader(`{"youtube_url":"https://www.youtube.com/watch?v=dQw4w9WgXcQ"}`))
+	r.SetPathValue("id", "a")
+	recorder := httptest.NewRecorder()
+	h.SetTrackSourceHandler(recorder, r)
+	if recorder.Code != http.StatusConflict {
+		t.Fatalf("Expected 409 while a separation is queued, got %d: %s", recorder.Code, recorder.Body)
+	}
+	if _, err := os.Stat(worker.BaseAudioPath("a")); err != nil {
+		t.Errorf("Expected the audio to stay for the queued separation: %v", err)
+	}
+}
+
+func TestTracksETagCoversFilters(t *testing.T) {
+	h := newTestHandler(t)
+
+	all, err := h.tracksETag("")
+	if err != nil {
+		t.Fatalf("tracksETag failed: %v", err)
+	}
+	failed, err := h.tracksETag("download_status=failed")
+	if err != nil {
+		t.Fatalf("tracksETag failed: %v", err)
+	}
+	if all == failed {
+		t.Errorf("Expected filtered lists to have their own ETag, both got %s", all)
+	}
+	if again, _ := h.tracksETag(""); again != all {
+		t.Errorf("Expected an unchanged list to keep its ETag, got %s then %s", all, again)
+	}
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"separate/server/models"
+	"separate/server/worker"
+)
+
+// healthCacheTTL is how long dependency check results are reused. Load
+// balancers poll /healthz every few seconds, and most checks fork docker or
+// demucs.
+const healthCacheTTL = 30 * time.Second
+
+// healthCheckTimeout bounds each dependency check, so a hung docker daemon is
+// reported as down rather than waited on
+const healthCheckTimeout = 5 * time.Second
+
+// healthCache keeps the last dependency check results. The zero value is empty.
+type healthCache struct {
+	mu         sync.Mutex
+	statuses   []models.DependencyStatus
+	checkedAt  time.Time
+	refreshing bool
+}
+
+// HealthHandler reports whether the server's dependencies are ready to do work.
+// It responds 503 if any critical dependency is down. Spotify is not checked:
+// the server won't start without credentials, and queued tracks download
+// without calling it.
+func (h *Handler) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	database := models.DependencyStatus{Name: "database", OK: true, Critical: true}
+	if err := h.DB.PingContext(r.Context()); err != nil {
+		database.OK = false
+		database.Error = err.Error()
+	}
+
+	response := models.HealthResponse{
+		Status:       "ok",
+		Dependencies: append([]models.DependencyStatus{database}, h.dependencyStatuses()...),
+	}
+
+	statusCode := http.StatusOK
+	for _, dependency := range response.Dependencies {
+		if dependency.OK {
+			continue
+		}
+		if dependency.Critical {
+			response.Status = "unavailable"
+			statusCode = http.StatusServiceUnavailable
+		} else if response.Status == "ok" {
+			response.Status = "degraded"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(response)
+}
+
+// dependencyStatuses returns the cached results of checkDependencies. Only the
+// first call waits for the checks; after that, results older than
+// healthCacheTTL are served while a single background check replaces them, so
+// a slow docker daemon never holds up a probe.
+func (h *Handler) dependencyStatuses() []models.DependencyStatus {
+	h.health.mu.Lock()
+	defer h.health.mu.Unlock()
+
+	if h.health.statuses == nil {
+		h.health.statuses = checkDependencies()
+		h.health.checkedAt = time.Now()
+		return h.health.statuses
+	}
+
+	if time.Since(h.health.checkedAt) >= healthCacheTTL && !h.health.refreshing {
+		h.health.refreshing = true
+		go func() {
+			statuses := checkDependencies()
+			h.health.mu.Lock()
+			defer h.health.mu.Unlock()
+			h.health.statuses = statuses
+			h.health.checkedAt = time.Now()
+			h.health.refreshing = false
+		}()
+	}
+	return h.health.statuses
+}
+
+// checkDependencies checks the tools jobs run, each under healthCheckTimeout
+func checkDependencies() []models.DependencyStatus {
+	check := func(name string, critical bool, run func(ctx context.Context) error) models.DependencyStatus {
+		ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+		defer cancel()
+
+		status := models.DependencyStatus{Name: name, OK: true, Critical: critical, Version: worker.ToolVersion(name)}
+		if err := run(ctx); err != nil {
+			status.OK = false
+			status.Error = err.Error()
+		}
+		return status
+	}
+
+	statuses := []models.DependencyStatus{
+		check("yt-dlp", true, func(context.Context) error { return worker.CheckYtDlp() }),
+	}
+	if worker.DemucsRunsLocally() {
+		return append(statuses, check("demucs", true, worker.CheckLocalDemucs))
+	}
+	return append(statuses,
+		check("docker", true, worker.CheckDocker),
+		// The container is created lazily by the first Demucs job
+		check("demucs_container", false, worker.CheckDemucsContainer),
+	)
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RequireAPIKey returns middleware that rejects requests without the API key.
+// The key is accepted as "Authorization: Bearer <key>", an X-API-Key header, or an
+// api_key query parameter for clients that cannot set headers (EventSource, <audio>).
+// An empty key disables the check.
+func RequireAPIKey(key string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if key == "" {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if subtle.ConstantTimeCompare([]byte(requestAPIKey(r)), []byte(key)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="splitter"`)
+				writeJSONError(w, http.StatusUnauthorized, "Missing or invalid API key")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requestAPIKey extracts the caller's key from the supported locations
+func requestAPIKey(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("api_key")
+}
+
+// LogRequests returns middleware that logs each request's method, path, status,
+// response size and duration once it completes. Server-sent event streams and
+// WebSockets are long-lived, so they are logged when they open and again when
+// they close.
+func LogRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, request: r}
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK // Handler wrote nothing; net/http sends 200
+		}
+		attrs := []any{"method", r.Method, "path", r.URL.Path, "status", rec.status,
+			"bytes", rec.bytes, "duration_ms", time.Since(start).Milliseconds()}
+		if rec.stream != "" {
+			slog.Info(rec.stream+" stream closed", attrs...)
+			return
+		}
+
+		level := slog.LevelInfo
+		if rec.status >= http.StatusInternalServerError {
+			level = slog.LevelWarn
+		}
+		slog.Log(context.Background(), level, "HTTP request", attrs...)
+	})
+}
+
+// statusRecorder captures the status code and body size a handler writes. It
+// passes Flush through so SSE keeps streaming behind the middleware.
+type statusRecorder struct {
+	http.ResponseWriter
+	request *http.Request
+	status  int
+	bytes   int64
+	stream  string // "SSE" or "WebSocket" for long-lived streams, "" otherwise
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+		if strings.HasPrefix(rec.Header().Get("Content-Type"), "text/event-stream") {
+			rec.stream = "SSE"
+			slog.Info("SSE stream opened", "method", rec.request.Method, "path", rec.request.URL.Path)
+		}
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+func (rec *statusRecorder) Flush() {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// ReadFrom keeps the underlying writer's sendfile path for http.ServeContent
+func (rec *statusRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	n, err := io.Copy(rec.ResponseWriter, src)
+	rec.bytes += n
+	return n, err
+}
+
+// Hijack hands the connection to a WebSocket upgrade. The request is logged
+// when the socket closes, like an SSE stream.
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(rec.ResponseWriter).Hijack()
+	if err == nil {
+		rec.status = http.StatusSwitchingProtocols
+		rec.stream = "WebSocket"
+		slog.Info("WebSocket stream opened", "method", rec.request.Method, "path", rec.request.URL.Path)
+	}
+	return conn, rw, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"separate/server/models"
+	"separate/server/worker"
+)
+
+// statsMaxAge bounds how stale /stats gets through changes the database never
+// sees, such as files deleted by hand
+const statsMaxAge = 10 * time.Minute
+
+// statsCache keeps the last /stats result so the songs directory is walked
+// only after a track changes or the result ages out. The zero value is empty.
+type statsCache struct {
+	mu       sync.Mutex
+	version  string // Database state the response was computed from
+	response *models.StatsResponse
+}
+
+// StatsHandler reports the disk space taken by downloads and stems, in total
+// and per playlist
+func (h *Handler) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	response, err := h.diskStats()
+	if err != nil {
+		slog.Error("Failed to compute disk usage", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to compute disk usage")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// diskStats returns the cached stats, rescanning if any track has changed
+// (jobs finishing, tracks deleted or reset) since they were computed
+func (h *Handler) diskStats() (*models.StatsResponse, error) {
+	maxUpdatedAt, count, err := h.DB.GetMaxUpdatedAt()
+	if err != nil {
+		return nil, err
+	}
+	version := fmt.Sprintf("%s|%d", maxUpdatedAt, count)
+
+	// Held during the scan, so concurrent requests wait for one scan to finish
+	// instead of each starting their own
+	h.stats.mu.Lock()
+	defer h.stats.mu.Unlock()
+	if cached := h.stats.response; cached != nil && h.stats.version == version && time.Since(cached.ScannedAt) < statsMaxAge {
+		return cached, nil
+	}
+
+	usage, err := worker.ScanDiskUsage()
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan songs directory: %w", err)
+	}
+	memberships, err := h.DB.GetPlaylistMemberships()
+	if err != nil {
+		return nil, err
+	}
+
+	response := &models.StatsResponse{
+		Playlists: make([]models.PlaylistDiskUsage, 0, len(memberships)),
+		ScannedAt: time.Now().UTC(),
+	}
+	for _, trackUsage := range usage {
+		addDiskUsage(&response.DiskUsage, trackUsage)
+	}
+	for playlistID, trackIDs := range memberships {
+		playlist := models.PlaylistDiskUsage{PlaylistID: playlistID}
+		for _, trackID := range trackIDs {
+			if trackUsage, ok := usage[trackID]; ok {
+				addDiskUsage(&playlist.DiskUsage, trackUsage)
+			}
+		}
+		response.Playlists = append(response.Playlists, playlist)
+	}
+	sort.Slice(response.Playlists, func(i, j int) bool {
+		return response.Playlists[i].PlaylistID < response.Playlists[j].PlaylistID
+	})
+
+	h.stats.version = version
+	h.stats.response = response
+	return response, nil
+}
+
+// addDiskUsage adds one track's files to a total
+func addDiskUsage(total *models.DiskUsage, track worker.TrackDiskUsage) {
+	if track.TotalBytes == 0 {
+		return
+	}
+	total.TotalBytes += track.TotalBytes
+	total.BaseBytes += track.BaseBytes
+	total.StemBytes += track.StemBytes
+	total.Tracks++
+	if track.BaseBytes > 0 {
+		total.BaseTracks++
+	}
+	if track.StemBytes > 0 {
+		total.StemTracks++
+	}
+}
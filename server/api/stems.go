@@ -0,0 +1,264 @@
+package api
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"separate/server/db"
+	"separate/server/models"
+	"separate/server/worker"
+)
+
+// StemsZipHandler streams a track's separated stems as a zip. The archive is
+// written straight to the response, so no stem is held in memory.
+func (h *Handler) StemsZipHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	track, err := h.DB.GetTrack(id)
+	if err != nil {
+		writeTrackLookupError(w, err)
+		return
+	}
+
+	stemDir, ok := worker.StemDir(track.TrackID)
+	if track.DemucsStatus != "completed" || !ok {
+		writeJSONError(w, http.StatusNotFound, "Stems are not available until separation completes")
+		return
+	}
+
+	stems, err := filepath.Glob(filepath.Join(stemDir, "*.wav"))
+	if err != nil || len(stems) == 0 {
+		writeJSONError(w, http.StatusNotFound, "Stems are not available until separation completes")
+		return
+	}
+
+	// Entries carry the track's name too, so stems of several tracks can be
+	// extracted into one folder
+	baseName := stemsBaseName(track)
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": baseName + " - stems.zip",
+	}))
+
+	// Headers are sent with the first write, so later failures can only cut the
+	// archive short; the client sees a truncated zip
+	archive := zip.NewWriter(w)
+	for _, stem := range stems {
+		if err := addFileToZip(archive, stem, baseName+" - "+filepath.Base(stem)); err != nil {
+			slog.Error("Failed to stream stems", "track_id", track.TrackID, "error", err)
+			return
+		}
+	}
+	if err := archive.Close(); err != nil {
+		slog.Error("Failed to finish stems zip", "track_id", track.TrackID, "error", err)
+	}
+}
+
+// stemsBaseName names a track's stem downloads "{artists} - {title}", falling
+// back to the track ID when Spotify gave no usable name
+func stemsBaseName(track *models.TrackState) string {
+	name := worker.SanitizeFilename(track.Name)
+	if name == "" {
+		return track.TrackID
+	}
+	if artists := worker.SanitizeFilename(track.Artists); artists != "" {
+		name = worker.SanitizeFilename(artists + " - " + name)
+	}
+	return name
+}
+
+// addFileToZip copies a file into the archive as name. Audio barely
+// compresses, so entries are stored rather than deflated.
+func addFileToZip(archive *zip.Writer, path, name string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Store
+
+	entry, err := archive.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, file)
+	return err
+}
+
+// stemContentTypes maps the stems served by AudioHandler to their MIME types. Only
+// these names are accepted, so a stem can never name a path. The no_* stems come
+// from two-stem separations.
+var stemContentTypes = map[string]string{
+	"base":      "audio/mpeg",
+	"vocals":    "audio/wav",
+	"drums":     "audio/wav",
+	"bass":      "audio/wav",
+	"other":     "audio/wav",
+	"no_vocals": "audio/wav",
+	"no_drums":  "audio/wav",
+	"no_bass":   "audio/wav",
+	"no_other":  "audio/wav",
+}
+
+// AudioHandler serves a track's downloaded audio ("base") or one of its stems,
+// with range support so players can seek
+func (h *Handler) AudioHandler(w http.ResponseWriter, r *http.Request) {
+	id, stem := r.PathValue("id"), r.PathValue("stem")
+
+	contentType, ok := stemContentTypes[stem]
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("Unknown stem: %s", stem))
+		return
+	}
+	if strings.ContainsAny(id, `/\`) || id == "." || id == ".." {
+		writeJSONError(w, http.StatusBadRequest, "Invalid track ID")
+		return
+	}
+
+	track, err := h.DB.GetTrack(id)
+	if err != nil {
+		writeTrackLookupError(w, err)
+		return
+	}
+
+	var path string
+	if stem == "base" {
+		path = worker.BaseAudioPath(track.TrackID)
+	} else {
+		stemDir, ok := worker.StemDir(track.TrackID)
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "Stems are not available until separation completes")
+			return
+		}
+		path = filepath.Join(stemDir, stem+".wav")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("No %s audio for this track yet", stem))
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "Failed to read audio file")
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, filepath.Base(path), info.ModTime(), file)
+}
+
+// PurgeStemsHandler deletes a separated track's stems to reclaim disk, keeping
+// the downloaded audio so POST /tracks/{id}/separate can rebuild them. The track
+// is marked "purged" rather than pending so it isn't separated again on its own.
+func (h *Handler) PurgeStemsHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	track, err := h.DB.GetTrack(id)
+	if err != nil {
+		writeTrackLookupError(w, err)
+		return
+	}
+	if track.DemucsStatus == "in_progress" || h.Workers.IsActive(id) {
+		writeJSONError(w, http.StatusConflict, "Track is currently being processed")
+		return
+	}
+	if track.DemucsStatus != "completed" {
+		writeJSONError(w, http.StatusConflict, "Track has no stems to purge")
+		return
+	}
+
+	freed, err := h.purgeStems(id)
+	if errors.Is(err, db.ErrJobInProgress) {
+		writeJSONError(w, http.StatusConflict, "Track is currently being processed")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to purge stems: %v", err))
+		return
+	}
+
+	track, err = h.DB.GetTrack(id)
+	if err != nil {
+		writeTrackLookupError(w, err)
+		return
+	}
+
+	slog.Info("Purged stems", "track_id", id, "freed_bytes", freed)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(track)
+}
+
+// PurgePlaylistStemsHandler purges the stems of every separated track in a
+// playlist. Tracks being processed or not yet separated are skipped.
+func (h *Handler) PurgePlaylistStemsHandler(w http.ResponseWriter, r *http.Request) {
+	playlistID := r.PathValue("id")
+
+	trackIDs, err := h.DB.GetPlaylistTrackIDs(playlistID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if len(trackIDs) == 0 {
+		writeJSONError(w, http.StatusNotFound, "Playlist not found")
+		return
+	}
+
+	response := models.PurgeStemsResponse{PlaylistID: playlistID}
+	for trackID := range trackIDs {
+		track, err := h.DB.GetTrack(trackID)
+		if err != nil || track.DemucsStatus != "completed" || h.Workers.IsActive(trackID) {
+			continue
+		}
+		freed, err := h.purgeStems(trackID)
+		if errors.Is(err, db.ErrJobInProgress) {
+			continue
+		}
+		if err != nil {
+			slog.Error("Failed to purge stems", "track_id", trackID, "error", err)
+			continue
+		}
+		response.PurgedTracks++
+		response.FreedBytes += freed
+	}
+
+	slog.Info("Purged playlist stems", "playlist_id", playlistID, "tracks", response.PurgedTracks, "freed_bytes", response.FreedBytes)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// purgeStems marks a track purged, then deletes its stems and tells clients.
+// The status goes first so a job that started in the meantime keeps its files.
+func (h *Handler) purgeStems(trackID string) (int64, error) {
+	if err := h.DB.SetDemucsStatus(trackID, "purged"); err != nil {
+		return 0, err
+	}
+	freed, err := worker.RemoveStems(trackID)
+	h.Progress.SendEvent(models.ProgressEvent{
+		TrackID: trackID,
+		Type:    "demucs",
+		Status:  "purged",
+	})
+	return freed, err
+}
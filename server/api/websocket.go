@@ -0,0 +1,148 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"separate/server/models"
+)
+
+const (
+	// wsPingInterval is how often the server pings an idle client; one that
+	// sends nothing, not even a pong, for wsPongTimeout is dropped
+	wsPingInterval = 30 * time.Second
+	wsPongTimeout  = 2 * wsPingInterval
+	wsWriteTimeout = 10 * time.Second
+
+	// wsMaxMessageBytes bounds client messages, which are only small control messages
+	wsMaxMessageBytes = 4096
+)
+
+// wsControlMessage is a message a WebSocket client sends to change its
+// subscription. {"subscribe_playlist": "<id>"} limits events to that playlist's
+// tracks; an empty ID subscribes to every track again.
+type wsControlMessage struct {
+	SubscribePlaylist *string `json:"subscribe_playlist"`
+}
+
+// wsErrorMessage tells a WebSocket client a control message was rejected
+type wsErrorMessage struct {
+	Error string `json:"error"`
+}
+
+// ProgressWebSocketHandler streams the same progress events as
+// ProgressStreamHandler over a WebSocket, for clients and proxies that handle
+// those better than SSE. It takes the same ?playlist_id= and ?snapshot=true
+// parameters, and clients can switch playlists with control messages.
+func (h *Handler) ProgressWebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			return h.AllowWebSocketOrigin == nil || h.AllowWebSocketOrigin(r.Header.Get("Origin"))
+		},
+	}
+	if !websocket.IsWebSocketUpgrade(r) {
+		writeJSONError(w, http.StatusBadRequest, "Expected a WebSocket upgrade")
+		return
+	}
+
+	clientChan, ok := h.registerProgressClient(w, r)
+	if !ok {
+		return
+	}
+	defer h.Progress.UnregisterClient(clientChan)
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already answered with an HTTP error
+		slog.Debug("WebSocket upgrade failed", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	// Control messages are handled by the reader; its replies go through the
+	// writer below, since a connection allows only one concurrent writer
+	replies := make(chan any)
+	done := make(chan struct{})
+	readerDone := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(readerDone)
+		h.readWebSocketControl(conn, clientChan, replies, done)
+	}()
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		var err error
+		select {
+		case event := <-clientChan:
+			err = writeWebSocketJSON(conn, event)
+		case reply := <-replies:
+			err = writeWebSocketJSON(conn, reply)
+		case <-ping.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+		case <-readerDone:
+			// The client closed the connection or stopped answering pings
+			return
+		}
+		if err != nil {
+			slog.Debug("WebSocket write failed", "error", err)
+			return
+		}
+	}
+}
+
+// readWebSocketControl reads a client's control messages until the connection
+// fails or closes. Any message, pongs included, proves the client is alive.
+func (h *Handler) readWebSocketControl(conn *websocket.Conn, clientChan chan models.ProgressEvent, replies chan<- any, done <-chan struct{}) {
+	extendDeadline := func() error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	}
+	conn.SetReadLimit(wsMaxMessageBytes)
+	extendDeadline()
+	conn.SetPongHandler(func(string) error { return extendDeadline() })
+
+	reply := func(message any) {
+		select {
+		case replies <- message:
+		case <-done:
+		}
+	}
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		extendDeadline()
+
+		var message wsControlMessage
+		if err := json.Unmarshal(data, &message); err != nil || message.SubscribePlaylist == nil {
+			reply(wsErrorMessage{Error: `Unknown control message; expected {"subscribe_playlist": "PLAYLIST_ID"}`})
+			continue
+		}
+
+		trackIDFilter, err := h.playlistTrackFilter(*message.SubscribePlaylist)
+		if errors.Is(err, errPlaylistNotFound) {
+			reply(wsErrorMessage{Error: "Playlist not found"})
+			continue
+		}
+		if err != nil {
+			slog.Error("Failed to change WebSocket subscription", "playlist_id", *message.SubscribePlaylist, "error", err)
+			reply(wsErrorMessage{Error: "Database error"})
+			continue
+		}
+		h.Progress.SetClientFilter(clientChan, trackIDFilter)
+	}
+}
+
+// writeWebSocketJSON sends v as a JSON text message
+func writeWebSocketJSON(conn *websocket.Conn, v any) error {
+	conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return conn.WriteJSON(v)
+}
@@ -0,0 +1,77 @@
+package core
+
+import (
+	"sync"
+	"time"
+
+	"separate/server/models"
+)
+
+// DefaultPlaylistCacheTTL is how long fetched playlist metadata is reused
+const DefaultPlaylistCacheTTL = 5 * time.Minute
+
+// MetadataCache keeps recently fetched playlist metadata so repeated setups of
+// the same playlist don't refetch every page from Spotify. Entries expire after
+// the TTL. A nil cache never hits, which disables caching.
+type MetadataCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]metadataCacheEntry
+	now     func() time.Time // Swapped in tests
+}
+
+type metadataCacheEntry struct {
+	metadata *models.PlaylistMetadata
+	expiry   time.Time
+}
+
+// NewMetadataCache returns a cache whose entries live for ttl. A ttl of zero
+// or less returns nil, i.e. no caching.
+func NewMetadataCache(ttl time.Duration) *MetadataCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &MetadataCache{
+		ttl:     ttl,
+		entries: make(map[string]metadataCacheEntry),
+		now:     time.Now,
+	}
+}
+
+// Get returns the cached metadata for id if it hasn't expired. Callers must not
+// modify the returned metadata, since other requests share it.
+func (c *MetadataCache) Get(id string) (*models.PlaylistMetadata, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[id]
+	if !ok {
+		return nil, false
+	}
+	if !c.now().Before(entry.expiry) {
+		delete(c.entries, id)
+		return nil, false
+	}
+	return entry.metadata, true
+}
+
+// Set caches metadata for id for the cache's TTL
+func (c *MetadataCache) Set(id string, metadata *models.PlaylistMetadata) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	// Drop expired entries here so playlists that are never asked for again don't linger
+	for key, entry := range c.entries {
+		if !now.Before(entry.expiry) {
+			delete(c.entries, key)
+		}
+	}
+	c.entries[id] = metadataCacheEntry{metadata: metadata, expiry: now.Add(c.ttl)}
+}
@@ -0,0 +1,42 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"separate/server/models"
+)
+
+func TestMetadataCacheExpires(t *testing.T) {
+	now := time.Now()
+	cache := NewMetadataCache(time.Minute)
+	cache.now = func() time.Time { return now }
+
+	metadata := &models.PlaylistMetadata{Name: "Road Trip"}
+	cache.Set("p1", metadata)
+	if got, ok := cache.Get("p1"); !ok || got != metadata {
+		t.Fatalf("Expected a cache hit for p1, got %v, %v", got, ok)
+	}
+	if _, ok := cache.Get("p2"); ok {
+		t.Error("Expected a miss for an uncached playlist")
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := cache.Get("p1"); ok {
+		t.Error("Expected p1 to expire after the TTL")
+	}
+	if len(cache.entries) != 0 {
+		t.Errorf("Expected the expired entry to be dropped, have %d", len(cache.entries))
+	}
+}
+
+func TestMetadataCacheDisabled(t *testing.T) {
+	cache := NewMetadataCache(0)
+	if cache != nil {
+		t.Fatal("Expected a zero TTL to disable the cache")
+	}
+	cache.Set("p1", &models.PlaylistMetadata{})
+	if _, ok := cache.Get("p1"); ok {
+		t.Error("Expected a disabled cache never to hit")
+	}
+}
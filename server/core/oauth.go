@@ -0,0 +1,152 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+
+	"separate/server/models"
+)
+
+const (
+	spotifyAuthorizeURL = "https://accounts.spotify.com/authorize"
+
+	// userScope is what the authorization-code flow asks the user to grant
+	userScope = "user-library-read"
+
+	// savedTracksPageSize is the most items /me/tracks returns per page
+	savedTracksPageSize = 50
+)
+
+// ErrUserNotAuthorized means no user has logged in through /auth/login, or the
+// stored user token has expired
+var ErrUserNotAuthorized = errors.New("no authorized Spotify user")
+
+// RefreshTokenStore persists the user's refresh token so a login survives restarts
+type RefreshTokenStore interface {
+	LoadRefreshToken() (string, error) // "" if no user has logged in
+	SaveRefreshToken(refreshToken string) error
+}
+
+// WithRefreshTokenStore persists the logged-in user's refresh token in store
+func WithRefreshTokenStore(store RefreshTokenStore) SpotifyClientOption {
+	return func(c *SpotifyClient) {
+		c.refreshStore = store
+	}
+}
+
+// AuthorizeURL returns the Spotify consent page URL for the user login flow.
+// state is echoed back to the callback and must be checked there.
+func (c *SpotifyClient) AuthorizeURL(state string) (string, error) {
+	if c.config.RedirectURI == "" {
+		return "", errors.New("SPOTIFY_REDIRECT_URI is not configured")
+	}
+	query := url.Values{}
+	query.Set("client_id", c.config.ClientID)
+	query.Set("response_type", "code")
+	query.Set("redirect_uri", c.config.RedirectURI)
+	query.Set("scope", userScope)
+	query.Set("state", state)
+	return c.authorizeURL + "?" + query.Encode(), nil
+}
+
+// ExchangeCode trades the code from the login callback for user tokens and keeps them
+func (c *SpotifyClient) ExchangeCode(ctx context.Context, code string) (*models.TokenResponse, error) {
+	data := url.Values{}
+	data.Set("grant_type", "authorization_code")
+	data.Set("code", code)
+	data.Set("redirect_uri", c.config.RedirectURI)
+
+	tokenResp, err := c.requestToken(ctx, data)
+	if err != nil {
+		return nil, err
+	}
+	c.user.set(tokenResp)
+	c.saveRefreshToken(tokenResp.RefreshToken)
+	return tokenResp, nil
+}
+
+// refreshUserToken gets a new user access token with a refresh token
+func (c *SpotifyClient) refreshUserToken(ctx context.Context, refreshToken string) (*models.TokenResponse, error) {
+	data := url.Values{}
+	data.Set("grant_type", "refresh_token")
+	data.Set("refresh_token", refreshToken)
+	return c.requestToken(ctx, data)
+}
+
+// UserAccessToken returns the logged-in user's access token, refreshing it when
+// it is about to expire. After a restart the refresh token comes from the store.
+func (c *SpotifyClient) UserAccessToken(ctx context.Context) (string, error) {
+	return c.user.get(func(refreshToken string) (*models.TokenResponse, error) {
+		if refreshToken == "" && c.refreshStore != nil {
+			stored, err := c.refreshStore.LoadRefreshToken()
+			if err != nil {
+				return nil, fmt.Errorf("failed to load refresh token: %w", err)
+			}
+			refreshToken = stored
+		}
+		if refreshToken == "" {
+			return nil, ErrUserNotAuthorized
+		}
+
+		tokenResp, err := c.refreshUserToken(ctx, refreshToken)
+		if err != nil {
+			return nil, fmt.Errorf("failed to refresh user token: %w", err)
+		}
+		// Spotify may rotate the refresh token; otherwise the current one stays valid
+		if tokenResp.RefreshToken == "" {
+			tokenResp.RefreshToken = refreshToken
+		} else {
+			c.saveRefreshToken(tokenResp.RefreshToken)
+		}
+		return tokenResp, nil
+	})
+}
+
+// saveRefreshToken persists a new refresh token. A failure only costs a login
+// after the next restart, so it is logged rather than returned.
+func (c *SpotifyClient) saveRefreshToken(refreshToken string) {
+	if c.refreshStore == nil || refreshToken == "" {
+		return
+	}
+	if err := c.refreshStore.SaveRefreshToken(refreshToken); err != nil {
+		slog.Warn("Failed to save Spotify refresh token", "error", err)
+	}
+}
+
+// savedTracksResponse is a page of /me/tracks
+type savedTracksResponse struct {
+	Items []struct {
+		Track trackObject `json:"track"`
+	} `json:"items"`
+	Next  string `json:"next"`
+	Total int    `json:"total"`
+}
+
+// GetSavedTracks fetches the user's Liked Songs in the playlist shape. accessToken
+// must be a user token with the user-library-read scope.
+func (c *SpotifyClient) GetSavedTracks(ctx context.Context, accessToken string) (*models.PlaylistMetadata, error) {
+	metadata := &models.PlaylistMetadata{Name: "Liked Songs"}
+
+	nextURL := c.withMarket(fmt.Sprintf("%s/me/tracks?limit=%d", c.apiBaseURL, savedTracksPageSize))
+	for nextURL != "" {
+		var page savedTracksResponse
+		if err := c.getJSON(ctx, nextURL, accessToken, "saved tracks", &page); err != nil {
+			return nil, err
+		}
+		metadata.TotalTracks = page.Total
+
+		for _, item := range page.Items {
+			if !item.Track.isMusicTrack() {
+				metadata.SkippedTracks++
+				continue
+			}
+			metadata.Tracks = append(metadata.Tracks, toTrackMetadata(item.Track))
+		}
+		nextURL = page.Next
+	}
+
+	return metadata, nil
+}
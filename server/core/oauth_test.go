@@ -0,0 +1,164 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"separate/server/models"
+)
+
+func TestAuthorizeURL(t *testing.T) {
+	client := NewSpotifyClient(models.SpotifyConfig{ClientID: "id", RedirectURI: "http://localhost:8080/auth/callback"})
+	authorizeURL, err := client.AuthorizeURL("state123")
+	if err != nil {
+		t.Fatalf("AuthorizeURL failed: %v", err)
+	}
+
+	u, err := url.Parse(authorizeURL)
+	if err != nil {
+		t.Fatalf("Invalid URL %q: %v", authorizeURL, err)
+	}
+	query := u.Query()
+	if query.Get("scope") != "user-library-read" || query.Get("state") != "state123" ||
+		query.Get("response_type") != "code" || query.Get("redirect_uri") != "http://localhost:8080/auth/callback" {
+		t.Errorf("Unexpected authorize query: %v", query)
+	}
+
+	if _, err := NewSpotifyClient(models.SpotifyConfig{ClientID: "id"}).AuthorizeURL("s"); err == nil {
+		t.Error("Expected an error without a redirect URI")
+	}
+}
+
+func TestExchangeCodeStoresUserToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if user, pass, _ := r.BasicAuth(); user != "id" || pass != "secret" {
+			t.Errorf("Expected app credentials, got %s:%s", user, pass)
+		}
+		if r.Form.Get("grant_type") != "authorization_code" || r.Form.Get("code") != "code123" ||
+			r.Form.Get("redirect_uri") != "http://localhost/cb" {
+			t.Errorf("Unexpected token form: %v", r.Form)
+		}
+		json.NewEncoder(w).Encode(models.TokenResponse{
+			AccessToken: "user-token", RefreshToken: "refresh", ExpiresIn: 3600, Scope: userScope,
+		})
+	}))
+	defer server.Close()
+
+	client := NewSpotifyClient(models.SpotifyConfig{ClientID: "id", ClientSecret: "secret", RedirectURI: "http://localhost/cb"},
+		WithHTTPClient(server.Client()))
+	client.tokenURL = server.URL
+
+	if _, err := client.UserAccessToken(context.Background()); !errors.Is(err, ErrUserNotAuthorized) {
+		t.Errorf("Expected ErrUserNotAuthorized before login, got %v", err)
+	}
+
+	if _, err := client.ExchangeCode(context.Background(), "code123"); err != nil {
+		t.Fatalf("ExchangeCode failed: %v", err)
+	}
+	token, err := client.UserAccessToken(context.Background())
+	if err != nil || token != "user-token" {
+		t.Errorf("UserAccessToken = %q, %v; want user-token", token, err)
+	}
+	// Only client-credentials tokens count as refreshes
+	if refreshes := client.TokenRefreshes(); refreshes != 0 {
+		t.Errorf("Expected no token refreshes for a login, got %d", refreshes)
+	}
+}
+
+func TestGetSavedTracksPaginates(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer user-token" {
+			t.Errorf("Expected the user token, got %q", r.Header.Get("Authorization"))
+		}
+
+		var page savedTracksResponse
+		page.Total = 3
+		page.Items = make([]struct {
+			Track trackObject `json:"track"`
+		}, 2)
+		if r.URL.Query().Get("offset") == "" {
+			page.Items[0].Track.ID = "a"
+			page.Items[1].Track.ID = "b"
+			page.Next = fmt.Sprintf("%s/me/tracks?offset=2&limit=2", server.URL)
+		} else {
+			page.Items = page.Items[:1]
+			page.Items[0].Track.ID = "" // Removed from Spotify
+		}
+		json.NewEncoder(w).Encode(page)
+	}))
+	defer server.Close()
+
+	client := NewSpotifyClient(models.SpotifyConfig{}, WithHTTPClient(server.Client()))
+	client.apiBaseURL = server.URL
+
+	metadata, err := client.GetSavedTracks(context.Background(), "user-token")
+	if err != nil {
+		t.Fatalf("GetSavedTracks failed: %v", err)
+	}
+	if len(metadata.Tracks) != 2 || metadata.Tracks[0].ID != "a" || metadata.Tracks[1].ID != "b" {
+		t.Errorf("Unexpected tracks: %+v", metadata.Tracks)
+	}
+	if metadata.TotalTracks != 3 || metadata.SkippedTracks != 1 {
+		t.Errorf("Expected 3 total and 1 skipped, got %d and %d", metadata.TotalTracks, metadata.SkippedTracks)
+	}
+}
+
+// memoryTokenStore is an in-memory RefreshTokenStore
+type memoryTokenStore struct {
+	refreshToken string
+	saves        int
+}
+
+func (s *memoryTokenStore) LoadRefreshToken() (string, error) { return s.refreshToken, nil }
+
+func (s *memoryTokenStore) SaveRefreshToken(refreshToken string) error {
+	s.refreshToken = refreshToken
+	s.saves++
+	return nil
+}
+
+func TestUserAccessTokenRefreshesFromStore(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		r.ParseForm()
+		if r.Form.Get("grant_type") != "refresh_token" || r.Form.Get("refresh_token") != "stored" {
+			t.Errorf("Unexpected token form: %v", r.Form)
+		}
+		json.NewEncoder(w).Encode(models.TokenResponse{AccessToken: "fresh", RefreshToken: "rotated", ExpiresIn: 3600})
+	}))
+	defer server.Close()
+
+	store := &memoryTokenStore{refreshToken: "stored"}
+	client := NewSpotifyClient(models.SpotifyConfig{ClientID: "id", ClientSecret: "secret"},
+		WithHTTPClient(server.Client()), WithRefreshTokenStore(store))
+	client.tokenURL = server.URL
+
+	for i := 0; i < 3; i++ {
+		token, err := client.UserAccessToken(context.Background())
+		if err != nil || token != "fresh" {
+			t.Fatalf("UserAccessToken = %q, %v; want fresh", token, err)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Expected one refresh for a still-valid token, got %d", requests)
+	}
+	if store.refreshToken != "rotated" || store.saves != 1 {
+		t.Errorf("Expected the rotated refresh token to be saved once, got %q after %d saves", store.refreshToken, store.saves)
+	}
+}
+
+func TestUserAccessTokenWithoutLogin(t *testing.T) {
+	client := NewSpotifyClient(models.SpotifyConfig{}, WithRefreshTokenStore(&memoryTokenStore{}))
+	if _, err := client.UserAccessToken(context.Background()); !errors.Is(err, ErrUserNotAuthorized) {
+		t.Errorf("Expected ErrUserNotAuthorized, got %v", err)
+	}
+}
@@ -1,9 +1,17 @@
 package core
 
 import (
+	"sync"
+	"time"
+
 	"separate/server/models"
 )
 
+// progressInterval is the least time between two broadcasts of a running
+// job's progress. yt-dlp and Demucs report many times a second, far more than
+// clients need to draw a progress bar.
+const progressInterval = 250 * time.Millisecond
+
 // clientInfo holds a client channel and optional filter for playlist-specific subscriptions
 type clientInfo struct {
 	channel       chan models.ProgressEvent
@@ -14,6 +22,7 @@ type clientInfo struct {
 type clientRegistration struct {
 	channel       chan models.ProgressEvent
 	trackIDFilter map[string]bool
+	snapshot      []models.ProgressEvent // Initial state to replay before live events
 }
 
 // ProgressBroadcaster manages SSE client subscriptions
@@ -21,7 +30,42 @@ type ProgressBroadcaster struct {
 	events         chan models.ProgressEvent
 	newClients     chan clientRegistration
 	closingClients chan chan models.ProgressEvent
+	filterUpdates  chan clientRegistration
 	clients        map[chan models.ProgressEvent]*clientInfo
+	latest         map[string]models.ProgressEvent // Last event per track and type, owned by run()
+
+	// Throttling of running jobs' progress, owned by run(). held keeps the
+	// newest event not yet broadcast for each eventKey.
+	lastSent map[string]time.Time
+	held     map[string]models.ProgressEvent
+
+	// progress holds the latest percentage of each running job by eventKey, for
+	// snapshot readers outside run()
+	progressMu      sync.RWMutex
+	progress        map[string]float64
+	progressVersion uint64 // Bumped on every change to progress
+}
+
+// eventKey identifies the stream of events for one track and job type, or for
+// one playlist's totals
+func eventKey(event models.ProgressEvent) string {
+	if event.Type == "playlist" {
+		return event.PlaylistID + "/playlist"
+	}
+	return event.TrackID + "/" + event.Type
+}
+
+// matchesFilter reports whether a client with trackIDFilter receives event.
+// Playlist events carry no track; filters built for a playlist hold its ID
+// alongside its track IDs to receive them.
+func matchesFilter(trackIDFilter map[string]bool, event models.ProgressEvent) bool {
+	if trackIDFilter == nil {
+		return true
+	}
+	if event.Type == "playlist" {
+		return trackIDFilter[event.PlaylistID]
+	}
+	return trackIDFilter[event.TrackID]
 }
 
 // NewProgressBroadcaster creates and starts a new progress broadcaster
@@ -30,13 +74,20 @@ func NewProgressBroadcaster() *ProgressBroadcaster {
 		events:         make(chan models.ProgressEvent, 100), // Buffered for bursts of progress updates
 		newClients:     make(chan clientRegistration),
 		closingClients: make(chan chan models.ProgressEvent),
+		filterUpdates:  make(chan clientRegistration),
 		clients:        make(map[chan models.ProgressEvent]*clientInfo),
+		latest:         make(map[string]models.ProgressEvent),
+		lastSent:       make(map[string]time.Time),
+		held:           make(map[string]models.ProgressEvent),
+		progress:       make(map[string]float64),
 	}
 	go b.run()
 	return b
 }
 
 func (b *ProgressBroadcaster) run() {
+	// flush fires when the earliest held event is due; nil while none is held
+	var flush <-chan time.Time
 	for {
 		select {
 		case registration := <-b.newClients:
@@ -44,26 +95,133 @@ func (b *ProgressBroadcaster) run() {
 				channel:       registration.channel,
 				trackIDFilter: registration.trackIDFilter,
 			}
+
+			// Replay the snapshot, preferring any newer event seen since it was taken.
+			// This runs before any live event reaches the client, so nothing is missed.
+			for _, event := range registration.snapshot {
+				if !matchesFilter(registration.trackIDFilter, event) {
+					continue
+				}
+				if newer, ok := b.latest[eventKey(event)]; ok {
+					event = newer
+				}
+				select {
+				case registration.channel <- event:
+				default:
+				}
+			}
+		case update := <-b.filterUpdates:
+			// Ignore clients that unregistered in the meantime
+			if client, ok := b.clients[update.channel]; ok {
+				client.trackIDFilter = update.trackIDFilter
+			}
 		case clientChan := <-b.closingClients:
 			delete(b.clients, clientChan)
 			close(clientChan)
 		case event := <-b.events:
-			// Broadcast to all clients that match the filter
-			for _, client := range b.clients {
-				// Check if client has a filter and if so, whether this event matches
-				if client.trackIDFilter != nil && !client.trackIDFilter[event.TrackID] {
-					continue // Skip this client, event doesn't match their filter
+			key := eventKey(event)
+			previous := b.latest[key]
+			b.latest[key] = event
+			b.recordProgress(event)
+
+			// Hold back progress that follows too soon after the last broadcast;
+			// status and stage changes, terminal events included, always go out
+			// and supersede anything held
+			now := time.Now()
+			if isRunning(event) && previous.Status == event.Status && previous.Stage == event.Stage &&
+				now.Sub(b.lastSent[key]) < progressInterval {
+				b.held[key] = event
+				if flush == nil {
+					flush = time.After(b.lastSent[key].Add(progressInterval).Sub(now))
 				}
-				select {
-				case client.channel <- event:
-				default:
-					// Client is slow/blocked, skip
+				continue
+			}
+			delete(b.held, key)
+			b.broadcast(event, now)
+		case now := <-flush:
+			flush = nil
+			var next time.Time
+			for key, event := range b.held {
+				due := b.lastSent[key].Add(progressInterval)
+				if !now.Before(due) {
+					delete(b.held, key)
+					b.broadcast(event, now)
+				} else if next.IsZero() || due.Before(next) {
+					next = due
 				}
 			}
+			if !next.IsZero() {
+				flush = time.After(next.Sub(now))
+			}
+		}
+	}
+}
+
+// isRunning reports whether event is a progress update of a running job
+func isRunning(event models.ProgressEvent) bool {
+	return event.Status == "downloading" || event.Status == "processing"
+}
+
+// broadcast sends event to every client whose filter matches it
+func (b *ProgressBroadcaster) broadcast(event models.ProgressEvent, now time.Time) {
+	key := eventKey(event)
+	if isRunning(event) {
+		b.lastSent[key] = now
+	} else {
+		delete(b.lastSent, key)
+	}
+
+	for _, client := range b.clients {
+		if !matchesFilter(client.trackIDFilter, event) {
+			continue // Skip this client, event doesn't match their filter
+		}
+		select {
+		case client.channel <- event:
+		default:
+			// Client is slow/blocked, skip
 		}
 	}
 }
 
+// recordProgress keeps the percentage of running jobs and forgets jobs that
+// are finished or not yet started, whose stored status says it all
+func (b *ProgressBroadcaster) recordProgress(event models.ProgressEvent) {
+	b.progressMu.Lock()
+	defer b.progressMu.Unlock()
+	key := eventKey(event)
+	previous, running := b.progress[key]
+	switch {
+	case isRunning(event):
+		if !running || previous != event.Progress {
+			b.progress[key] = event.Progress
+			b.progressVersion++
+		}
+	default:
+		if running {
+			delete(b.progress, key)
+			b.progressVersion++
+		}
+	}
+}
+
+// ProgressVersion changes whenever the progress of a running job does, so
+// callers can tell whether Progress results may have changed
+func (b *ProgressBroadcaster) ProgressVersion() uint64 {
+	b.progressMu.RLock()
+	defer b.progressMu.RUnlock()
+	return b.progressVersion
+}
+
+// Progress returns the latest percentage reported by a running job of the given
+// type ("download" or "demucs") for a track, so clients that poll instead of
+// streaming still see jobs advance
+func (b *ProgressBroadcaster) Progress(trackID, jobType string) (float64, bool) {
+	b.progressMu.RLock()
+	defer b.progressMu.RUnlock()
+	progress, ok := b.progress[trackID+"/"+jobType]
+	return progress, ok
+}
+
 // SendEvent broadcasts a progress event to all connected clients
 func (b *ProgressBroadcaster) SendEvent(event models.ProgressEvent) {
 	b.events <- event
@@ -86,6 +244,38 @@ func (b *ProgressBroadcaster) RegisterClient(trackIDFilter map[string]bool) chan
 	return clientChan
 }
 
+// Subscribe registers an in-process listener for every event. Unlike a
+// streaming client's, its channel has room for buffer events, so a listener
+// doing some work between reads misses nothing unless it falls that far behind.
+func (b *ProgressBroadcaster) Subscribe(buffer int) chan models.ProgressEvent {
+	clientChan := make(chan models.ProgressEvent, buffer)
+	b.newClients <- clientRegistration{channel: clientChan}
+	return clientChan
+}
+
+// RegisterClientWithSnapshot registers a client that first receives snapshot
+// (e.g. the current DB state) before live events. Snapshot entries are replaced
+// by any newer event for the same track and type, closing the gap between
+// reading the snapshot and subscribing.
+func (b *ProgressBroadcaster) RegisterClientWithSnapshot(trackIDFilter map[string]bool, snapshot []models.ProgressEvent) chan models.ProgressEvent {
+	clientChan := make(chan models.ProgressEvent, len(snapshot))
+	b.newClients <- clientRegistration{
+		channel:       clientChan,
+		trackIDFilter: trackIDFilter,
+		snapshot:      snapshot,
+	}
+	return clientChan
+}
+
+// SetClientFilter replaces a registered client's filter, e.g. when a WebSocket
+// client subscribes to another playlist. A nil filter receives all events.
+func (b *ProgressBroadcaster) SetClientFilter(clientChan chan models.ProgressEvent, trackIDFilter map[string]bool) {
+	b.filterUpdates <- clientRegistration{
+		channel:       clientChan,
+		trackIDFilter: trackIDFilter,
+	}
+}
+
 // UnregisterClient unregisters a client
 func (b *ProgressBroadcaster) UnregisterClient(clientChan chan models.ProgressEvent) {
 	b.closingClients <- clientChan
@@ -0,0 +1,83 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"separate/server/models"
+)
+
+func TestProgressTracksRunningJobs(t *testing.T) {
+	b := NewProgressBroadcaster()
+	client := b.RegisterClient(nil)
+	defer b.UnregisterClient(client)
+
+	// Progress is recorded before the event is broadcast, so receiving it means
+	// the broadcaster has seen it
+	send := func(event models.ProgressEvent) {
+		b.SendEvent(event)
+		<-client
+	}
+
+	send(models.ProgressEvent{TrackID: "t1", Type: "download", Status: "downloading", Progress: 42.5})
+	send(models.ProgressEvent{TrackID: "t1", Type: "demucs", Status: "pending"})
+	if progress, ok := b.Progress("t1", "download"); !ok || progress != 42.5 {
+		t.Errorf("Expected download progress 42.5, got %v, %v", progress, ok)
+	}
+	if _, ok := b.Progress("t1", "demucs"); ok {
+		t.Error("Expected no progress for a job that hasn't started")
+	}
+
+	send(models.ProgressEvent{TrackID: "t1", Type: "download", Status: "completed", Progress: 100})
+	if _, ok := b.Progress("t1", "download"); ok {
+		t.Error("Expected a finished job to be forgotten")
+	}
+}
+
+func TestProgressThrottlesRunningJobs(t *testing.T) {
+	b := NewProgressBroadcaster()
+	client := b.RegisterClient(nil)
+	defer b.UnregisterClient(client)
+
+	receive := func(want models.ProgressEvent) {
+		t.Helper()
+		select {
+		case got := <-client:
+			if got != want {
+				t.Errorf("Expected %+v, got %+v", want, got)
+			}
+		case <-time.After(2 * progressInterval):
+			t.Fatalf("Expected %+v, got nothing", want)
+		}
+	}
+	progress := func(percent float64) models.ProgressEvent {
+		return models.ProgressEvent{TrackID: "t1", Type: "download", Status: "downloading", Progress: percent}
+	}
+
+	b.SendEvent(progress(10))
+	receive(progress(10))
+
+	// A burst collapses into its latest value, sent once the interval is up
+	sent := time.Now()
+	for _, percent := range []float64{20, 30, 40} {
+		b.SendEvent(progress(percent))
+	}
+	receive(progress(40))
+	if elapsed := time.Since(sent); elapsed < progressInterval/2 {
+		t.Errorf("Expected the burst to be held back, got it after %v", elapsed)
+	}
+	if p, _ := b.Progress("t1", "download"); p != 40 {
+		t.Errorf("Expected progress 40, got %v", p)
+	}
+
+	// A terminal event is never held back and supersedes held progress
+	completed := models.ProgressEvent{TrackID: "t1", Type: "download", Status: "completed", Progress: 100}
+	b.SendEvent(progress(50))
+	b.SendEvent(completed)
+	receive(completed)
+	select {
+	case event := <-client:
+		t.Errorf("Expected nothing after completion, got %+v", event)
+	case <-time.After(2 * progressInterval):
+	}
+}
@@ -1,31 +1,217 @@
 package core
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"separate/server/models"
 )
 
+const (
+	defaultHTTPTimeout = 30 * time.Second
+	spotifyTokenURL    = "https://accounts.spotify.com/api/token"
+	spotifyAPIBaseURL  = "https://api.spotify.com/v1"
+
+	maxSpotifyAttempts = 4
+	baseRetryDelay     = 500 * time.Millisecond
+	maxRetryDelay      = 10 * time.Second
+)
+
+// sleep waits between retries, returning ctx's error early if it is cancelled
+// (replaced in tests to avoid real delays)
+var sleep = func(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// httpClient is the default client for Spotify calls; the timeout keeps a hung
+// connection from blocking a worker or request handler forever
+var httpClient = &http.Client{Timeout: defaultHTTPTimeout}
+
+// SpotifyClient talks to the Spotify Web API using a configurable HTTP client
+type SpotifyClient struct {
+	config       models.SpotifyConfig
+	httpClient   *http.Client
+	tokenURL     string
+	authorizeURL string
+	apiBaseURL   string
+
+	appToken     cachedToken       // Client-credentials token
+	user         cachedToken       // Set once a user logs in through the authorization-code flow
+	refreshStore RefreshTokenStore // Optional persistence for the user's refresh token
+
+	tokenRefreshes atomic.Int64 // Client-credentials tokens fetched, for metrics; user tokens aren't counted
+}
+
+// SpotifyClientOption customizes a SpotifyClient
+type SpotifyClientOption func(*SpotifyClient)
+
+// WithHTTPClient uses the given client (e.g. an httptest server client or a proxying client)
+func WithHTTPClient(client *http.Client) SpotifyClientOption {
+	return func(c *SpotifyClient) {
+		c.httpClient = client
+	}
+}
+
+// WithTimeout uses a fresh client with the given request timeout
+func WithTimeout(timeout time.Duration) SpotifyClientOption {
+	return func(c *SpotifyClient) {
+		c.httpClient = &http.Client{Timeout: timeout, Transport: c.httpClient.Transport}
+	}
+}
+
+// WithProxy routes all Spotify traffic through proxyURL. The client timeout still
+// applies, so an unreachable proxy fails the request instead of hanging.
+func WithProxy(proxyURL *url.URL) SpotifyClientOption {
+	return func(c *SpotifyClient) {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = http.ProxyURL(proxyURL)
+		c.httpClient = &http.Client{Timeout: c.httpClient.Timeout, Transport: transport}
+	}
+}
+
+// NewSpotifyClient creates a Spotify API client for the given credentials
+func NewSpotifyClient(config models.SpotifyConfig, opts ...SpotifyClientOption) *SpotifyClient {
+	c := &SpotifyClient{
+		config:       config,
+		httpClient:   httpClient,
+		tokenURL:     spotifyTokenURL,
+		authorizeURL: spotifyAuthorizeURL,
+		apiBaseURL:   spotifyAPIBaseURL,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// isRetryableStatus reports whether a Spotify response status is transient
+func isRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable:
+		return true
+	}
+	return false
+}
+
+// retryDelay returns how long to wait after a failed attempt (0-based).
+// A 429 with a Retry-After header (seconds) is honored as-is; otherwise the
+// delay doubles each attempt with jitter.
+func retryDelay(attempt int, resp *http.Response) time.Duration {
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+
+	backoff := baseRetryDelay << attempt
+	if backoff > maxRetryDelay {
+		backoff = maxRetryDelay
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)))
+}
+
+// doWithRetry sends the request built by newRequest, retrying network errors
+// and transient statuses. Any other response is returned to the caller as-is.
+// Retries are per call, so a paginated fetch backs off on the failing page
+// without discarding the pages already collected. Once ctx is cancelled, the
+// request in flight is aborted and no further attempt is made.
+func doWithRetry(ctx context.Context, client *http.Client, newRequest func(ctx context.Context) (*http.Request, error)) (*http.Response, error) {
+	var lastErr error
+	for attempt := 0; attempt < maxSpotifyAttempts; attempt++ {
+		req, err := newRequest(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+
+		start := time.Now()
+		resp, err := client.Do(req)
+		if err == nil && !isRetryableStatus(resp.StatusCode) {
+			slog.Debug("Spotify request", "path", req.URL.Path, "status", resp.StatusCode,
+				"duration_ms", time.Since(start).Milliseconds())
+			return resp, nil
+		}
+
+		if ctx.Err() != nil {
+			if err == nil {
+				resp.Body.Close()
+			}
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			lastErr = err
+		} else {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			lastErr = fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
+		}
+
+		if attempt < maxSpotifyAttempts-1 {
+			delay := retryDelay(attempt, resp)
+			slog.Warn("Retrying Spotify request", "path", req.URL.Path, "attempt", attempt+1,
+				"delay_ms", delay.Milliseconds(), "error", lastErr)
+			if err := sleep(ctx, delay); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return nil, fmt.Errorf("giving up after %d attempts: %w", maxSpotifyAttempts, lastErr)
+}
+
+// authorizedGet returns a request builder for a bearer-authenticated GET
+func authorizedGet(reqURL, accessToken string) func(ctx context.Context) (*http.Request, error) {
+	return func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		return req, nil
+	}
+}
+
 // getAccessTokenWithExpiry obtains an access token and expiry information using client credentials flow
-func getAccessTokenWithExpiry(config models.SpotifyConfig) (*models.TokenResponse, error) {
+func (c *SpotifyClient) getAccessTokenWithExpiry(ctx context.Context) (*models.TokenResponse, error) {
 	data := url.Values{}
 	data.Set("grant_type", "client_credentials")
-
-	req, err := http.NewRequest("POST", "https://accounts.spotify.com/api/token", strings.NewReader(data.Encode()))
+	tokenResp, err := c.requestToken(ctx, data)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+		return nil, err
 	}
+	c.tokenRefreshes.Add(1)
+	return tokenResp, nil
+}
 
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.SetBasicAuth(config.ClientID, config.ClientSecret)
+// requestToken POSTs a grant to the token endpoint, authenticating as the app
+func (c *SpotifyClient) requestToken(ctx context.Context, data url.Values) (*models.TokenResponse, error) {
+	// The body reader is consumed per attempt, so build a fresh request each time
+	newRequest := func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", c.tokenURL, strings.NewReader(data.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(c.config.ClientID, c.config.ClientSecret)
+		return req, nil
+	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := doWithRetry(ctx, c.httpClient, newRequest)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get token: %w", err)
 	}
@@ -44,54 +230,75 @@ func getAccessTokenWithExpiry(config models.SpotifyConfig) (*models.TokenRespons
 	return &tokenResp, nil
 }
 
-// GetAccessToken obtains an access token using client credentials flow
-func GetAccessToken(config models.SpotifyConfig) (string, error) {
-	tokenResp, err := getAccessTokenWithExpiry(config)
-	if err != nil {
-		return "", err
-	}
-	return tokenResp.AccessToken, nil
+// GetAccessToken returns a client-credentials access token, reusing the
+// current one until it is about to expire
+func (c *SpotifyClient) GetAccessToken(ctx context.Context) (string, error) {
+	return c.appToken.get(func(string) (*models.TokenResponse, error) {
+		return c.getAccessTokenWithExpiry(ctx)
+	})
+}
+
+// TokenRefreshes returns how many client-credentials access tokens this client
+// has fetched. Logins and user token refreshes go through requestToken too but
+// are not counted.
+func (c *SpotifyClient) TokenRefreshes() int64 {
+	return c.tokenRefreshes.Load()
 }
 
 // GetAccessTokenWithDetails exposes the full response including expiry
-func GetAccessTokenWithDetails(config models.SpotifyConfig) (*models.TokenResponse, error) {
-	return getAccessTokenWithExpiry(config)
+func (c *SpotifyClient) GetAccessTokenWithDetails(ctx context.Context) (*models.TokenResponse, error) {
+	return c.getAccessTokenWithExpiry(ctx)
 }
 
 // fetchPlaylistPage fetches a single page of playlist data
-func fetchPlaylistPage(playlistID, accessToken, pageURL string) (requestURL string, response *playlistResponse, err error) {
+func (c *SpotifyClient) fetchPlaylistPage(ctx context.Context, playlistID, accessToken, pageURL string) (requestURL string, response *playlistResponse, err error) {
 	var reqURL string
 	if pageURL != "" {
 		reqURL = pageURL
 	} else {
-		reqURL = fmt.Sprintf("https://api.spotify.com/v1/playlists/%s", playlistID)
+		// Spotify carries the market through into the "next" URLs it returns
+		reqURL = c.withMarket(fmt.Sprintf("%s/playlists/%s", c.apiBaseURL, playlistID))
 	}
 
-	req, err := http.NewRequest("GET", reqURL, nil)
-	if err != nil {
-		return "", nil, fmt.Errorf("failed to create request: %w", err)
+	var playlistResp playlistResponse
+	if err := c.getJSON(ctx, reqURL, accessToken, "playlist", &playlistResp); err != nil {
+		return "", nil, err
 	}
 
-	req.Header.Set("Authorization", "Bearer "+accessToken)
+	return reqURL, &playlistResp, nil
+}
+
+// withMarket appends the configured market code to reqURL. With no market
+// configured the URL is returned unchanged.
+func (c *SpotifyClient) withMarket(reqURL string) string {
+	if c.config.Market == "" {
+		return reqURL
+	}
+	separator := "?"
+	if strings.Contains(reqURL, "?") {
+		separator = "&"
+	}
+	return reqURL + separator + "market=" + url.QueryEscape(c.config.Market)
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+// getJSON performs an authorized GET and decodes the JSON response into out.
+// kind names the resource in error messages (e.g. "playlist", "track").
+func (c *SpotifyClient) getJSON(ctx context.Context, reqURL, accessToken, kind string, out interface{}) error {
+	resp, err := doWithRetry(ctx, c.httpClient, authorizedGet(reqURL, accessToken))
 	if err != nil {
-		return "", nil, fmt.Errorf("failed to fetch playlist: %w", err)
+		return fmt.Errorf("failed to fetch %s: %w", kind, err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return "", nil, fmt.Errorf("playlist request failed with status %d: %s", resp.StatusCode, string(body))
+		return fmt.Errorf("%s request failed with status %d: %s", kind, resp.StatusCode, string(body))
 	}
 
-	var playlistResp playlistResponse
-	if err := json.NewDecoder(resp.Body).Decode(&playlistResp); err != nil {
-		return "", nil, fmt.Errorf("failed to decode playlist response: %w", err)
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode %s response: %w", kind, err)
 	}
-
-	return reqURL, &playlistResp, nil
+	return nil
 }
 
 // Private structs for JSON decoding of Spotify responses
@@ -109,6 +316,7 @@ type playlistResponse struct {
 
 type trackObject struct {
 	ID           string `json:"id"`
+	Type         string `json:"type"` // "track", or "episode" for podcast episodes in playlists
 	Name         string `json:"name"`
 	DurationMs   int    `json:"duration_ms"`
 	ExternalURLs struct {
@@ -122,15 +330,91 @@ type trackObject struct {
 		Name string `json:"name"`
 	} `json:"artists"`
 	Album struct {
-		Name        string `json:"name"`
-		ReleaseDate string `json:"release_date"`
+		Name        string        `json:"name"`
+		ReleaseDate string        `json:"release_date"`
+		Images      []imageObject `json:"images"`
 	} `json:"album"`
 }
 
+// isMusicTrack reports whether a playlist item is a song we can download.
+// Local files and removed tracks come back without an ID, and podcast episodes
+// have no artists or album to search for.
+func (track trackObject) isMusicTrack() bool {
+	return track.ID != "" && (track.Type == "" || track.Type == "track")
+}
+
+// imageObject is a cover image; Spotify may omit the dimensions
+type imageObject struct {
+	URL    string `json:"url"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// largestImageURL returns the URL of the biggest image, or "" if there are none.
+// Spotify usually lists the largest first, which also wins when sizes are unknown.
+func largestImageURL(images []imageObject) string {
+	best := -1
+	for i, image := range images {
+		if best < 0 || image.Width*image.Height > images[best].Width*images[best].Height {
+			best = i
+		}
+	}
+	if best < 0 {
+		return ""
+	}
+	return images[best].URL
+}
+
+// albumResponse is the album object; its first page of (simplified) tracks is embedded
+type albumResponse struct {
+	Name   string          `json:"name"`
+	Tracks albumTracksPage `json:"tracks"`
+}
+
+// albumTracksPage is a page of simplified track objects from /albums/{id}/tracks
+type albumTracksPage struct {
+	Items []trackObject `json:"items"`
+	Next  string        `json:"next"`
+	Total int           `json:"total"`
+}
+
+// searchResponse is the response from /search?type=track
+type searchResponse struct {
+	Tracks struct {
+		Items []trackObject `json:"items"`
+	} `json:"tracks"`
+}
+
+// tracksResponse is the batch response from /tracks?ids=
+type tracksResponse struct {
+	Tracks []*trackObject `json:"tracks"`
+}
+
+// toTrackMetadata converts a decoded Spotify track object to our metadata model
+func toTrackMetadata(track trackObject) models.TrackMetadata {
+	artists := make([]string, len(track.Artists))
+	for i, artist := range track.Artists {
+		artists[i] = artist.Name
+	}
+
+	return models.TrackMetadata{
+		ID:          track.ID,
+		Name:        track.Name,
+		Artists:     artists,
+		Album:       track.Album.Name,
+		DurationMs:  track.DurationMs,
+		SpotifyURL:  track.ExternalURLs.Spotify,
+		PreviewURL:  track.PreviewURL,
+		ReleaseDate: track.Album.ReleaseDate,
+		ISRC:        track.ExternalIDs.ISRC,
+		AlbumArtURL: largestImageURL(track.Album.Images),
+	}
+}
+
 // GetPlaylistMetadataWithToken fetches all metadata for a Spotify playlist using a provided access token
-func GetPlaylistMetadataWithToken(playlistID, accessToken string) (*models.PlaylistMetadata, error) {
+func (c *SpotifyClient) GetPlaylistMetadataWithToken(ctx context.Context, playlistID, accessToken string) (*models.PlaylistMetadata, error) {
 	// Fetch first page of playlist
-	_, playlistResp, err := fetchPlaylistPage(playlistID, accessToken, "")
+	_, playlistResp, err := c.fetchPlaylistPage(ctx, playlistID, accessToken, "")
 	if err != nil {
 		return nil, err
 	}
@@ -147,23 +431,11 @@ func GetPlaylistMetadataWithToken(playlistID, accessToken string) (*models.Playl
 		Track trackObject `json:"track"`
 	}) {
 		for _, item := range items {
-			track := item.Track
-			artists := make([]string, len(track.Artists))
-			for i, artist := range track.Artists {
-				artists[i] = artist.Name
+			if !item.Track.isMusicTrack() {
+				metadata.SkippedTracks++
+				continue
 			}
-
-			metadata.Tracks = append(metadata.Tracks, models.TrackMetadata{
-				ID:          track.ID,
-				Name:        track.Name,
-				Artists:     artists,
-				Album:       track.Album.Name,
-				DurationMs:  track.DurationMs,
-				SpotifyURL:  track.ExternalURLs.Spotify,
-				PreviewURL:  track.PreviewURL,
-				ReleaseDate: track.Album.ReleaseDate,
-				ISRC:        track.ExternalIDs.ISRC,
-			})
+			metadata.Tracks = append(metadata.Tracks, toTrackMetadata(item.Track))
 		}
 	}
 
@@ -173,7 +445,7 @@ func GetPlaylistMetadataWithToken(playlistID, accessToken string) (*models.Playl
 	// Fetch remaining pages if playlist has more than 100 tracks
 	nextURL := playlistResp.Tracks.Next
 	for nextURL != "" {
-		_, pageResp, err := fetchPlaylistPage(playlistID, accessToken, nextURL)
+		_, pageResp, err := c.fetchPlaylistPage(ctx, playlistID, accessToken, nextURL)
 		if err != nil {
 			return nil, fmt.Errorf("failed to fetch page: %w", err)
 		}
@@ -185,47 +457,117 @@ func GetPlaylistMetadataWithToken(playlistID, accessToken string) (*models.Playl
 }
 
 // GetTrackMetadata fetches metadata for a single track using Spotify API
-func GetTrackMetadata(trackID, accessToken string) (*models.TrackMetadata, error) {
-	reqURL := fmt.Sprintf("https://api.spotify.com/v1/tracks/%s", trackID)
+func (c *SpotifyClient) GetTrackMetadata(ctx context.Context, trackID, accessToken string) (*models.TrackMetadata, error) {
+	reqURL := c.withMarket(fmt.Sprintf("%s/tracks/%s", c.apiBaseURL, trackID))
 
-	req, err := http.NewRequest("GET", reqURL, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+	var trackResp trackObject
+	if err := c.getJSON(ctx, reqURL, accessToken, "track", &trackResp); err != nil {
+		return nil, err
 	}
 
-	req.Header.Set("Authorization", "Bearer "+accessToken)
+	track := toTrackMetadata(trackResp)
+	return &track, nil
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch track: %w", err)
+// MaxSearchLimit is the most results Spotify returns for one search
+const MaxSearchLimit = 50
+
+// SearchTracks searches Spotify for tracks matching query and returns up to limit
+// candidates in Spotify's relevance order
+func (c *SpotifyClient) SearchTracks(ctx context.Context, query string, limit int, accessToken string) ([]models.TrackMetadata, error) {
+	if limit < 1 || limit > MaxSearchLimit {
+		return nil, fmt.Errorf("search limit must be between 1 and %d, got %d", MaxSearchLimit, limit)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("track request failed with status %d: %s", resp.StatusCode, string(body))
+	params := url.Values{}
+	params.Set("q", query)
+	params.Set("type", "track")
+	params.Set("limit", strconv.Itoa(limit))
+	reqURL := c.withMarket(fmt.Sprintf("%s/search?%s", c.apiBaseURL, params.Encode()))
+
+	var searchResp searchResponse
+	if err := c.getJSON(ctx, reqURL, accessToken, "search", &searchResp); err != nil {
+		return nil, err
 	}
 
-	var trackResp trackObject
-	if err := json.NewDecoder(resp.Body).Decode(&trackResp); err != nil {
-		return nil, fmt.Errorf("failed to decode track response: %w", err)
+	tracks := make([]models.TrackMetadata, 0, len(searchResp.Tracks.Items))
+	for _, track := range searchResp.Tracks.Items {
+		tracks = append(tracks, toTrackMetadata(track))
 	}
+	return tracks, nil
+}
 
-	artists := make([]string, len(trackResp.Artists))
-	for i, artist := range trackResp.Artists {
-		artists[i] = artist.Name
+// maxTracksPerBatch is the most IDs Spotify accepts in one /tracks?ids= call
+const maxTracksPerBatch = 50
+
+// GetTracksMetadata fetches full metadata for many tracks, batching IDs in groups of 50.
+// Results are returned in the same order as trackIDs; IDs Spotify doesn't know are omitted.
+// A track relinked for the market keeps the ID it was asked for, so callers can
+// match results to the tracks they hold.
+func (c *SpotifyClient) GetTracksMetadata(ctx context.Context, trackIDs []string, accessToken string) ([]models.TrackMetadata, error) {
+	tracks := make([]models.TrackMetadata, 0, len(trackIDs))
+	for start := 0; start < len(trackIDs); start += maxTracksPerBatch {
+		end := start + maxTracksPerBatch
+		if end > len(trackIDs) {
+			end = len(trackIDs)
+		}
+
+		reqURL := c.withMarket(fmt.Sprintf("%s/tracks?ids=%s", c.apiBaseURL, strings.Join(trackIDs[start:end], ",")))
+
+		var batch tracksResponse
+		if err := c.getJSON(ctx, reqURL, accessToken, "tracks", &batch); err != nil {
+			return nil, err
+		}
+
+		// The response is positional, with null for unknown IDs
+		for i, track := range batch.Tracks {
+			if track == nil || start+i >= end {
+				continue
+			}
+			metadata := toTrackMetadata(*track)
+			metadata.ID = trackIDs[start+i]
+			tracks = append(tracks, metadata)
+		}
 	}
+	return tracks, nil
+}
 
-	return &models.TrackMetadata{
-		ID:          trackResp.ID,
-		Name:        trackResp.Name,
-		Artists:     artists,
-		Album:       trackResp.Album.Name,
-		DurationMs:  trackResp.DurationMs,
-		SpotifyURL:  trackResp.ExternalURLs.Spotify,
-		PreviewURL:  trackResp.PreviewURL,
-		ReleaseDate: trackResp.Album.ReleaseDate,
-		ISRC:        trackResp.ExternalIDs.ISRC,
+// GetAlbumMetadataWithToken fetches all tracks of a Spotify album in the playlist shape.
+// The album endpoints return simplified tracks without ISRC or release date, so full
+// track metadata is filled in with batched /tracks lookups.
+func (c *SpotifyClient) GetAlbumMetadataWithToken(ctx context.Context, albumID, accessToken string) (*models.PlaylistMetadata, error) {
+	var album albumResponse
+	albumURL := c.withMarket(fmt.Sprintf("%s/albums/%s", c.apiBaseURL, albumID))
+	if err := c.getJSON(ctx, albumURL, accessToken, "album", &album); err != nil {
+		return nil, err
+	}
+
+	trackIDs := make([]string, 0, album.Tracks.Total)
+	page := album.Tracks
+	for {
+		for _, track := range page.Items {
+			trackIDs = append(trackIDs, track.ID)
+		}
+		if page.Next == "" {
+			break
+		}
+
+		nextURL := page.Next
+		page = albumTracksPage{}
+		if err := c.getJSON(ctx, nextURL, accessToken, "album tracks", &page); err != nil {
+			return nil, fmt.Errorf("failed to fetch page: %w", err)
+		}
+	}
+
+	tracks, err := c.GetTracksMetadata(ctx, trackIDs, accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.PlaylistMetadata{
+		Name:          album.Name,
+		TotalTracks:   album.Tracks.Total,
+		Tracks:        tracks,
+		SkippedTracks: len(trackIDs) - len(tracks),
 	}, nil
 }
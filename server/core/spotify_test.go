@@ -1,11 +1,17 @@
 package core
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/joho/godotenv"
 
@@ -46,7 +52,8 @@ func TestFetchPlaylistPageParsing(t *testing.T) {
 	}))
 	defer server.Close()
 
-	_, resp, err := fetchPlaylistPage("test", "token", server.URL)
+	client := NewSpotifyClient(models.SpotifyConfig{}, WithHTTPClient(server.Client()))
+	_, resp, err := client.fetchPlaylistPage(context.Background(), "test", "token", server.URL)
 	if err != nil {
 		t.Fatalf("Failed to fetch: %v", err)
 	}
@@ -64,6 +71,434 @@ func TestFetchPlaylistPageParsing(t *testing.T) {
 	}
 }
 
+func TestFetchPlaylistPageRetriesRateLimit(t *testing.T) {
+	originalSleep := sleep
+	sleep = func(context.Context, time.Duration) error { return nil }
+	defer func() { sleep = originalSleep }()
+
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("Expected bearer token on retry, got %q", r.Header.Get("Authorization"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(playlistResponse{Name: "Rate Limited"})
+	}))
+	defer server.Close()
+
+	client := NewSpotifyClient(models.SpotifyConfig{}, WithHTTPClient(server.Client()))
+	_, resp, err := client.fetchPlaylistPage(context.Background(), "test", "token", server.URL)
+	if err != nil {
+		t.Fatalf("Failed to fetch: %v", err)
+	}
+	if resp.Name != "Rate Limited" {
+		t.Errorf("Expected 'Rate Limited', got '%s'", resp.Name)
+	}
+	if calls != 2 {
+		t.Errorf("Expected 2 calls, got %d", calls)
+	}
+}
+
+func TestDoWithRetryRecoversFromTransientErrors(t *testing.T) {
+	var delays []time.Duration
+	originalSleep := sleep
+	sleep = func(_ context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return nil
+	}
+	defer func() { sleep = originalSleep }()
+
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch calls {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.Header().Set("Retry-After", "3")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer server.Close()
+
+	resp, err := doWithRetry(context.Background(), server.Client(), func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	})
+	if err != nil {
+		t.Fatalf("Expected success after retries, got: %v", err)
+	}
+	resp.Body.Close()
+
+	if calls != 3 {
+		t.Errorf("Expected 3 calls, got %d", calls)
+	}
+	if len(delays) != 2 {
+		t.Fatalf("Expected 2 delays, got %d", len(delays))
+	}
+	if delays[1] != 3*time.Second {
+		t.Errorf("Expected Retry-After delay of 3s, got %v", delays[1])
+	}
+}
+
+func TestDoWithRetryGivesUp(t *testing.T) {
+	originalSleep := sleep
+	sleep = func(context.Context, time.Duration) error { return nil }
+	defer func() { sleep = originalSleep }()
+
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	_, err := doWithRetry(context.Background(), server.Client(), func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	})
+	if err == nil {
+		t.Fatal("Expected error after exhausting retries")
+	}
+	if calls != maxSpotifyAttempts {
+		t.Errorf("Expected %d calls, got %d", maxSpotifyAttempts, calls)
+	}
+}
+
+func TestPlaylistFetchStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pages := 0
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pages++
+		if pages > 1 {
+			// The client goes away while a later page is in flight
+			cancel()
+			<-r.Context().Done()
+			return
+		}
+		var page playlistResponse
+		page.Tracks.Next = server.URL + "/next"
+		json.NewEncoder(w).Encode(page)
+	}))
+	defer server.Close()
+
+	client := NewSpotifyClient(models.SpotifyConfig{}, WithHTTPClient(server.Client()))
+	client.apiBaseURL = server.URL
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.GetPlaylistMetadataWithToken(ctx, "long", "token")
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the fetch to stop once cancelled")
+	}
+	if pages != 2 {
+		t.Errorf("Expected no retry after cancellation, got %d requests", pages)
+	}
+}
+
+func TestGetTrackMetadataUsesInjectedClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/tracks/abc" {
+			t.Errorf("Expected /tracks/abc, got %s", r.URL.Path)
+		}
+		track := trackObject{ID: "abc", Name: "Injected"}
+		track.ExternalIDs.ISRC = "USRC17607839"
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(track)
+	}))
+	defer server.Close()
+
+	client := NewSpotifyClient(models.SpotifyConfig{}, WithHTTPClient(server.Client()))
+	client.apiBaseURL = server.URL
+
+	track, err := client.GetTrackMetadata(context.Background(), "abc", "token")
+	if err != nil {
+		t.Fatalf("GetTrackMetadata failed: %v", err)
+	}
+	if track.Name != "Injected" || track.ISRC != "USRC17607839" {
+		t.Errorf("Unexpected track: %+v", track)
+	}
+}
+
+func TestSearchTracksParsesNestedItems(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.URL.Path != "/search" || query.Get("type") != "track" || query.Get("q") != "lorde - the louvre" || query.Get("limit") != "2" {
+			t.Errorf("Unexpected search request: %s", r.URL)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"tracks": {"items": [
+			{"id": "a1", "name": "The Louvre", "duration_ms": 286000, "artists": [{"name": "Lorde"}], "album": {"name": "Melodrama"}},
+			{"id": "a2", "name": "The Louvre - Live", "artists": [{"name": "Lorde"}], "album": {"name": "Live"}}
+		], "total": 2}}`)
+	}))
+	defer server.Close()
+
+	client := NewSpotifyClient(models.SpotifyConfig{}, WithHTTPClient(server.Client()))
+	client.apiBaseURL = server.URL
+
+	tracks, err := client.SearchTracks(context.Background(), "lorde - the louvre", 2, "token")
+	if err != nil {
+		t.Fatalf("SearchTracks failed: %v", err)
+	}
+	if len(tracks) != 2 || tracks[0].ID != "a1" || tracks[0].Album != "Melodrama" || tracks[0].Artists[0] != "Lorde" {
+		t.Errorf("Unexpected results: %+v", tracks)
+	}
+
+	if _, err := client.SearchTracks(context.Background(), "lorde", MaxSearchLimit+1, "token"); err == nil {
+		t.Error("Expected an out-of-range limit to be rejected")
+	}
+}
+
+func TestGetAccessTokenReusesUnexpiredToken(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		// Short enough that the expiry margin makes the token stale immediately
+		expiresIn := 3600
+		if requests > 1 {
+			expiresIn = 30
+		}
+		json.NewEncoder(w).Encode(models.TokenResponse{AccessToken: fmt.Sprintf("token%d", requests), ExpiresIn: expiresIn})
+	}))
+	defer server.Close()
+
+	client := NewSpotifyClient(models.SpotifyConfig{}, WithHTTPClient(server.Client()))
+	client.tokenURL = server.URL
+
+	for i := 0; i < 3; i++ {
+		if token, err := client.GetAccessToken(context.Background()); err != nil || token != "token1" {
+			t.Fatalf("GetAccessToken = %q, %v; want token1", token, err)
+		}
+	}
+	if requests != 1 {
+		t.Fatalf("Expected one token request, got %d", requests)
+	}
+
+	// Force expiry: the next call fetches a new token
+	client.appToken.expiry = time.Now().Add(-time.Second)
+	if token, _ := client.GetAccessToken(context.Background()); token != "token2" {
+		t.Errorf("Expected a renewed token, got %q", token)
+	}
+	if token, _ := client.GetAccessToken(context.Background()); token != "token3" {
+		t.Errorf("Expected a token inside the expiry margin to be renewed, got %q", token)
+	}
+	if refreshes := client.TokenRefreshes(); refreshes != 3 {
+		t.Errorf("Expected 3 token refreshes, got %d", refreshes)
+	}
+}
+
+func TestWithProxyRoutesThroughProxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A forward proxy sees the absolute target URL
+		proxied = r.URL.String()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(trackObject{ID: "abc", Name: "Proxied"})
+	}))
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := NewSpotifyClient(models.SpotifyConfig{}, WithProxy(proxyURL), WithTimeout(5*time.Second))
+	client.apiBaseURL = "http://api.spotify.invalid/v1"
+
+	track, err := client.GetTrackMetadata(context.Background(), "abc", "token")
+	if err != nil {
+		t.Fatalf("GetTrackMetadata failed: %v", err)
+	}
+	if track.Name != "Proxied" || proxied != "http://api.spotify.invalid/v1/tracks/abc" {
+		t.Errorf("Expected request via proxy, got track %+v and proxied URL %q", track, proxied)
+	}
+	if client.httpClient.Timeout != 5*time.Second {
+		t.Errorf("Expected timeout to be kept, got %v", client.httpClient.Timeout)
+	}
+}
+
+func TestLargestImageURL(t *testing.T) {
+	images := []imageObject{
+		{URL: "small", Width: 64, Height: 64},
+		{URL: "large", Width: 640, Height: 640},
+		{URL: "medium", Width: 300, Height: 300},
+	}
+	if got := largestImageURL(images); got != "large" {
+		t.Errorf("Expected large, got %s", got)
+	}
+	if got := largestImageURL(nil); got != "" {
+		t.Errorf("Expected no URL without images, got %s", got)
+	}
+}
+
+func TestGetPlaylistMetadataSkipsLocalTracks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		// Second item is a local file, third is a removed track (null), fourth
+		// is a podcast episode
+		w.Write([]byte(`{"name":"Mixed","tracks":{"total":4,"items":[
+			{"track":{"id":"real1","name":"Real","type":"track"}},
+			{"track":{"id":null,"name":"Local File","is_local":true}},
+			{"track":null},
+			{"track":{"id":"episode1","name":"Episode 12","type":"episode","show":{"name":"Podcast"}}}
+		]}}`))
+	}))
+	defer server.Close()
+
+	client := NewSpotifyClient(models.SpotifyConfig{}, WithHTTPClient(server.Client()))
+	client.apiBaseURL = server.URL
+
+	metadata, err := client.GetPlaylistMetadataWithToken(context.Background(), "mixed", "token")
+	if err != nil {
+		t.Fatalf("GetPlaylistMetadataWithToken failed: %v", err)
+	}
+
+	if len(metadata.Tracks) != 1 || metadata.Tracks[0].ID != "real1" {
+		t.Errorf("Expected only real1, got %+v", metadata.Tracks)
+	}
+	if metadata.SkippedTracks != 3 {
+		t.Errorf("Expected 3 skipped tracks, got %d", metadata.SkippedTracks)
+	}
+}
+
+func TestMarketIsAppendedWhenConfigured(t *testing.T) {
+	var markets []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		markets = append(markets, r.URL.Query().Get("market"))
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/tracks" {
+			json.NewEncoder(w).Encode(tracksResponse{})
+			return
+		}
+		json.NewEncoder(w).Encode(trackObject{ID: "abc"})
+	}))
+	defer server.Close()
+
+	withMarket := NewSpotifyClient(models.SpotifyConfig{Market: "US"}, WithHTTPClient(server.Client()))
+	withMarket.apiBaseURL = server.URL
+	withoutMarket := NewSpotifyClient(models.SpotifyConfig{}, WithHTTPClient(server.Client()))
+	withoutMarket.apiBaseURL = server.URL
+
+	if _, err := withMarket.GetTrackMetadata(context.Background(), "abc", "token"); err != nil {
+		t.Fatalf("GetTrackMetadata failed: %v", err)
+	}
+	if _, err := withMarket.GetTracksMetadata(context.Background(), []string{"abc"}, "token"); err != nil {
+		t.Fatalf("GetTracksMetadata failed: %v", err)
+	}
+	if _, err := withoutMarket.GetTrackMetadata(context.Background(), "abc", "token"); err != nil {
+		t.Fatalf("GetTrackMetadata failed: %v", err)
+	}
+
+	if fmt.Sprint(markets) != "[US US ]" {
+		t.Errorf("Expected markets [US US ], got %q", markets)
+	}
+}
+
+func TestGetTracksMetadataBatchesInOrder(t *testing.T) {
+	trackIDs := make([]string, 120)
+	for i := range trackIDs {
+		trackIDs[i] = fmt.Sprintf("id%03d", i)
+	}
+
+	var batchSizes []int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids := strings.Split(r.URL.Query().Get("ids"), ",")
+		batchSizes = append(batchSizes, len(ids))
+
+		var resp tracksResponse
+		for _, id := range ids {
+			// Relinking for the market swaps in another copy of the track
+			if id == "id007" {
+				id = "relinked"
+			}
+			resp.Tracks = append(resp.Tracks, &trackObject{ID: id})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+
+	client := NewSpotifyClient(models.SpotifyConfig{}, WithHTTPClient(server.Client()))
+	client.apiBaseURL = server.URL
+
+	tracks, err := client.GetTracksMetadata(context.Background(), trackIDs, "token")
+	if err != nil {
+		t.Fatalf("GetTracksMetadata failed: %v", err)
+	}
+
+	if fmt.Sprint(batchSizes) != "[50 50 20]" {
+		t.Errorf("Expected batches of [50 50 20], got %v", batchSizes)
+	}
+	if len(tracks) != len(trackIDs) {
+		t.Fatalf("Expected %d tracks, got %d", len(trackIDs), len(tracks))
+	}
+	for i, track := range tracks {
+		if track.ID != trackIDs[i] {
+			t.Fatalf("Expected track %d to be %s, got %s", i, trackIDs[i], track.ID)
+		}
+	}
+}
+
+func TestGetAlbumMetadataPaginatesAndFillsTracks(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/albums/alb":
+			album := albumResponse{Name: "Test Album"}
+			album.Tracks.Total = 2
+			album.Tracks.Items = []trackObject{{ID: "t1"}}
+			album.Tracks.Next = server.URL + "/albums/alb/tracks?offset=1"
+			json.NewEncoder(w).Encode(album)
+		case "/albums/alb/tracks":
+			json.NewEncoder(w).Encode(albumTracksPage{Items: []trackObject{{ID: "t2"}}, Total: 2})
+		case "/tracks":
+			if ids := r.URL.Query().Get("ids"); ids != "t1,t2" {
+				t.Errorf("Expected ids t1,t2, got %q", ids)
+			}
+			first, second := trackObject{ID: "t1", Name: "One"}, trackObject{ID: "t2", Name: "Two"}
+			first.ExternalIDs.ISRC = "ISRC1"
+			second.Album.ReleaseDate = "2017-06-16"
+			json.NewEncoder(w).Encode(tracksResponse{Tracks: []*trackObject{&first, &second}})
+		default:
+			t.Errorf("Unexpected request to %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := NewSpotifyClient(models.SpotifyConfig{}, WithHTTPClient(server.Client()))
+	client.apiBaseURL = server.URL
+
+	metadata, err := client.GetAlbumMetadataWithToken(context.Background(), "alb", "token")
+	if err != nil {
+		t.Fatalf("GetAlbumMetadataWithToken failed: %v", err)
+	}
+
+	if metadata.Name != "Test Album" {
+		t.Errorf("Expected 'Test Album', got '%s'", metadata.Name)
+	}
+	if len(metadata.Tracks) != 2 {
+		t.Fatalf("Expected 2 tracks, got %d", len(metadata.Tracks))
+	}
+	if metadata.Tracks[0].ISRC != "ISRC1" || metadata.Tracks[1].ReleaseDate != "2017-06-16" {
+		t.Errorf("Expected batch lookup to fill ISRC and release date, got %+v", metadata.Tracks)
+	}
+}
+
 // Integration Tests
 
 func TestGetPlaylistMetadataIntegration(t *testing.T) {
@@ -85,13 +520,15 @@ func TestGetPlaylistMetadataIntegration(t *testing.T) {
 		PlaylistID:   playlistID,
 	}
 
+	client := NewSpotifyClient(config)
+
 	// Used GetAccessToken to get token first
-	token, err := GetAccessToken(config)
+	token, err := client.GetAccessToken(context.Background())
 	if err != nil {
 		t.Fatalf("Failed to get token: %v", err)
 	}
 
-	metadata, err := GetPlaylistMetadataWithToken(config.PlaylistID, token)
+	metadata, err := client.GetPlaylistMetadataWithToken(context.Background(), config.PlaylistID, token)
 	if err != nil {
 		t.Fatalf("GetPlaylistMetadata failed: %v", err)
 	}
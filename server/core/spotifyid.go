@@ -0,0 +1,68 @@
+package core
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// spotifyIDPattern matches a bare 22-character base62 Spotify ID
+var spotifyIDPattern = regexp.MustCompile(`^[0-9A-Za-z]{22}$`)
+
+// ParsePlaylistID extracts a playlist ID from a raw ID, spotify:playlist: URI or open.spotify.com URL
+func ParsePlaylistID(input string) (string, error) {
+	return parseSpotifyID(input, "playlist")
+}
+
+// ParseAlbumID extracts an album ID from a raw ID, spotify:album: URI or open.spotify.com URL
+func ParseAlbumID(input string) (string, error) {
+	return parseSpotifyID(input, "album")
+}
+
+// ParseTrackID extracts a track ID from a raw ID, spotify:track: URI or open.spotify.com URL
+func ParseTrackID(input string) (string, error) {
+	return parseSpotifyID(input, "track")
+}
+
+// parseSpotifyID accepts the forms users paste for a Spotify object of the given kind
+// and returns the bare ID
+func parseSpotifyID(input, kind string) (string, error) {
+	s := strings.TrimSpace(input)
+
+	switch {
+	case strings.HasPrefix(s, "spotify:"):
+		// spotify:playlist:<id>
+		parts := strings.Split(s, ":")
+		if len(parts) != 3 || parts[1] != kind {
+			return "", fmt.Errorf("invalid Spotify %s URI: %q", kind, input)
+		}
+		s = parts[2]
+
+	case strings.Contains(s, "open.spotify.com"):
+		if !strings.Contains(s, "://") {
+			s = "https://" + s
+		}
+		u, err := url.Parse(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid Spotify %s URL: %q", kind, input)
+		}
+		// Paths may carry a locale prefix, e.g. /intl-de/playlist/<id>
+		segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+		s = ""
+		for i := 0; i+1 < len(segments); i++ {
+			if segments[i] == kind {
+				s = segments[i+1]
+				break
+			}
+		}
+		if s == "" {
+			return "", fmt.Errorf("URL is not a Spotify %s link: %q", kind, input)
+		}
+	}
+
+	if !spotifyIDPattern.MatchString(s) {
+		return "", fmt.Errorf("invalid Spotify %s ID: %q", kind, input)
+	}
+	return s, nil
+}
@@ -0,0 +1,55 @@
+package core
+
+import "testing"
+
+func TestParsePlaylistID(t *testing.T) {
+	const id = "37i9dQZF1DXcBWIGoYBM5M"
+
+	valid := []string{
+		id,
+		"  " + id + "\n",
+		"spotify:playlist:" + id,
+		"https://open.spotify.com/playlist/" + id,
+		"https://open.spotify.com/playlist/" + id + "?si=abc123",
+		"https://open.spotify.com/intl-de/playlist/" + id,
+		"open.spotify.com/playlist/" + id,
+	}
+	for _, input := range valid {
+		got, err := ParsePlaylistID(input)
+		if err != nil {
+			t.Errorf("ParsePlaylistID(%q) returned error: %v", input, err)
+			continue
+		}
+		if got != id {
+			t.Errorf("ParsePlaylistID(%q) = %q, want %q", input, got, id)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"not-an-id",
+		id + "x",
+		"spotify:album:" + id,
+		"https://open.spotify.com/album/" + id,
+		"https://open.spotify.com/playlist/",
+	}
+	for _, input := range invalid {
+		if got, err := ParsePlaylistID(input); err == nil {
+			t.Errorf("ParsePlaylistID(%q) = %q, want error", input, got)
+		}
+	}
+}
+
+func TestParseAlbumAndTrackID(t *testing.T) {
+	const id = "4aawyAB9vmqN3uQ7FjRGTy"
+
+	if got, err := ParseAlbumID("https://open.spotify.com/album/" + id + "?si=x"); err != nil || got != id {
+		t.Errorf("ParseAlbumID = %q, %v; want %q", got, err, id)
+	}
+	if got, err := ParseTrackID("spotify:track:" + id); err != nil || got != id {
+		t.Errorf("ParseTrackID = %q, %v; want %q", got, err, id)
+	}
+	if _, err := ParseTrackID("https://open.spotify.com/playlist/" + id); err == nil {
+		t.Error("ParseTrackID accepted a playlist URL")
+	}
+}
@@ -0,0 +1,72 @@
+package core
+
+import (
+	"sync"
+	"time"
+
+	"separate/server/models"
+)
+
+// tokenExpiryMargin renews a token this long before Spotify says it expires,
+// so a request started just before expiry doesn't carry a dead token
+const tokenExpiryMargin = time.Minute
+
+// cachedToken is an access token reused until it is about to expire. Callers
+// share it on a read-locked fast path; renewal takes the write lock.
+type cachedToken struct {
+	mu           sync.RWMutex
+	accessToken  string
+	refreshToken string // Authorization-code flow only
+	expiry       time.Time
+}
+
+// get returns the cached access token, calling renew for a new one when it is
+// missing or about to expire. renew receives the current refresh token, if any.
+func (t *cachedToken) get(renew func(refreshToken string) (*models.TokenResponse, error)) (string, error) {
+	t.mu.RLock()
+	token, ok := t.validLocked()
+	t.mu.RUnlock()
+	if ok {
+		return token, nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Another caller may have renewed it while we waited for the lock
+	if token, ok := t.validLocked(); ok {
+		return token, nil
+	}
+
+	tokenResp, err := renew(t.refreshToken)
+	if err != nil {
+		return "", err
+	}
+	t.setLocked(tokenResp)
+	return t.accessToken, nil
+}
+
+// set replaces the cached token with a fresh token response
+func (t *cachedToken) set(tokenResp *models.TokenResponse) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.setLocked(tokenResp)
+}
+
+// setLocked stores tokenResp, keeping the previous refresh token if Spotify
+// didn't rotate it. Callers hold mu.
+func (t *cachedToken) setLocked(tokenResp *models.TokenResponse) {
+	t.accessToken = tokenResp.AccessToken
+	t.expiry = time.Now().Add(time.Duration(tokenResp.ExpiresIn)*time.Second - tokenExpiryMargin)
+	if tokenResp.RefreshToken != "" {
+		t.refreshToken = tokenResp.RefreshToken
+	}
+}
+
+// validLocked returns the access token if it is still usable. Callers hold mu.
+func (t *cachedToken) validLocked() (string, bool) {
+	if t.accessToken == "" || !time.Now().Before(t.expiry) {
+		return "", false
+	}
+	return t.accessToken, true
+}
@@ -2,8 +2,10 @@ package db
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"separate/server/models"
 
@@ -14,61 +16,91 @@ type DB struct {
 	*sql.DB
 }
 
-// InitDB initializes the SQLite database and creates tables
+// ErrJobInProgress is returned when a change would interfere with a running job
+var ErrJobInProgress = errors.New("job is in progress")
+
+// ErrTrackNotFound is returned when no track has the requested ID
+var ErrTrackNotFound = errors.New("track not found")
+
+// busyTimeoutMs is how long a connection waits on a locked database before failing
+const busyTimeoutMs = 5000
+
+// connectionParams configure every pooled connection. busy_timeout and foreign_keys
+// are per-connection pragmas, so they go in the DSN rather than a one-off PRAGMA.
+// WAL lets the HTTP handlers read while workers write; immediate transactions take
+// the write lock up front so a read-then-write transaction never fails mid-way.
+var connectionParams = fmt.Sprintf("_journal_mode=WAL&_busy_timeout=%d&_foreign_keys=on&_txlock=immediate", busyTimeoutMs)
+
+// InitDB opens the SQLite database at path and applies any pending migrations.
+// An in-memory path (":memory:") works but is limited to one open connection, so
+// HTTP reads queue behind worker writes, and it uses the "memory" journal rather than WAL.
 func InitDB(path string) (*DB, error) {
-	db, err := sql.Open("sqlite3", path)
+	dsn := path + "?" + connectionParams
+	if strings.Contains(path, "?") {
+		dsn = path + "&" + connectionParams
+	}
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		return nil, err
 	}
 
-	// Create schema
-	schema := `
-	CREATE TABLE IF NOT EXISTS tracks (
-		track_id TEXT PRIMARY KEY,
-		name TEXT NOT NULL,
-		artists TEXT NOT NULL,
-		download_status TEXT NOT NULL,
-		error_message TEXT,
-		demucs_status TEXT DEFAULT 'pending',
-		demucs_error_message TEXT,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	);
-	CREATE INDEX IF NOT EXISTS idx_download_status ON tracks(download_status);
-	CREATE INDEX IF NOT EXISTS idx_demucs_status ON tracks(demucs_status);
-
-	CREATE TABLE IF NOT EXISTS playlist_tracks (
-		playlist_id TEXT NOT NULL,
-		track_id TEXT NOT NULL,
-		PRIMARY KEY (playlist_id, track_id),
-		FOREIGN KEY (track_id) REFERENCES tracks(track_id)
-	);
-	CREATE INDEX IF NOT EXISTS idx_playlist_id ON playlist_tracks(playlist_id);
-	`
-
-	_, err = db.Exec(schema)
-	if err != nil {
-		return nil, err
+	// Each pooled connection to an in-memory database opens its own empty
+	// database, so everything has to share a single connection
+	if isInMemory(path) {
+		db.SetMaxOpenConns(1)
 	}
 
-	// Migration: add demucs columns if they don't exist
-	migrations := []string{
-		`ALTER TABLE tracks ADD COLUMN demucs_status TEXT DEFAULT 'pending'`,
-		`ALTER TABLE tracks ADD COLUMN demucs_error_message TEXT`,
-		`CREATE INDEX IF NOT EXISTS idx_demucs_status ON tracks(demucs_status)`,
+	if err := verifyPragmas(db); err != nil {
+		db.Close()
+		return nil, err
 	}
 
-	for _, migration := range migrations {
-		// Ignore errors if column already exists
-		db.Exec(migration)
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
 	}
 
 	return &DB{db}, nil
 }
 
-// GetPendingDownloadJobs returns all tracks that are pending download
+// isInMemory reports whether path names an in-memory SQLite database
+// (":memory:", "file::memory:", or a file: URI with mode=memory)
+func isInMemory(path string) bool {
+	return strings.HasPrefix(path, ":memory:") || strings.HasPrefix(path, "file::memory:") ||
+		(strings.HasPrefix(path, "file:") && strings.Contains(path, "mode=memory"))
+}
+
+// verifyPragmas reads the connection settings back, since SQLite silently ignores
+// pragmas it cannot apply (in-memory databases, for example, cannot use WAL)
+func verifyPragmas(db *sql.DB) error {
+	var journalMode string
+	var busyTimeout, foreignKeys int
+	if err := db.QueryRow("PRAGMA journal_mode").Scan(&journalMode); err != nil {
+		return fmt.Errorf("failed to read journal_mode: %w", err)
+	}
+	if err := db.QueryRow("PRAGMA busy_timeout").Scan(&busyTimeout); err != nil {
+		return fmt.Errorf("failed to read busy_timeout: %w", err)
+	}
+	if err := db.QueryRow("PRAGMA foreign_keys").Scan(&foreignKeys); err != nil {
+		return fmt.Errorf("failed to read foreign_keys: %w", err)
+	}
+
+	if journalMode != "wal" && journalMode != "memory" {
+		return fmt.Errorf("expected WAL journal mode, got %q", journalMode)
+	}
+	if busyTimeout != busyTimeoutMs {
+		return fmt.Errorf("expected busy_timeout %d, got %d", busyTimeoutMs, busyTimeout)
+	}
+	if foreignKeys != 1 {
+		return errors.New("foreign key enforcement is not enabled")
+	}
+	return nil
+}
+
+// GetPendingDownloadJobs returns all tracks that are pending download, oldest first.
+// rowid breaks ties between tracks saved in the same second.
 func (db *DB) GetPendingDownloadJobs() ([]string, error) {
-	rows, err := db.Query("SELECT track_id FROM tracks WHERE download_status = 'pending'")
+	rows, err := db.Query("SELECT track_id FROM tracks WHERE download_status = 'pending' ORDER BY created_at ASC, rowid ASC")
 	if err != nil {
 		return nil, err
 	}
@@ -83,12 +115,13 @@ func (db *DB) GetPendingDownloadJobs() ([]string, error) {
 	return trackIDs, nil
 }
 
-// GetPendingDemucsJobs returns all tracks that are downloaded but pending Demucs processing
+// GetPendingDemucsJobs returns all tracks that are downloaded but pending Demucs processing, oldest first
 func (db *DB) GetPendingDemucsJobs() ([]models.TrackMetadata, error) {
 	rows, err := db.Query(`
 		SELECT track_id, name, artists
 		FROM tracks
 		WHERE download_status = 'completed' AND demucs_status = 'pending'
+		ORDER BY created_at ASC, rowid ASC
 	`)
 	if err != nil {
 		return nil, err
@@ -118,13 +151,13 @@ func (db *DB) UpdateDownloadStatus(trackID, status, errorMessage string) error {
 	if errorMessage != "" {
 		_, err = db.Exec(`
 			UPDATE tracks
-			SET download_status = ?, error_message = ?, updated_at = CURRENT_TIMESTAMP
+			SET download_status = ?, error_message = ?, updated_at = strftime('%Y-%m-%d %H:%M:%f', 'now')
 			WHERE track_id = ?
 		`, status, errorMessage, trackID)
 	} else {
 		_, err = db.Exec(`
 			UPDATE tracks
-			SET download_status = ?, error_message = NULL, updated_at = CURRENT_TIMESTAMP
+			SET download_status = ?, error_message = NULL, updated_at = strftime('%Y-%m-%d %H:%M:%f', 'now')
 			WHERE track_id = ?
 		`, status, trackID)
 	}
@@ -137,19 +170,75 @@ func (db *DB) UpdateDemucsStatus(trackID, status, errorMessage string) error {
 	if errorMessage != "" {
 		_, err = db.Exec(`
 			UPDATE tracks
-			SET demucs_status = ?, demucs_error_message = ?, updated_at = CURRENT_TIMESTAMP
+			SET demucs_status = ?, demucs_error_message = ?, updated_at = strftime('%Y-%m-%d %H:%M:%f', 'now')
 			WHERE track_id = ?
 		`, status, errorMessage, trackID)
 	} else {
 		_, err = db.Exec(`
 			UPDATE tracks
-			SET demucs_status = ?, demucs_error_message = NULL, updated_at = CURRENT_TIMESTAMP
+			SET demucs_status = ?, demucs_error_message = NULL, updated_at = strftime('%Y-%m-%d %H:%M:%f', 'now')
 			WHERE track_id = ?
 		`, status, trackID)
 	}
 	return err
 }
 
+// SetDemucsStatus sets a track's Demucs status on request, clearing its error
+// and timing. Unlike UpdateDemucsStatus, which workers use, it refuses with
+// ErrJobInProgress while the job is running.
+func (db *DB) SetDemucsStatus(trackID, status string) error {
+	result, err := db.Exec(`
+		UPDATE tracks
+		SET demucs_status = ?, demucs_error_message = NULL, demucs_duration_ms = NULL,
+		    updated_at = strftime('%Y-%m-%d %H:%M:%f', 'now')
+		WHERE track_id = ? AND demucs_status != 'in_progress'
+	`, status, trackID)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		if _, err := db.GetTrack(trackID); err != nil {
+			return err
+		}
+		return ErrJobInProgress
+	}
+	return nil
+}
+
+// BeginAttempt marks a track's download or Demucs job in_progress, clearing its
+// previous error, and returns how many times the job has now been started.
+// kind is "download" or "demucs".
+func (db *DB) BeginAttempt(trackID, kind string) (int, error) {
+	var query string
+	switch kind {
+	case "download":
+		query = `
+			UPDATE tracks
+			SET download_status = 'in_progress', error_message = NULL, download_attempts = download_attempts + 1,
+			    updated_at = strftime('%Y-%m-%d %H:%M:%f', 'now')
+			WHERE track_id = ?
+			RETURNING download_attempts
+		`
+	case "demucs":
+		query = `
+			UPDATE tracks
+			SET demucs_status = 'in_progress', demucs_error_message = NULL, demucs_attempts = demucs_attempts + 1,
+			    updated_at = strftime('%Y-%m-%d %H:%M:%f', 'now')
+			WHERE track_id = ?
+			RETURNING demucs_attempts
+		`
+	default:
+		return 0, fmt.Errorf("unknown job kind: %s", kind)
+	}
+
+	var attempts int
+	err := db.QueryRow(query, trackID).Scan(&attempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrTrackNotFound
+	}
+	return attempts, err
+}
+
 // SavePlaylistTracks saves tracks and their playlist association
 func (db *DB) SavePlaylistTracks(playlistID string, tracks []models.TrackMetadata) error {
 	tx, err := db.Begin()
@@ -205,14 +294,79 @@ func (db *DB) SavePlaylistTracks(playlistID string, tracks []models.TrackMetadat
 	return tx.Commit()
 }
 
+// SaveTrack saves a single track with no playlist association. It reports
+// false, leaving the stored track untouched, if the track already exists.
+func (db *DB) SaveTrack(track models.TrackMetadata) (bool, error) {
+	result, err := db.Exec(`
+		INSERT INTO tracks (track_id, name, artists, download_status)
+		VALUES (?, ?, ?, 'pending')
+		ON CONFLICT(track_id) DO NOTHING
+	`, track.ID, track.Name, strings.Join(track.Artists, ", "))
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+// SetDownloadDuration records how long the last download attempt took
+func (db *DB) SetDownloadDuration(trackID string, d time.Duration) error {
+	_, err := db.Exec("UPDATE tracks SET download_duration_ms = ? WHERE track_id = ?", d.Milliseconds(), trackID)
+	return err
+}
+
+// SetDemucsDuration records how long the last Demucs run took
+func (db *DB) SetDemucsDuration(trackID string, d time.Duration) error {
+	_, err := db.Exec("UPDATE tracks SET demucs_duration_ms = ? WHERE track_id = ?", d.Milliseconds(), trackID)
+	return err
+}
+
 // GetAllTracks returns the current state of all tracks
 func (db *DB) GetAllTracks() ([]models.TrackState, error) {
-	rows, err := db.Query(`
+	return db.QueryTracks(models.TrackFilter{})
+}
+
+// likeEscaper escapes LIKE wildcards so a search matches them literally
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// QueryTracks returns the current state of the tracks matching filter
+func (db *DB) QueryTracks(filter models.TrackFilter) ([]models.TrackState, error) {
+	var conditions []string
+	var args []any
+	if filter.DownloadStatus != "" {
+		conditions = append(conditions, "download_status = ?")
+		args = append(args, filter.DownloadStatus)
+	}
+	if filter.DemucsStatus != "" {
+		conditions = append(conditions, "demucs_status = ?")
+		args = append(args, filter.DemucsStatus)
+	}
+	if filter.PlaylistID != "" {
+		conditions = append(conditions, "track_id IN (SELECT track_id FROM playlist_tracks WHERE playlist_id = ?)")
+		args = append(args, filter.PlaylistID)
+	}
+	if filter.Query != "" {
+		pattern := "%" + likeEscaper.Replace(filter.Query) + "%"
+		conditions = append(conditions, `(name LIKE ? ESCAPE '\' OR artists LIKE ? ESCAPE '\')`)
+		args = append(args, pattern, pattern)
+	}
+
+	query := `
 		SELECT track_id, name, artists,
 		       download_status, error_message,
-		       demucs_status, demucs_error_message
-		FROM tracks
-	`)
+		       demucs_status, demucs_error_message,
+		       download_duration_ms, demucs_duration_ms, source_url,
+		       youtube_video_id, youtube_title, updated_at,
+		       download_attempts, demucs_attempts
+		FROM tracks`
+	if len(conditions) > 0 {
+		query += "\n\t\tWHERE " + strings.Join(conditions, " AND ")
+	}
+
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -221,10 +375,15 @@ func (db *DB) GetAllTracks() ([]models.TrackState, error) {
 	var tracks []models.TrackState
 	for rows.Next() {
 		var trackID, name, artists, downloadStatus, demucsStatus string
-		var downloadError, demucsError sql.NullString
-		rows.Scan(&trackID, &name, &artists, &downloadStatus, &downloadError, &demucsStatus, &demucsError)
+		var downloadError, demucsError, sourceURL, youTubeVideoID, youTubeTitle sql.NullString
+		var downloadDuration, demucsDuration sql.NullInt64
+		var updatedAt sql.NullTime
+		var downloadAttempts, demucsAttempts int
+		rows.Scan(&trackID, &name, &artists, &downloadStatus, &downloadError, &demucsStatus, &demucsError,
+			&downloadDuration, &demucsDuration, &sourceURL, &youTubeVideoID, &youTubeTitle, &updatedAt,
+			&downloadAttempts, &demucsAttempts)
 
-		// Map status to progress (simplified for snapshot)
+		// Map status to progress; the API fills in live progress for running jobs
 		var downloadProgress float64
 		if downloadStatus == "completed" {
 			downloadProgress = 100
@@ -243,6 +402,12 @@ func (db *DB) GetAllTracks() ([]models.TrackState, error) {
 			DownloadProgress: downloadProgress,
 			DemucsStatus:     demucsStatus,
 			DemucsProgress:   demucsProgress,
+			SourceURL:        sourceURL.String,
+			YouTubeVideoID:   youTubeVideoID.String,
+			YouTubeTitle:     youTubeTitle.String,
+			UpdatedAt:        updatedAt.Time,
+			DownloadAttempts: downloadAttempts,
+			DemucsAttempts:   demucsAttempts,
 		}
 		if downloadError.Valid {
 			track.DownloadError = downloadError.String
@@ -250,6 +415,12 @@ func (db *DB) GetAllTracks() ([]models.TrackState, error) {
 		if demucsError.Valid {
 			track.DemucsError = demucsError.String
 		}
+		if downloadDuration.Valid {
+			track.DownloadDurationMs = &downloadDuration.Int64
+		}
+		if demucsDuration.Valid {
+			track.DemucsDurationMs = &demucsDuration.Int64
+		}
 		tracks = append(tracks, track)
 	}
 	return tracks, nil
@@ -278,29 +449,135 @@ func (db *DB) VerifyDownloadStatus(checkFileExists func(string) bool) error {
 	return nil
 }
 
+// GetMaxUpdatedAt returns the latest updated_at across all tracks and the number
+// of tracks. Together they change whenever any track does: status changes set
+// updated_at (to the millisecond, so changes within a second are told apart),
+// and adding or deleting a track changes the count.
+func (db *DB) GetMaxUpdatedAt() (maxUpdatedAt string, count int, err error) {
+	var latest sql.NullString
+	err = db.QueryRow("SELECT MAX(updated_at), COUNT(*) FROM tracks").Scan(&latest, &count)
+	return latest.String, count, err
+}
+
+// GetInProgressTracks returns all tracks with a download or Demucs job marked in_progress
+func (db *DB) GetInProgressTracks() ([]models.TrackState, error) {
+	rows, err := db.Query(`
+		SELECT track_id, name, artists, download_status, demucs_status
+		FROM tracks
+		WHERE download_status = 'in_progress' OR demucs_status = 'in_progress'
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tracks []models.TrackState
+	for rows.Next() {
+		var track models.TrackState
+		if err := rows.Scan(&track.TrackID, &track.Name, &track.Artists, &track.DownloadStatus, &track.DemucsStatus); err != nil {
+			continue
+		}
+		tracks = append(tracks, track)
+	}
+	return tracks, nil
+}
+
+// GetFailedTracks returns all tracks with a failed download or Demucs job, with
+// their attempt counts, limited to one playlist's tracks if playlistID is set
+func (db *DB) GetFailedTracks(playlistID string) ([]models.TrackState, error) {
+	query := `
+		SELECT track_id, name, artists, download_status, demucs_status, download_attempts, demucs_attempts
+		FROM tracks
+		WHERE (download_status = 'failed' OR demucs_status = 'failed')`
+	var args []any
+	if playlistID != "" {
+		query += " AND track_id IN (SELECT track_id FROM playlist_tracks WHERE playlist_id = ?)"
+		args = append(args, playlistID)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tracks []models.TrackState
+	for rows.Next() {
+		var track models.TrackState
+		if err := rows.Scan(&track.TrackID, &track.Name, &track.Artists, &track.DownloadStatus, &track.DemucsStatus,
+			&track.DownloadAttempts, &track.DemucsAttempts); err != nil {
+			continue
+		}
+		tracks = append(tracks, track)
+	}
+	return tracks, rows.Err()
+}
+
+// VerifyDemucsStatus resolves Demucs jobs left in_progress by a crash: tracks with
+// finished output are marked completed, the rest go back to pending for re-queue
+func (db *DB) VerifyDemucsStatus(checkOutputExists func(string) bool) error {
+	rows, err := db.Query("SELECT track_id FROM tracks WHERE demucs_status = 'in_progress'")
+	if err != nil {
+		return err
+	}
+
+	var trackIDs []string
+	for rows.Next() {
+		var trackID string
+		if err := rows.Scan(&trackID); err != nil {
+			continue
+		}
+		trackIDs = append(trackIDs, trackID)
+	}
+	rows.Close()
+
+	for _, trackID := range trackIDs {
+		status := "pending"
+		if checkOutputExists(trackID) {
+			status = "completed"
+		}
+		if err := db.UpdateDemucsStatus(trackID, status, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // GetTrack returns a single track by ID
 func (db *DB) GetTrack(trackID string) (*models.TrackState, error) {
 	var track models.TrackState
-	var downloadError, demucsError sql.NullString
+	var downloadError, demucsError, sourceURL, youTubeVideoID, youTubeTitle sql.NullString
+	var downloadDuration, demucsDuration sql.NullInt64
+	var updatedAt sql.NullTime
 	var downloadStatus, demucsStatus string
 
 	err := db.QueryRow(`
 		SELECT track_id, name, artists,
 		       download_status, error_message,
-		       demucs_status, demucs_error_message
+		       demucs_status, demucs_error_message,
+		       download_duration_ms, demucs_duration_ms, source_url,
+		       youtube_video_id, youtube_title, updated_at,
+		       download_attempts, demucs_attempts
 		FROM tracks
 		WHERE track_id = ?
 	`, trackID).Scan(
 		&track.TrackID, &track.Name, &track.Artists,
 		&downloadStatus, &downloadError,
 		&demucsStatus, &demucsError,
+		&downloadDuration, &demucsDuration, &sourceURL,
+		&youTubeVideoID, &youTubeTitle, &updatedAt,
+		&track.DownloadAttempts, &track.DemucsAttempts,
 	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrTrackNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	track.DownloadStatus = downloadStatus
 	track.DemucsStatus = demucsStatus
+	track.UpdatedAt = updatedAt.Time
 
 	if downloadStatus == "completed" {
 		track.DownloadProgress = 100
@@ -315,10 +592,317 @@ func (db *DB) GetTrack(trackID string) (*models.TrackState, error) {
 	if demucsError.Valid {
 		track.DemucsError = demucsError.String
 	}
+	if downloadDuration.Valid {
+		track.DownloadDurationMs = &downloadDuration.Int64
+	}
+	if demucsDuration.Valid {
+		track.DemucsDurationMs = &demucsDuration.Int64
+	}
+	track.SourceURL = sourceURL.String
+	track.YouTubeVideoID = youTubeVideoID.String
+	track.YouTubeTitle = youTubeTitle.String
 
 	return &track, nil
 }
 
+// ResetForRetry sets a failed job back to pending and clears its error.
+// kind is "download" or "demucs". Returns ErrJobInProgress if that job is running.
+func (db *DB) ResetForRetry(trackID, kind string) error {
+	var query string
+	switch kind {
+	case "download":
+		query = `
+			UPDATE tracks
+			SET download_status = 'pending', error_message = NULL, updated_at = strftime('%Y-%m-%d %H:%M:%f', 'now')
+			WHERE track_id = ? AND download_status != 'in_progress'
+		`
+	case "demucs":
+		query = `
+			UPDATE tracks
+			SET demucs_status = 'pending', demucs_error_message = NULL, updated_at = strftime('%Y-%m-%d %H:%M:%f', 'now')
+			WHERE track_id = ? AND demucs_status != 'in_progress'
+		`
+	default:
+		return fmt.Errorf("unknown job kind: %s", kind)
+	}
+
+	result, err := db.Exec(query, trackID)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		if _, err := db.GetTrack(trackID); err != nil {
+			return err
+		}
+		return ErrJobInProgress
+	}
+	return nil
+}
+
+// ResetFailedForRetry sets a failed download or Demucs stage back to pending and
+// reports whether it did. Only one caller can flip a given failure, so bulk
+// retries racing each other enqueue each track once.
+func (db *DB) ResetFailedForRetry(trackID, kind string) (bool, error) {
+	var query string
+	switch kind {
+	case "download":
+		query = `
+			UPDATE tracks
+			SET download_status = 'pending', error_message = NULL, updated_at = strftime('%Y-%m-%d %H:%M:%f', 'now')
+			WHERE track_id = ? AND download_status = 'failed'
+		`
+	case "demucs":
+		query = `
+			UPDATE tracks
+			SET demucs_status = 'pending', demucs_error_message = NULL, updated_at = strftime('%Y-%m-%d %H:%M:%f', 'now')
+			WHERE track_id = ? AND demucs_status = 'failed'
+		`
+	default:
+		return false, fmt.Errorf("unknown job kind: %s", kind)
+	}
+
+	result, err := db.Exec(query, trackID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// SetSourceURL pins the video a track is downloaded from (empty restores the YouTube
+// search) and sets both stages back to pending, with fresh attempt counts, so the
+// track is fetched again.
+// Returns ErrJobInProgress if either stage is running.
+func (db *DB) SetSourceURL(trackID, sourceURL string) error {
+	result, err := db.Exec(`
+		UPDATE tracks
+		SET source_url = NULLIF(?, ''),
+		    download_status = 'pending', error_message = NULL, download_duration_ms = NULL,
+		    demucs_status = 'pending', demucs_error_message = NULL, demucs_duration_ms = NULL,
+		    download_attempts = 0, demucs_attempts = 0,
+		    updated_at = strftime('%Y-%m-%d %H:%M:%f', 'now')
+		WHERE track_id = ? AND download_status != 'in_progress' AND demucs_status != 'in_progress'
+	`, sourceURL, trackID)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		if _, err := db.GetTrack(trackID); err != nil {
+			return err
+		}
+		return ErrJobInProgress
+	}
+	return nil
+}
+
+// SetYouTubeMatch records the YouTube video a track was downloaded from. The
+// title is empty for a pinned source URL, which is downloaded without a search.
+func (db *DB) SetYouTubeMatch(trackID, videoID, title string) error {
+	_, err := db.Exec(`
+		UPDATE tracks SET youtube_video_id = NULLIF(?, ''), youtube_title = NULLIF(?, '')
+		WHERE track_id = ?
+	`, videoID, title, trackID)
+	return err
+}
+
+// GetSourceURL returns the video URL pinned for a track, or "" if it should be searched for
+func (db *DB) GetSourceURL(trackID string) (string, error) {
+	var sourceURL sql.NullString
+	err := db.QueryRow(`SELECT source_url FROM tracks WHERE track_id = ?`, trackID).Scan(&sourceURL)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrTrackNotFound
+	}
+	return sourceURL.String, err
+}
+
+// ResetPlaylistForRedownload sets both stages of every track in a playlist back to
+// pending, clearing errors, timings and attempt counts. Tracks that also belong to
+// another playlist are left alone, since their files serve that playlist too. It
+// returns ErrJobInProgress and changes nothing if any of the tracks it would reset
+// is mid-download or mid-separation.
+func (db *DB) ResetPlaylistForRedownload(playlistID string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	var running int
+	err = tx.QueryRow(`
+		SELECT COUNT(*) FROM tracks
+		WHERE track_id IN (`+unsharedPlaylistTracks+`)
+		  AND (download_status = 'in_progress' OR demucs_status = 'in_progress')
+	`, playlistID, playlistID).Scan(&running)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if running > 0 {
+		tx.Rollback()
+		return ErrJobInProgress
+	}
+
+	_, err = tx.Exec(`
+		UPDATE tracks
+		SET download_status = 'pending', error_message = NULL,
+		    demucs_status = 'pending', demucs_error_message = NULL,
+		    download_duration_ms = NULL, demucs_duration_ms = NULL,
+		    download_attempts = 0, demucs_attempts = 0,
+		    updated_at = strftime('%Y-%m-%d %H:%M:%f', 'now')
+		WHERE track_id IN (`+unsharedPlaylistTracks+`)
+	`, playlistID, playlistID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// unsharedPlaylistTracks selects the tracks of one playlist that no other
+// playlist holds. It takes the playlist ID twice.
+const unsharedPlaylistTracks = `
+	SELECT track_id FROM playlist_tracks WHERE playlist_id = ?
+	EXCEPT
+	SELECT track_id FROM playlist_tracks WHERE playlist_id != ?`
+
+// GetSharedTrackIDs returns the tracks of a playlist that also belong to another playlist
+func (db *DB) GetSharedTrackIDs(playlistID string) (map[string]bool, error) {
+	rows, err := db.Query(`
+		SELECT track_id FROM playlist_tracks WHERE playlist_id = ?
+		INTERSECT
+		SELECT track_id FROM playlist_tracks WHERE playlist_id != ?
+	`, playlistID, playlistID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shared := make(map[string]bool)
+	for rows.Next() {
+		var trackID string
+		if err := rows.Scan(&trackID); err != nil {
+			return nil, err
+		}
+		shared[trackID] = true
+	}
+	return shared, rows.Err()
+}
+
+// DeleteTrack removes a track and its playlist associations in one transaction
+func (db *DB) DeleteTrack(trackID string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM playlist_tracks WHERE track_id = ?", trackID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM tracks WHERE track_id = ?", trackID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CountByStatus returns track counts keyed by stage ("download", "demucs") and then status
+func (db *DB) CountByStatus() (map[string]map[string]int, error) {
+	rows, err := db.Query(`
+		SELECT 'download', download_status, COUNT(*) FROM tracks GROUP BY download_status
+		UNION ALL
+		SELECT 'demucs', demucs_status, COUNT(*) FROM tracks GROUP BY demucs_status
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[string]map[string]int{
+		"download": {},
+		"demucs":   {},
+	}
+	for rows.Next() {
+		var stage, status string
+		var count int
+		if err := rows.Scan(&stage, &status, &count); err != nil {
+			continue
+		}
+		counts[stage][status] = count
+	}
+	return counts, nil
+}
+
+// GetPlaylistSummaries returns per-playlist track counts grouped by download and
+// Demucs status. autoDemucs is the server default for tracks queued without their
+// own setting.
+func (db *DB) GetPlaylistSummaries(autoDemucs bool) ([]models.PlaylistSummary, error) {
+	return db.queryPlaylistSummaries(autoDemucs, "")
+}
+
+// GetPlaylistSummariesForTracks returns the summaries of every playlist that
+// contains at least one of trackIDs
+func (db *DB) GetPlaylistSummariesForTracks(trackIDs []string, autoDemucs bool) ([]models.PlaylistSummary, error) {
+	if len(trackIDs) == 0 {
+		return []models.PlaylistSummary{}, nil
+	}
+	placeholders := strings.Repeat("?,", len(trackIDs))
+	placeholders = placeholders[:len(placeholders)-1]
+	args := make([]any, len(trackIDs))
+	for i, id := range trackIDs {
+		args[i] = id
+	}
+	return db.queryPlaylistSummaries(autoDemucs, fmt.Sprintf(
+		"WHERE pt.playlist_id IN (SELECT playlist_id FROM playlist_tracks WHERE track_id IN (%s))", placeholders), args...)
+}
+
+// queryPlaylistSummaries aggregates the playlists selected by where, a WHERE
+// clause over playlist_tracks pt (empty for all playlists)
+func (db *DB) queryPlaylistSummaries(autoDemucs bool, where string, args ...any) ([]models.PlaylistSummary, error) {
+	rows, err := db.Query(`
+		SELECT pt.playlist_id, COUNT(*),
+		       SUM(CASE WHEN t.download_status = 'completed' THEN 1 ELSE 0 END),
+		       SUM(CASE WHEN t.download_status = 'in_progress' THEN 1 ELSE 0 END),
+		       SUM(CASE WHEN t.download_status = 'pending' THEN 1 ELSE 0 END),
+		       SUM(CASE WHEN t.download_status = 'failed' THEN 1 ELSE 0 END),
+		       SUM(CASE WHEN t.demucs_status = 'completed' THEN 1 ELSE 0 END),
+		       SUM(CASE WHEN t.demucs_status = 'in_progress' THEN 1 ELSE 0 END),
+		       SUM(CASE WHEN t.demucs_status = 'pending' THEN 1 ELSE 0 END),
+		       SUM(CASE WHEN t.demucs_status = 'failed' THEN 1 ELSE 0 END),
+		       SUM(CASE WHEN t.download_status = 'completed' AND t.demucs_status = 'pending'
+		                 AND COALESCE(t.auto_demucs, ?) = 0 THEN 1 ELSE 0 END)
+		FROM playlist_tracks pt
+		JOIN tracks t ON t.track_id = pt.track_id
+		`+where+`
+		GROUP BY pt.playlist_id
+		ORDER BY pt.playlist_id
+	`, append([]any{autoDemucs}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	summaries := []models.PlaylistSummary{}
+	for rows.Next() {
+		var summary models.PlaylistSummary
+		if err := rows.Scan(
+			&summary.PlaylistID, &summary.TrackCount,
+			&summary.DownloadCompleted, &summary.DownloadInProgress, &summary.DownloadPending, &summary.DownloadFailed,
+			&summary.DemucsCompleted, &summary.DemucsInProgress, &summary.DemucsPending, &summary.DemucsFailed,
+			&summary.DemucsSkipped,
+		); err != nil {
+			continue
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, nil
+}
+
 // GetPlaylistTrackIDs returns all track IDs for a given playlist
 func (db *DB) GetPlaylistTrackIDs(playlistID string) (map[string]bool, error) {
 	rows, err := db.Query(`
@@ -340,3 +924,148 @@ func (db *DB) GetPlaylistTrackIDs(playlistID string) (map[string]bool, error) {
 	}
 	return trackIDs, nil
 }
+
+// GetPlaylistMemberships returns the track IDs of every playlist, keyed by playlist ID
+func (db *DB) GetPlaylistMemberships() (map[string][]string, error) {
+	rows, err := db.Query(`SELECT playlist_id, track_id FROM playlist_tracks ORDER BY playlist_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	memberships := make(map[string][]string)
+	for rows.Next() {
+		var playlistID, trackID string
+		if err := rows.Scan(&playlistID, &trackID); err != nil {
+			return nil, err
+		}
+		memberships[playlistID] = append(memberships[playlistID], trackID)
+	}
+	return memberships, rows.Err()
+}
+
+// GetExistingStatuses returns the download status of each of trackIDs that is
+// already stored, in one query. Tracks not yet in the database are left out.
+func (db *DB) GetExistingStatuses(trackIDs []string) (map[string]string, error) {
+	statuses := make(map[string]string, len(trackIDs))
+	if len(trackIDs) == 0 {
+		return statuses, nil
+	}
+
+	placeholders := strings.Repeat("?,", len(trackIDs))
+	placeholders = placeholders[:len(placeholders)-1]
+	args := make([]any, len(trackIDs))
+	for i, id := range trackIDs {
+		args[i] = id
+	}
+
+	rows, err := db.Query(fmt.Sprintf(`
+		SELECT track_id, download_status FROM tracks
+		WHERE track_id IN (%s)
+	`, placeholders), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var trackID, status string
+		if err := rows.Scan(&trackID, &status); err != nil {
+			return nil, err
+		}
+		statuses[trackID] = status
+	}
+	return statuses, rows.Err()
+}
+
+// SetJobOptions records the options trackIDs were queued with, replacing any
+// recorded before
+func (db *DB) SetJobOptions(trackIDs []string, opts models.JobOptions) error {
+	if len(trackIDs) == 0 {
+		return nil
+	}
+
+	var autoDemucs sql.NullBool
+	if opts.AutoDemucs != nil {
+		autoDemucs = sql.NullBool{Bool: *opts.AutoDemucs, Valid: true}
+	}
+	placeholders := strings.Repeat("?,", len(trackIDs))
+	placeholders = placeholders[:len(placeholders)-1]
+	args := []any{opts.PlaylistID, opts.Separation.Model, opts.Separation.TwoStems,
+		opts.Separation.Shifts, opts.Separation.Overlap, autoDemucs}
+	for _, id := range trackIDs {
+		args = append(args, id)
+	}
+
+	_, err := db.Exec(fmt.Sprintf(`
+		UPDATE tracks
+		SET queued_playlist_id = ?, demucs_model = ?, demucs_two_stems = ?,
+		    demucs_shifts = ?, demucs_overlap = ?, auto_demucs = ?
+		WHERE track_id IN (%s)
+	`, placeholders), args...)
+	return err
+}
+
+// GetJobOptions returns the options each of trackIDs was queued with, in one
+// query. Tracks not in the database are left out.
+func (db *DB) GetJobOptions(trackIDs []string) (map[string]models.JobOptions, error) {
+	options := make(map[string]models.JobOptions, len(trackIDs))
+	if len(trackIDs) == 0 {
+		return options, nil
+	}
+
+	placeholders := strings.Repeat("?,", len(trackIDs))
+	placeholders = placeholders[:len(placeholders)-1]
+	args := make([]any, len(trackIDs))
+	for i, id := range trackIDs {
+		args[i] = id
+	}
+
+	rows, err := db.Query(fmt.Sprintf(`
+		SELECT track_id, queued_playlist_id, demucs_model, demucs_two_stems,
+		       demucs_shifts, demucs_overlap, auto_demucs
+		FROM tracks
+		WHERE track_id IN (%s)
+	`, placeholders), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var trackID string
+		var opts models.JobOptions
+		var autoDemucs sql.NullBool
+		if err := rows.Scan(&trackID, &opts.PlaylistID, &opts.Separation.Model, &opts.Separation.TwoStems,
+			&opts.Separation.Shifts, &opts.Separation.Overlap, &autoDemucs); err != nil {
+			return nil, err
+		}
+		if autoDemucs.Valid {
+			opts.AutoDemucs = &autoDemucs.Bool
+		}
+		options[trackID] = opts
+	}
+	return options, rows.Err()
+}
+
+// spotifyProvider keys the Spotify user's row in oauth_tokens
+const spotifyProvider = "spotify"
+
+// LoadRefreshToken returns the stored Spotify refresh token, or "" if no user has logged in
+func (db *DB) LoadRefreshToken() (string, error) {
+	var refreshToken string
+	err := db.QueryRow(`SELECT refresh_token FROM oauth_tokens WHERE provider = ?`, spotifyProvider).Scan(&refreshToken)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return refreshToken, err
+}
+
+// SaveRefreshToken stores the Spotify refresh token, replacing any previous one
+func (db *DB) SaveRefreshToken(refreshToken string) error {
+	_, err := db.Exec(`
+		INSERT INTO oauth_tokens (provider, refresh_token) VALUES (?, ?)
+		ON CONFLICT(provider) DO UPDATE SET refresh_token = excluded.refresh_token, updated_at = CURRENT_TIMESTAMP
+	`, spotifyProvider, refreshToken)
+	return err
+}
@@ -0,0 +1,44 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+
+	"separate/server/models"
+)
+
+func TestResetPlaylistForRedownloadSkipsSharedTracks(t *testing.T) {
+	db, err := InitDB(filepath.Join(t.TempDir(), "queue.db"))
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer db.Close()
+
+	own := models.TrackMetadata{ID: "own1", Name: "Own", Artists: []string{"A"}}
+	shared := models.TrackMetadata{ID: "shared1", Name: "Shared", Artists: []string{"A"}}
+	db.SavePlaylistTracks("p1", []models.TrackMetadata{own, shared})
+	db.SavePlaylistTracks("p2", []models.TrackMetadata{shared})
+	for _, id := range []string{"own1", "shared1"} {
+		db.UpdateDownloadStatus(id, "completed", "")
+	}
+	// A shared track busy for the other playlist doesn't block the redownload
+	db.UpdateDemucsStatus("shared1", "in_progress", "")
+
+	sharedIDs, err := db.GetSharedTrackIDs("p1")
+	if err != nil || len(sharedIDs) != 1 || !sharedIDs["shared1"] {
+		t.Fatalf("Expected only shared1 to be shared, got %v, %v", sharedIDs, err)
+	}
+	if err := db.ResetPlaylistForRedownload("p1"); err != nil {
+		t.Fatalf("ResetPlaylistForRedownload failed: %v", err)
+	}
+
+	for id, want := range map[string]string{"own1": "pending", "shared1": "completed"} {
+		track, err := db.GetTrack(id)
+		if err != nil {
+			t.Fatalf("GetTrack failed: %v", err)
+		}
+		if track.DownloadStatus != want {
+			t.Errorf("Expected %s to be %s, got %s", id, want, track.DownloadStatus)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migration is one versioned change to the schema. Versions are applied in
+// order, each in its own transaction, and recorded in schema_migrations so they
+// run once per database.
+type migration struct {
+	version     int
+	description string
+	apply       func(tx *sql.Tx) error
+}
+
+// migrations lists every schema change, oldest first. Append new ones with the
+// next version; never edit or reorder one that has shipped. Databases created
+// before schema_migrations existed already have some of these changes, so each
+// must be safe to apply on top of them (CREATE ... IF NOT EXISTS, addColumn).
+var migrations = []migration{
+	{1, "create tracks, playlist_tracks and oauth_tokens", execAll(`
+		CREATE TABLE IF NOT EXISTS tracks (
+			track_id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			artists TEXT NOT NULL,
+			download_status TEXT NOT NULL,
+			error_message TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_download_status ON tracks(download_status)`,
+		`CREATE TABLE IF NOT EXISTS playlist_tracks (
+			playlist_id TEXT NOT NULL,
+			track_id TEXT NOT NULL,
+			PRIMARY KEY (playlist_id, track_id),
+			FOREIGN KEY (track_id) REFERENCES tracks(track_id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_playlist_id ON playlist_tracks(playlist_id)`,
+		`CREATE TABLE IF NOT EXISTS oauth_tokens (
+			provider TEXT PRIMARY KEY,
+			refresh_token TEXT NOT NULL,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+	)},
+	{2, "track Demucs status per track", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "tracks", "demucs_status", "TEXT DEFAULT 'pending'"); err != nil {
+			return err
+		}
+		if err := addColumn(tx, "tracks", "demucs_error_message", "TEXT"); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`CREATE INDEX IF NOT EXISTS idx_demucs_status ON tracks(demucs_status)`)
+		return err
+	}},
+	{3, "record job durations", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "tracks", "download_duration_ms", "INTEGER"); err != nil {
+			return err
+		}
+		return addColumn(tx, "tracks", "demucs_duration_ms", "INTEGER")
+	}},
+	// Serve the FIFO resume queries without a sort
+	{4, "index job status by creation time", execAll(
+		`CREATE INDEX IF NOT EXISTS idx_download_status_created ON tracks(download_status, created_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_demucs_status_created ON tracks(demucs_status, created_at)`,
+	)},
+	{5, "pin a source URL per track", func(tx *sql.Tx) error {
+		return addColumn(tx, "tracks", "source_url", "TEXT")
+	}},
+	{6, "record the matched YouTube video", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "tracks", "youtube_video_id", "TEXT"); err != nil {
+			return err
+		}
+		return addColumn(tx, "tracks", "youtube_title", "TEXT")
+	}},
+	{7, "count job attempts", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "tracks", "download_attempts", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+		return addColumn(tx, "tracks", "demucs_attempts", "INTEGER NOT NULL DEFAULT 0")
+	}},
+	{8, "remember the options each track was queued with", func(tx *sql.Tx) error {
+		for _, column := range []struct{ name, definition string }{
+			{"queued_playlist_id", "TEXT NOT NULL DEFAULT ''"},
+			{"demucs_model", "TEXT NOT NULL DEFAULT ''"},
+			{"demucs_two_stems", "TEXT NOT NULL DEFAULT ''"},
+			{"demucs_shifts", "INTEGER NOT NULL DEFAULT 0"},
+			{"demucs_overlap", "REAL NOT NULL DEFAULT 0"},
+			{"auto_demucs", "INTEGER"}, // NULL follows AUTO_DEMUCS
+		} {
+			if err := addColumn(tx, "tracks", column.name, column.definition); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+}
+
+// migrate applies every migration the database hasn't recorded yet
+func migrate(db *sql.DB) error {
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	for _, m := range migrations {
+		if err := applyMigration(db, m); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.description, err)
+		}
+	}
+	return nil
+}
+
+// applyMigration runs m unless it is already recorded. The check runs in the
+// same transaction as the change, so two servers starting against the same
+// database apply it only once.
+func applyMigration(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var applied bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = ?)", m.version).Scan(&applied); err != nil {
+		return err
+	}
+	if applied {
+		return nil
+	}
+
+	if err := m.apply(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO schema_migrations (version) VALUES (?)", m.version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// execAll returns a migration step running each statement in turn
+func execAll(statements ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, statement := range statements {
+			if _, err := tx.Exec(statement); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// addColumn adds a column unless the table already has it, which SQLite's
+// ALTER TABLE ... ADD COLUMN cannot check for itself
+func addColumn(tx *sql.Tx, table, column, definition string) error {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			cid          int
+			name, kind   string
+			notNull, pk  int
+			defaultValue sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &kind, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
@@ -0,0 +1,69 @@
+package db
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrateUpgradesLegacyDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.db")
+
+	// A database from before schema_migrations, which had run some of the old
+	// unversioned ALTERs but not others
+	legacy, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = legacy.Exec(`
+		CREATE TABLE tracks (
+			track_id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			artists TEXT NOT NULL,
+			download_status TEXT NOT NULL,
+			error_message TEXT,
+			demucs_status TEXT DEFAULT 'pending',
+			demucs_error_message TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+		ALTER TABLE tracks ADD COLUMN download_duration_ms INTEGER;
+		INSERT INTO tracks (track_id, name, artists, download_status) VALUES ('t1', 'A', 'B', 'completed');
+	`)
+	legacy.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Opening twice shows migrations are applied once and then skipped
+	for i := 0; i < 2; i++ {
+		db, err := InitDB(path)
+		if err != nil {
+			t.Fatalf("InitDB failed: %v", err)
+		}
+
+		var applied int
+		if err := db.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&applied); err != nil {
+			t.Fatal(err)
+		}
+		if applied != len(migrations) {
+			t.Errorf("Expected %d migrations recorded, got %d", len(migrations), applied)
+		}
+		if err := db.SetYouTubeMatch("t1", "dQw4w9WgXcQ", "Title"); err != nil {
+			t.Errorf("Expected the youtube columns to be added, got %v", err)
+		}
+		track, err := db.GetTrack("t1")
+		if err != nil || track.DemucsStatus != "pending" {
+			t.Errorf("Expected the existing track to survive, got %+v, %v", track, err)
+		}
+		db.Close()
+	}
+}
+
+func TestMigrationVersionsAreOrdered(t *testing.T) {
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("Expected migration %q to be version %d, got %d", m.description, i+1, m.version)
+		}
+	}
+}
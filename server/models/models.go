@@ -13,59 +13,277 @@ type TrackMetadata struct {
 	PreviewURL  string   `json:"preview_url"`
 	ReleaseDate string   `json:"release_date"`
 	ISRC        string   `json:"isrc"`
+	AlbumArtURL string   `json:"album_art_url"` // Largest album cover, empty if Spotify has none
 }
 
 // PlaylistMetadata represents metadata for an entire playlist
 type PlaylistMetadata struct {
-	Name        string          `json:"name"`
-	Description string          `json:"description"`
-	TotalTracks int             `json:"total_tracks"`
-	Tracks      []TrackMetadata `json:"tracks"`
+	Name          string          `json:"name"`
+	Description   string          `json:"description"`
+	TotalTracks   int             `json:"total_tracks"`
+	Tracks        []TrackMetadata `json:"tracks"`
+	SkippedTracks int             `json:"skipped_tracks"` // Local or unavailable tracks and podcast episodes
 }
 
 // SetupPlaylistRequest represents the request to setup a playlist
 type SetupPlaylistRequest struct {
 	PlaylistID string `json:"playlist_id"`
+	AutoDemucs *bool  `json:"auto_demucs,omitempty"` // Overrides AUTO_DEMUCS for these tracks
+	SeparationOptions
+}
+
+// SetupAlbumRequest represents the request to setup an album
+type SetupAlbumRequest struct {
+	AlbumID    string `json:"album_id"`
+	AutoDemucs *bool  `json:"auto_demucs,omitempty"` // Overrides AUTO_DEMUCS for these tracks
+	SeparationOptions
+}
+
+// AddTrackRequest represents the request to download a single track
+type AddTrackRequest struct {
+	TrackID    string `json:"track_id"`
+	AutoDemucs *bool  `json:"auto_demucs,omitempty"` // Overrides AUTO_DEMUCS for this track
+	SeparationOptions
+}
+
+// SearchRequest represents a Spotify track search; the chosen result is added with POST /tracks
+type SearchRequest struct {
+	Query string `json:"query"`
+	Limit int    `json:"limit"` // Defaults to 5 when omitted
+}
+
+// SetupLikedRequest represents the request to download the logged-in user's Liked Songs
+type SetupLikedRequest struct {
+	AutoDemucs *bool `json:"auto_demucs,omitempty"` // Overrides AUTO_DEMUCS for these tracks
+	SeparationOptions
+}
+
+// AuthCallbackResponse confirms a completed Spotify login
+type AuthCallbackResponse struct {
+	Authorized bool   `json:"authorized"`
+	Scope      string `json:"scope"`
 }
 
 // SetupPlaylistResponse represents the response after setting up directories
 type SetupPlaylistResponse struct {
-	PlaylistName string   `json:"playlist_name"`
-	TotalTracks  int      `json:"total_tracks"`
-	TrackIDs     []string `json:"track_ids"`
+	PlaylistName      string   `json:"playlist_name"`
+	TotalTracks       int      `json:"total_tracks"`
+	TrackIDs          []string `json:"track_ids"`
+	SkippedTracks     int      `json:"skipped_tracks"`
+	AlreadyDownloaded int      `json:"already_downloaded"` // Downloaded earlier for another collection, so not queued again
+}
+
+// PreviewPlaylistRequest asks for the YouTube matches of a playlist without downloading
+type PreviewPlaylistRequest struct {
+	PlaylistID string `json:"playlist_id"`
+}
+
+// MatchPreview is the YouTube video SearchYouTube picked for one track
+type MatchPreview struct {
+	TrackID       string   `json:"track_id"`
+	SpotifyName   string   `json:"spotify_name"`
+	MatchedTitle  string   `json:"matched_title,omitempty"`
+	MatchedURL    string   `json:"matched_url,omitempty"`
+	DurationDelta *float64 `json:"duration_delta"` // Video minus Spotify duration in seconds; null if either is unknown
+	Error         string   `json:"error,omitempty"`
+}
+
+// TrackSourceRequest pins the YouTube video a track is downloaded from
+type TrackSourceRequest struct {
+	YouTubeURL string `json:"youtube_url"`
+}
+
+// UnstickResponse reports how many stuck tracks were reset and re-queued
+type UnstickResponse struct {
+	ResetDownloads int `json:"reset_downloads"`
+	ResetDemucs    int `json:"reset_demucs"`
+}
+
+// RetryFailedResponse reports how many failed tracks were reset and re-queued
+type RetryFailedResponse struct {
+	PlaylistID        string `json:"playlist_id,omitempty"` // Set when the retry was limited to one playlist
+	Requeued          int    `json:"requeued"`
+	RequeuedDownloads int    `json:"requeued_downloads"`
+	RequeuedDemucs    int    `json:"requeued_demucs"`
+	Exhausted         int    `json:"exhausted"` // Failed tracks left alone because they used up their attempts
+}
+
+// RedownloadResponse summarizes a playlist re-download
+type RedownloadResponse struct {
+	PlaylistID   string `json:"playlist_id"`
+	ResetTracks  int    `json:"reset_tracks"`
+	QueuedTracks int    `json:"queued_tracks"` // Tracks already on the download queue stay there once
+	SharedTracks int    `json:"shared_tracks"` // Tracks also in another playlist, left as they are
+}
+
+// PurgeStemsResponse summarizes purging a playlist's stems
+type PurgeStemsResponse struct {
+	PlaylistID   string `json:"playlist_id"`
+	PurgedTracks int    `json:"purged_tracks"`
+	FreedBytes   int64  `json:"freed_bytes"`
+}
+
+// SeparationOptions selects how Demucs separates a track
+type SeparationOptions struct {
+	Model    string `json:"model,omitempty"`     // Pretrained model (e.g. "htdemucs", "mdx_extra_q"); empty uses the Demucs default
+	TwoStems string `json:"two_stems,omitempty"` // Split into this stem and everything else (e.g. "vocals" → vocals.wav, no_vocals.wav)
+	// Quality settings that trade speed for better separation; zero keeps the Demucs defaults
+	Shifts  int     `json:"shifts,omitempty"`  // Random shift passes to average (runtime grows linearly)
+	Overlap float64 `json:"overlap,omitempty"` // Overlap between split chunks, between 0 and 1 (Demucs default 0.25)
 }
 
+// Download job priorities: interactive requests are high, resumed backlog is low
+const (
+	PriorityLow  = 0
+	PriorityHigh = 1
+)
+
 // DownloadJob represents a track download job
 type DownloadJob struct {
-	Track TrackMetadata
+	Track      TrackMetadata
+	Separation SeparationOptions // Applied to the Demucs job queued once the download completes
+	Priority   int               // PriorityLow or PriorityHigh
+	PlaylistID string            // Playlist or album the job was queued for; empty for single tracks
+
+	// AutoDemucs overrides the server's AUTO_DEMUCS setting when set
+	AutoDemucs *bool
+}
+
+// JobOptions are the settings a track was queued with. They are stored with the
+// track so retries and resumed jobs run the way the original request asked.
+type JobOptions struct {
+	PlaylistID string // Playlist or album the track was queued for; empty for single tracks
+	Separation SeparationOptions
+	AutoDemucs *bool // Nil follows AUTO_DEMUCS
 }
 
 // DemucsJob represents a Demucs separation job
 type DemucsJob struct {
 	Track     TrackMetadata
 	InputPath string
+	SeparationOptions
 }
 
 // ProgressEvent represents a download/processing progress update (minimal)
 type ProgressEvent struct {
 	TrackID  string  `json:"track_id"`
-	Type     string  `json:"type"`     // "download" or "demucs"
-	Status   string  `json:"status"`   // "pending", "downloading"/"processing", "completed", "failed"
+	Type     string  `json:"type"`     // "download", "demucs", or "playlist" for a playlist's totals
+	Status   string  `json:"status"`   // "queued" (just enqueued), "pending" (picked up by a worker), "downloading"/"processing", "completed", "failed", "purged" (stems deleted); playlists are "in_progress" or "completed"
 	Progress float64 `json:"progress"` // 0.0 to 100.0
 	Error    string  `json:"error,omitempty"`
+	Stage    string  `json:"stage,omitempty"` // Human-readable step, e.g. "extracting audio" or "model 2 of 4"
+
+	QueuePosition    int `json:"queue_position,omitempty"`    // 1-based place in the download queue, on "queued" events
+	RemainingSeconds int `json:"remaining_seconds,omitempty"` // Estimated time left in this stage, when the tool reports one
+
+	// Set on "playlist" events only
+	PlaylistID string `json:"playlist_id,omitempty"`
+	Completed  int    `json:"completed,omitempty"` // Tracks with stems ready, or downloaded if they won't be separated automatically
+	Failed     int    `json:"failed,omitempty"`    // Tracks whose download or separation failed
+	Total      int    `json:"total,omitempty"`
 }
 
 // TrackState represents full track metadata for /tracks endpoint
 type TrackState struct {
-	TrackID          string  `json:"track_id"`
-	Name             string  `json:"name"`
-	Artists          string  `json:"artists"`
-	DownloadStatus   string  `json:"download_status"`
-	DownloadProgress float64 `json:"download_progress"`
-	DownloadError    string  `json:"download_error,omitempty"`
-	DemucsStatus     string  `json:"demucs_status"`
-	DemucsProgress   float64 `json:"demucs_progress"`
-	DemucsError      string  `json:"demucs_error,omitempty"`
+	TrackID          string    `json:"track_id"`
+	Name             string    `json:"name"`
+	Artists          string    `json:"artists"`
+	DownloadStatus   string    `json:"download_status"`
+	DownloadProgress float64   `json:"download_progress"`
+	DownloadError    string    `json:"download_error,omitempty"`
+	DemucsStatus     string    `json:"demucs_status"`
+	DemucsProgress   float64   `json:"demucs_progress"`
+	DemucsError      string    `json:"demucs_error,omitempty"`
+	SourceURL        string    `json:"source_url,omitempty"`       // Set when the YouTube video was chosen manually
+	YouTubeVideoID   string    `json:"youtube_video_id,omitempty"` // Video the audio was downloaded from
+	YouTubeTitle     string    `json:"youtube_title,omitempty"`    // Its title, when found by search
+	ActiveJob        string    `json:"active_job,omitempty"`       // "download" or "demucs" while a worker holds the track
+	UpdatedAt        time.Time `json:"updated_at"`                 // Last status change
+
+	// Times each stage has been started, retries included
+	DownloadAttempts int `json:"download_attempts"`
+	DemucsAttempts   int `json:"demucs_attempts"`
+
+	// Stage timings in milliseconds; nil until the stage has run
+	DownloadDurationMs *int64 `json:"download_duration_ms,omitempty"`
+	DemucsDurationMs   *int64 `json:"demucs_duration_ms,omitempty"`
+}
+
+// TrackFilter narrows a track listing; empty fields do not filter
+type TrackFilter struct {
+	DownloadStatus string
+	DemucsStatus   string
+	PlaylistID     string
+	Query          string // Case-insensitive substring of the name or artists
+}
+
+// PlaylistSummary aggregates track statuses for one playlist for the /playlists endpoint
+type PlaylistSummary struct {
+	PlaylistID         string `json:"playlist_id"`
+	TrackCount         int    `json:"track_count"`
+	DownloadCompleted  int    `json:"download_completed"`
+	DownloadInProgress int    `json:"download_in_progress"`
+	DownloadPending    int    `json:"download_pending"`
+	DownloadFailed     int    `json:"download_failed"`
+	DemucsCompleted    int    `json:"demucs_completed"`
+	DemucsInProgress   int    `json:"demucs_in_progress"`
+	DemucsPending      int    `json:"demucs_pending"`
+	DemucsFailed       int    `json:"demucs_failed"`
+	DemucsSkipped      int    `json:"demucs_skipped"` // Downloaded with auto-Demucs off, so separated only on demand; also counted as pending
+}
+
+// StageCounts counts the tracks waiting, running and failed in one stage
+type StageCounts struct {
+	Pending    int `json:"pending"`
+	InProgress int `json:"in_progress"`
+	Failed     int `json:"failed"`
+}
+
+// QueuesResponse is the /queues response body: how backed up each stage is
+type QueuesResponse struct {
+	Download           StageCounts `json:"download"`
+	Demucs             StageCounts `json:"demucs"`
+	DownloadQueueDepth int         `json:"download_queue_depth"` // Jobs waiting in memory for a worker
+	DemucsQueueDepth   int         `json:"demucs_queue_depth"`
+}
+
+// DiskUsage totals the files of a set of tracks for the /stats endpoint
+type DiskUsage struct {
+	TotalBytes int64 `json:"total_bytes"` // Everything, including cover art and leftovers
+	BaseBytes  int64 `json:"base_bytes"`
+	StemBytes  int64 `json:"stem_bytes"`
+	Tracks     int   `json:"tracks"`      // Tracks with any files
+	BaseTracks int   `json:"base_tracks"` // Tracks with downloaded audio
+	StemTracks int   `json:"stem_tracks"` // Tracks with stems
+}
+
+// PlaylistDiskUsage is the disk usage of one playlist's tracks
+type PlaylistDiskUsage struct {
+	PlaylistID string `json:"playlist_id"`
+	DiskUsage
+}
+
+// StatsResponse reports disk usage overall and per playlist. A track in several
+// playlists counts toward each of them but only once toward the total.
+type StatsResponse struct {
+	DiskUsage
+	Playlists []PlaylistDiskUsage `json:"playlists"`
+	ScannedAt time.Time           `json:"scanned_at"` // When the songs directory was last walked
+}
+
+// DependencyStatus reports the health of one external dependency
+type DependencyStatus struct {
+	Name     string `json:"name"`
+	OK       bool   `json:"ok"`
+	Critical bool   `json:"critical"`          // A failing critical dependency makes the server unhealthy
+	Version  string `json:"version,omitempty"` // Detected at startup, for external tools
+	Error    string `json:"error,omitempty"`
+}
+
+// HealthResponse is the /healthz response body
+type HealthResponse struct {
+	Status       string             `json:"status"` // "ok", "degraded" or "unavailable"
+	Dependencies []DependencyStatus `json:"dependencies"`
 }
 
 // SpotifyConfig holds configuration for Spotify API access
@@ -73,22 +291,31 @@ type SpotifyConfig struct {
 	ClientID     string
 	ClientSecret string
 	PlaylistID   string
+	Market       string // Optional ISO country code (e.g. "US") for track availability and relinking
+	RedirectURI  string // Registered OAuth callback (e.g. "http://localhost:8080/auth/callback"); enables user login
 }
 
 // TokenResponse represents the OAuth token response from Spotify
 type TokenResponse struct {
-	AccessToken string `json:"access_token"`
-	TokenType   string `json:"token_type"`
-	ExpiresIn   int    `json:"expires_in"`
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"` // Authorization-code flow only
+	Scope        string `json:"scope,omitempty"`
 }
 
 // ServerConfig holds the main application configuration
 type ServerConfig struct {
-	SpotifyClientID     string
-	SpotifyClientSecret string
-	Port                string
-	NumWorkers          int
-	NumDemucsWorkers    int
+	SpotifyClientID         string
+	SpotifyClientSecret     string
+	Port                    string
+	NumWorkers              int
+	NumDemucsWorkers        int
+	SongsDir                string // Absolute directory for track audio and stems
+	DBPath                  string // SQLite database file, or ":memory:"
+	MaxDownloadsPerPlaylist int    // Concurrent downloads allowed per playlist; zero is unlimited
+	AutoDemucs              bool   // Queue Demucs for each completed download unless the request opted out
+	MaxJobAttempts          int    // Runs allowed per job before retries must be forced
 }
 
 // AppState holds the application state
@@ -2,7 +2,12 @@ package worker
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -10,227 +15,811 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"separate/server/models"
 )
 
+// Container name and image used unless DemucsConfig overrides them
 const (
-	demucsContainerName = "demucs-worker"
-	demucsImage         = "xserrat/facebook-demucs:latest"
+	defaultDemucsContainerName = "demucs-worker"
+	defaultDemucsImage         = "xserrat/facebook-demucs:latest"
 )
 
+// defaultModelCount is the bag size of the Demucs default model (a bag of 4)
+const defaultModelCount = 4
+
+// demucsModels maps supported pretrained models to how many sub-models they bag.
+// Each sub-model prints its own tqdm bar, so this drives the progress math.
+var demucsModels = map[string]int{
+	"htdemucs":    1,
+	"htdemucs_ft": 4,
+	"htdemucs_6s": 1,
+	"hdemucs_mmi": 1,
+	"mdx":         4,
+	"mdx_q":       4,
+	"mdx_extra":   4,
+	"mdx_extra_q": 4,
+}
+
+// IsKnownDemucsModel reports whether model is a supported pretrained Demucs model
+func IsKnownDemucsModel(model string) bool {
+	_, ok := demucsModels[model]
+	return ok
+}
+
+// ValidateSeparationOptions rejects models or stems Demucs doesn't know about
+func ValidateSeparationOptions(opts models.SeparationOptions) error {
+	if opts.Model != "" && !IsKnownDemucsModel(opts.Model) {
+		return fmt.Errorf("unknown Demucs model: %s", opts.Model)
+	}
+	switch opts.TwoStems {
+	case "", "vocals", "drums", "bass", "other":
+	default:
+		return fmt.Errorf("unknown stem for two-stem mode: %s", opts.TwoStems)
+	}
+	if opts.Shifts < 0 || opts.Shifts > maxShifts {
+		return fmt.Errorf("shifts must be between 0 and %d, got %d", maxShifts, opts.Shifts)
+	}
+	if opts.Overlap < 0 || opts.Overlap >= 1 {
+		return fmt.Errorf("overlap must be at least 0 and below 1, got %g", opts.Overlap)
+	}
+	return nil
+}
+
+// maxShifts caps --shifts, since every shift repeats the whole separation
+const maxShifts = 20
+
+// demucsModelCount returns the number of sub-models for model ("" means the default)
+func demucsModelCount(model string) int {
+	if count, ok := demucsModels[model]; ok {
+		return count
+	}
+	return defaultModelCount
+}
+
+// Demucs modes: run inside a managed Docker container, or a host install
+const (
+	DemucsModeDocker = "docker"
+	DemucsModeLocal  = "local"
+)
+
+// defaultLocalDemucsCommand is the command run in local mode
+const defaultLocalDemucsCommand = "demucs"
+
+// DemucsConfig controls how Demucs is run. The container settings only apply
+// in docker mode.
+type DemucsConfig struct {
+	Mode          string // DemucsModeDocker (the default) or DemucsModeLocal
+	LocalCommand  string // Command run in local mode, e.g. "/opt/venv/bin/python -m demucs"
+	UseGPU        bool   // Run on CUDA via "docker run --gpus all", falling back to CPU if that fails
+	MemoryLimit   string // Container memory cap in docker's format (e.g. "6g"); empty means no limit
+	ContainerName string // Long-running container jobs exec into; must be unique per server on a host
+	Image         string // Image the container is created from; it must provide the demucs CLI
+}
+
+// containerNamePattern matches the names docker accepts for containers
+var containerNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// memoryLimitPattern matches docker's memory sizes: a number with an optional b/k/m/g unit
+var memoryLimitPattern = regexp.MustCompile(`^[1-9][0-9]*[bkmgBKMG]?$`)
+
+// memoryLimitLabel records the configured limit on the container, so a changed
+// setting can be noticed when the container is reused
+const memoryLimitLabel = "splitter.memory-limit"
+
+// oomExitCode is the exit status of a process killed by SIGKILL, which is how
+// the kernel's OOM killer ends demucs when the container runs out of memory
+const oomExitCode = 137
+
+// ErrDemucsOutOfMemory is returned when demucs is killed for using too much memory
+var ErrDemucsOutOfMemory = errors.New("demucs ran out of memory; reduce workers or add RAM")
+
 var (
-	dockerInitOnce sync.Once
-	dockerInitErr  error
+	demucsConfig = DemucsConfig{
+		Mode:          DemucsModeDocker,
+		LocalCommand:  defaultLocalDemucsCommand,
+		ContainerName: defaultDemucsContainerName,
+		Image:         defaultDemucsImage,
+	}
+
+	// dockerSetupMu serializes container checks so concurrent jobs don't race
+	// to start or recreate it; it guards containerReady and gpuEnabled
+	dockerSetupMu  sync.Mutex
+	containerReady bool // Set once startDockerContainer has validated the container
+	gpuEnabled     bool // Set during container setup when the container has GPU access
 )
 
-// ensureDockerContainer ensures the Demucs Docker container is running
-func ensureDockerContainer() error {
-	dockerInitOnce.Do(func() {
-		dockerInitErr = startDockerContainer()
-	})
-	return dockerInitErr
+// ConfigureDemucs applies Demucs settings; call before starting Demucs workers.
+// An empty Mode, LocalCommand, ContainerName or Image keeps the default.
+func ConfigureDemucs(config DemucsConfig) error {
+	switch config.Mode {
+	case "":
+		config.Mode = DemucsModeDocker
+	case DemucsModeDocker, DemucsModeLocal:
+	default:
+		return fmt.Errorf("invalid mode %q: use %s or %s", config.Mode, DemucsModeDocker, DemucsModeLocal)
+	}
+	if strings.TrimSpace(config.LocalCommand) == "" {
+		config.LocalCommand = defaultLocalDemucsCommand
+	}
+	if config.MemoryLimit != "" && !memoryLimitPattern.MatchString(config.MemoryLimit) {
+		return fmt.Errorf("invalid memory limit %q: use a size like 6g or 6144m", config.MemoryLimit)
+	}
+	if config.ContainerName == "" {
+		config.ContainerName = defaultDemucsContainerName
+	} else if !containerNamePattern.MatchString(config.ContainerName) {
+		return fmt.Errorf("invalid container name %q: use letters, digits, '_', '.' and '-'", config.ContainerName)
+	}
+	if config.Image == "" {
+		config.Image = defaultDemucsImage
+	}
+	demucsConfig = config
+	return nil
+}
+
+// DemucsRunsLocally reports whether Demucs runs from a host install rather than in Docker
+func DemucsRunsLocally() bool {
+	return demucsConfig.Mode == DemucsModeLocal
+}
+
+// localDemucsCommand splits LocalCommand into the program and its leading arguments
+func localDemucsCommand() []string {
+	return strings.Fields(demucsConfig.LocalCommand)
+}
+
+// CheckLocalDemucs verifies that the local demucs command runs
+func CheckLocalDemucs(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, dependencyCheckTimeout)
+	defer cancel()
+
+	command := localDemucsCommand()
+	output, err := execCommand(ctx, command[0], append(command[1:], "--help")...).CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(output)); msg != "" {
+			return fmt.Errorf("%s --help failed: %w: %s", demucsConfig.LocalCommand, err, msg)
+		}
+		return fmt.Errorf("%s --help failed: %w", demucsConfig.LocalCommand, err)
+	}
+	return nil
+}
+
+// dependencyCheckTimeout bounds dependency checks that shell out to docker or demucs
+const dependencyCheckTimeout = 5 * time.Second
+
+// CheckDocker verifies that the docker CLI is installed and the daemon responds
+func CheckDocker(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, dependencyCheckTimeout)
+	defer cancel()
+
+	output, err := execCommand(ctx, "docker", "version", "--format", "{{.Server.Version}}").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("docker unavailable: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// CheckDemucsContainer verifies that the Demucs container is running
+func CheckDemucsContainer(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, dependencyCheckTimeout)
+	defer cancel()
+
+	output, err := execCommand(ctx, "docker", "inspect", "--format", "{{.State.Running}}", demucsConfig.ContainerName).Output()
+	if err != nil {
+		return fmt.Errorf("container %s not found: %w", demucsConfig.ContainerName, err)
+	}
+	if strings.TrimSpace(string(output)) != "true" {
+		return fmt.Errorf("container %s is not running", demucsConfig.ContainerName)
+	}
+	return nil
+}
+
+// Container setup stages reported to jobs waiting on ensureDockerContainer
+const (
+	stagePullingImage      = "pulling demucs image"
+	stageCreatingContainer = "creating container"
+	stageStartingContainer = "starting container"
+	stageContainerReady    = "container ready"
+)
+
+var (
+	// setupWatchers are the jobs waiting on container setup, keyed by a
+	// registration ID. The first job can wait minutes for a multi-GB image pull.
+	setupWatchersMu sync.Mutex
+	setupWatchers   = make(map[int]func(stage string))
+	nextWatcherID   int
+)
+
+// announceSetupStage tells every job waiting on container setup what it is doing
+func announceSetupStage(stage string) {
+	setupWatchersMu.Lock()
+	defer setupWatchersMu.Unlock()
+	for _, onStage := range setupWatchers {
+		onStage(stage)
+	}
+}
+
+// ensureDockerContainer ensures the Demucs Docker container is running and
+// reports whether it has GPU access. Every job checks, so a container that died
+// or was removed since the last job is restarted or recreated rather than
+// failing every job after it. While setup runs, onStage hears each stage it
+// reaches; when the container is already running nothing is reported.
+func ensureDockerContainer(onStage func(stage string)) (bool, error) {
+	setupWatchersMu.Lock()
+	id := nextWatcherID
+	nextWatcherID++
+	setupWatchers[id] = onStage
+	setupWatchersMu.Unlock()
+	defer func() {
+		setupWatchersMu.Lock()
+		delete(setupWatchers, id)
+		setupWatchersMu.Unlock()
+	}()
+
+	dockerSetupMu.Lock()
+	defer dockerSetupMu.Unlock()
+
+	if containerReady {
+		err := CheckDemucsContainer(context.Background())
+		if err == nil {
+			return gpuEnabled, nil
+		}
+		slog.Warn("Demucs container is down, setting it up again", "container", demucsConfig.ContainerName, "error", err)
+		containerReady = false
+	}
+
+	gpuEnabled = false
+	if err := startDockerContainer(); err != nil {
+		return false, err
+	}
+	containerReady = true
+	announceSetupStage(stageContainerReady)
+	return gpuEnabled, nil
 }
 
 // startDockerContainer starts or reuses the Demucs Docker container
 func startDockerContainer() error {
+	// The mount source must be the same absolute directory the workers write to
+	mountSource := SongsDir()
+	if !filepath.IsAbs(mountSource) {
+		return fmt.Errorf("songs directory %q is not absolute; call SetSongsDir at startup", mountSource)
+	}
+
 	// Check if container already exists
-	checkCmd := exec.Command("docker", "ps", "-a", "--filter", fmt.Sprintf("name=%s", demucsContainerName), "--format", "{{.Names}}")
+	checkCmd := execCommand(context.Background(), "docker", "ps", "-a", "--filter", containerNameFilter(), "--format", "{{.Names}}")
 	output, err := checkCmd.Output()
 	if err != nil {
 		return fmt.Errorf("failed to check for existing container: %w", err)
 	}
 
-	containerExists := strings.TrimSpace(string(output)) == demucsContainerName
+	containerExists := strings.TrimSpace(string(output)) == demucsConfig.ContainerName
+
+	// A container left over from a run with a different songs directory would
+	// look for input files that were never written there, so recreate it
+	if containerExists {
+		if current := containerMountSource(); current != mountSource {
+			slog.Warn("Recreating Demucs container with a stale songs mount", "container", demucsConfig.ContainerName, "mounted", current, "songs_dir", mountSource)
+			if err := execCommand(context.Background(), "docker", "rm", "-f", demucsConfig.ContainerName).Run(); err != nil {
+				return fmt.Errorf("failed to remove stale container: %w", err)
+			}
+			containerExists = false
+		}
+	}
 
 	if containerExists {
 		// Check if it's running
-		checkRunning := exec.Command("docker", "ps", "--filter", fmt.Sprintf("name=%s", demucsContainerName), "--format", "{{.Names}}")
+		checkRunning := execCommand(context.Background(), "docker", "ps", "--filter", containerNameFilter(), "--format", "{{.Names}}")
 		output, err := checkRunning.Output()
 		if err != nil {
 			return fmt.Errorf("failed to check if container is running: %w", err)
 		}
 
-		isRunning := strings.TrimSpace(string(output)) == demucsContainerName
+		isRunning := strings.TrimSpace(string(output)) == demucsConfig.ContainerName
 
 		if !isRunning {
 			// Start existing container
-			startCmd := exec.Command("docker", "start", demucsContainerName)
+			announceSetupStage(stageStartingContainer)
+			startCmd := execCommand(context.Background(), "docker", "start", demucsConfig.ContainerName)
 			if err := startCmd.Run(); err != nil {
 				return fmt.Errorf("failed to start existing container: %w", err)
 			}
-			fmt.Printf("Started existing Demucs container: %s\n", demucsContainerName)
+			slog.Info("Started existing Demucs container", "container", demucsConfig.ContainerName)
 		} else {
-			fmt.Printf("Demucs container already running: %s\n", demucsContainerName)
+			slog.Info("Demucs container already running", "container", demucsConfig.ContainerName)
+		}
+
+		if demucsConfig.UseGPU {
+			gpuEnabled = containerHasGPU()
+			if !gpuEnabled {
+				slog.Warn("Existing Demucs container has no GPU access; remove it to recreate with --gpus all", "container", demucsConfig.ContainerName)
+			}
+		}
+		if image := containerImage(); image != "" && image != demucsConfig.Image {
+			slog.Warn("Existing Demucs container uses a different image; remove it to recreate",
+				"container", demucsConfig.ContainerName, "current", image, "configured", demucsConfig.Image)
+		}
+		if limit := containerMemoryLimit(); limit != demucsConfig.MemoryLimit {
+			slog.Warn("Existing Demucs container has a different memory limit; remove it to recreate",
+				"container", demucsConfig.ContainerName, "current", limit, "configured", demucsConfig.MemoryLimit)
 		}
 	} else {
 		// Pull image if not present
-		pullCmd := exec.Command("docker", "pull", demucsImage)
-		pullCmd.Stdout = os.Stdout
-		pullCmd.Stderr = os.Stderr
-		if err := pullCmd.Run(); err != nil {
+		announceSetupStage(stagePullingImage)
+		if err := pullImage(demucsConfig.Image); err != nil {
 			return fmt.Errorf("failed to pull Demucs image: %w", err)
 		}
 
-		// Get absolute path for volume mount
-		absPath, err := filepath.Abs("songs")
-		if err != nil {
-			return fmt.Errorf("failed to get absolute path: %w", err)
+		announceSetupStage(stageCreatingContainer)
+		if demucsConfig.UseGPU {
+			if err := createContainer(mountSource, true); err != nil {
+				// Typically no NVIDIA container runtime; clean up and fall back to CPU
+				slog.Warn("Failed to create GPU Demucs container, falling back to CPU", "error", err)
+				execCommand(context.Background(), "docker", "rm", "-f", demucsConfig.ContainerName).Run()
+			} else {
+				gpuEnabled = true
+				return nil
+			}
 		}
 
-		// Create new container that stays running
-		createCmd := exec.Command("docker", "run", "-d",
-			"--name", demucsContainerName,
-			"--entrypoint", "sleep",
-			"-v", fmt.Sprintf("%s:/songs", absPath),
-			demucsImage,
-			"infinity", // Keep container alive forever
-		)
-		if err := createCmd.Run(); err != nil {
-			return fmt.Errorf("failed to create Demucs container: %w", err)
+		if err := createContainer(mountSource, false); err != nil {
+			return err
 		}
-		fmt.Printf("Created new Demucs container: %s\n", demucsContainerName)
 	}
 
 	return nil
 }
 
-// ProcessTrackWithDemucs separates audio using Demucs and reports progress
-func ProcessTrackWithDemucs(track models.TrackMetadata, inputPath string, progressChan chan<- models.ProgressEvent) error {
-	// Ensure Docker container is running
-	if err := ensureDockerContainer(); err != nil {
-		return fmt.Errorf("failed to ensure Docker container: %w", err)
+// createContainer creates a new long-running Demucs container with songsDir mounted at containerSongsDir
+func createContainer(songsDir string, withGPU bool) error {
+	args := []string{"run", "-d", "--name", demucsConfig.ContainerName}
+	if withGPU {
+		args = append(args, "--gpus", "all")
+	}
+	if demucsConfig.MemoryLimit != "" {
+		// Equal swap keeps demucs from thrashing swap instead of failing cleanly
+		args = append(args, "-m", demucsConfig.MemoryLimit, "--memory-swap", demucsConfig.MemoryLimit)
 	}
+	args = append(args, "--label", memoryLimitLabel+"="+demucsConfig.MemoryLimit)
+	args = append(args,
+		"--entrypoint", "sleep",
+		"-v", songsDir+":"+containerSongsDir,
+		demucsConfig.Image,
+		"infinity", // Keep container alive forever
+	)
+
+	createCmd := execCommand(context.Background(), "docker", args...)
+	if output, err := createCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to create Demucs container: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	slog.Info("Created new Demucs container", "container", demucsConfig.ContainerName, "gpu", withGPU, "songs_dir", songsDir)
+	return nil
+}
 
-	// Convert to paths inside container
-	trackID := track.ID
-	containerInputPath := fmt.Sprintf("/songs/%s/base.mp3", trackID)
-	containerOutputDir := fmt.Sprintf("/songs/%s", trackID)
+// containerNameFilter is a "docker ps" filter matching only the Demucs container.
+// docker matches names by substring, which would also find e.g. "demucs-worker-2"
+// from a second server on the host.
+func containerNameFilter() string {
+	return "name=^" + regexp.QuoteMeta(demucsConfig.ContainerName) + "$"
+}
 
-	// Run demucs command
-	args := []string{
-		"exec",
-		"-e", "PYTHONUNBUFFERED=1",
-		demucsContainerName,
-		"demucs",
-		"--device", "cpu",
-		"-v",
-		"-o", containerOutputDir,
-		containerInputPath,
+// containerMountSource returns the host directory mounted at containerSongsDir in
+// the existing Demucs container, or "" if it can't be determined
+func containerMountSource() string {
+	format := fmt.Sprintf(`{{range .Mounts}}{{if eq .Destination %q}}{{.Source}}{{end}}{{end}}`, containerSongsDir)
+	output, err := execCommand(context.Background(), "docker", "inspect", "--format", format, demucsConfig.ContainerName).Output()
+	if err != nil {
+		return ""
 	}
+	return strings.TrimSpace(string(output))
+}
 
-	cmd := exec.Command("docker", args...)
-
-	// Create pipes
-	stderr, err := cmd.StderrPipe()
+// containerMemoryLimit returns the memory limit the existing Demucs container
+// was created with, as configured at the time ("" for none)
+func containerMemoryLimit() string {
+	format := fmt.Sprintf(`{{index .Config.Labels %q}}`, memoryLimitLabel)
+	output, err := execCommand(context.Background(), "docker", "inspect", "--format", format, demucsConfig.ContainerName).Output()
 	if err != nil {
-		return fmt.Errorf("failed to create stderr pipe: %w", err)
+		return ""
 	}
+	// Containers created before the label existed print "<no value>"
+	return strings.TrimPrefix(strings.TrimSpace(string(output)), "<no value>")
+}
 
-	stdout, err := cmd.StdoutPipe()
+// containerImage returns the image the existing Demucs container was created
+// from, or "" if it can't be determined
+func containerImage() string {
+	output, err := execCommand(context.Background(), "docker", "inspect", "--format", "{{.Config.Image}}", demucsConfig.ContainerName).Output()
 	if err != nil {
-		return fmt.Errorf("failed to create stdout pipe: %w", err)
+		return ""
 	}
+	return strings.TrimSpace(string(output))
+}
 
-	// Start command
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start demucs: %w", err)
+// containerHasGPU reports whether the existing Demucs container was created with GPU access
+func containerHasGPU() bool {
+	output, err := execCommand(context.Background(), "docker", "inspect", "--format", "{{json .HostConfig.DeviceRequests}}", demucsConfig.ContainerName).Output()
+	if err != nil {
+		return false
 	}
+	requests := strings.TrimSpace(string(output))
+	return requests != "null" && requests != "[]"
+}
 
-	var wg sync.WaitGroup
+// HasDemucsOutput reports whether separated stems exist for a track
+func HasDemucsOutput(trackID string) bool {
+	_, ok := StemDir(trackID)
+	return ok
+}
 
-	// State for tracking model progress
-	currentModel := 0
-	lastProgress := 0.0
-	ansiRegex := regexp.MustCompile(`\x1b\[[0-9;]*m`)
+// StemDir returns the directory holding a track's separated stems,
+// {songs dir}/{id}/demucs/, which has at least two stems once a run succeeds.
+// Tracks separated before the layout was normalized keep Demucs's own
+// {model}/base/ directories; of those, the most recent output wins.
+func StemDir(trackID string) (string, bool) {
+	dir := stemsDir(trackID)
+	if stems, err := filepath.Glob(filepath.Join(dir, "*.wav")); err == nil && len(stems) >= 2 {
+		return dir, true
+	}
 
-	// Helper function to process each progress update
-	processDemucsOutput := func(line, trackID string, currentModel *int, lastProgress *float64, ansiRegex *regexp.Regexp, progressChan chan<- models.ProgressEvent) {
-		cleanLine := ansiRegex.ReplaceAllString(line, "")
-		cleanLine = strings.TrimSpace(cleanLine)
+	dirs, err := filepath.Glob(filepath.Join(TrackDir(trackID), "*", "base"))
+	if err != nil {
+		return "", false
+	}
 
-		if !strings.Contains(cleanLine, "%") {
-			return
+	var newest string
+	var newestTime time.Time
+	for _, dir := range dirs {
+		stems, err := filepath.Glob(filepath.Join(dir, "*.wav"))
+		if err != nil || len(stems) < 2 {
+			continue
 		}
-
-		percentRegex := regexp.MustCompile(`^\s*(\d+)%`)
-		matches := percentRegex.FindStringSubmatch(cleanLine)
-		if len(matches) < 2 {
-			return
+		info, err := os.Stat(dir)
+		if err != nil {
+			continue
 		}
-
-		percentStr := matches[1]
-		modelProgress, err := strconv.ParseFloat(percentStr, 64)
-		if err != nil || modelProgress < 0 || modelProgress > 100 {
-			return
+		if newest == "" || info.ModTime().After(newestTime) {
+			newest, newestTime = dir, info.ModTime()
 		}
+	}
+	return newest, newest != ""
+}
+
+// RemoveStems deletes a track's Demucs output for every model, keeping the
+// downloaded audio, and returns the number of bytes freed
+func RemoveStems(trackID string) (int64, error) {
+	dir := TrackDir(trackID)
+	before, err := scanTrackDir(dir)
+	if err != nil {
+		return 0, err
+	}
 
-		if modelProgress < *lastProgress-50 {
-			*currentModel++
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	var removeErr error
+	for _, entry := range entries {
+		// Stems live in demucs/ (or {model}/base/ from before the layout was
+		// normalized); only files such as base.mp3 sit at the top level
+		if entry.IsDir() {
+			removeErr = errors.Join(removeErr, os.RemoveAll(filepath.Join(dir, entry.Name())))
 		}
-		*lastProgress = modelProgress
+	}
+
+	after, err := scanTrackDir(dir)
+	if err != nil {
+		return 0, errors.Join(removeErr, err)
+	}
+	return before.TotalBytes - after.TotalBytes, removeErr
+}
+
+// collectStems moves the stems Demucs wrote to {staging}/{model}/base/ into
+// the track's stems directory. They replace an earlier separation as a whole,
+// so stems of different runs (four-stem and two-stem, say) never mix.
+func collectStems(trackID string) error {
+	outputs, err := filepath.Glob(filepath.Join(demucsStagingDir(trackID), "*", "base"))
+	if err != nil {
+		return err
+	}
+	if len(outputs) != 1 {
+		return fmt.Errorf("expected one Demucs output directory, found %d", len(outputs))
+	}
+	stems, err := filepath.Glob(filepath.Join(outputs[0], "*.wav"))
+	if err != nil {
+		return err
+	}
+	if len(stems) < 2 {
+		return fmt.Errorf("demucs wrote %d stems, expected at least 2", len(stems))
+	}
 
-		// Calculate progress by averaging all 4 models:
-		// - Completed models contribute 100%
-		// - Current model contributes its actual progress
-		// - Future models contribute 0%
-		var totalProgress float64
-		for i := 0; i < 4; i++ {
-			if i < *currentModel {
-				totalProgress += 100.0 // Completed models
-			} else if i == *currentModel {
-				totalProgress += modelProgress // Current model
+	// Clear the previous stems, including per-model directories from before
+	// the layout was normalized
+	entries, err := os.ReadDir(TrackDir(trackID))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name() != demucsStagingDirName {
+			if err := os.RemoveAll(filepath.Join(TrackDir(trackID), entry.Name())); err != nil {
+				return err
 			}
-			// Future models contribute 0
 		}
-		overallProgress := totalProgress / 4.0
+	}
+	return os.Rename(outputs[0], stemsDir(trackID))
+}
 
-		if overallProgress > 100 {
-			overallProgress = 100
+// demucsExitError explains a failed demucs run, calling out the OOM killer
+// since a bare "exit status 137" says nothing about memory
+func demucsExitError(err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == oomExitCode {
+		if demucsConfig.MemoryLimit != "" {
+			return fmt.Errorf("%w (container limit %s)", ErrDemucsOutOfMemory, demucsConfig.MemoryLimit)
 		}
+		return ErrDemucsOutOfMemory
+	}
+	return fmt.Errorf("demucs processing failed: %w", err)
+}
+
+var (
+	// ansiRegex matches the color codes tqdm may wrap around its bar
+	ansiRegex = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+	// tqdmPercentRegex matches the percentage that starts a tqdm bar
+	tqdmPercentRegex = regexp.MustCompile(`^\s*(\d+)%`)
+	// tqdmTimingRegex matches tqdm's "[00:45<01:12" elapsed/remaining block
+	tqdmTimingRegex = regexp.MustCompile(`\[([\d:]+)<([\d:]+)`)
+	// bagSizeRegex matches demucs's "Selected model is a bag of 4 models." notice
+	bagSizeRegex = regexp.MustCompile(`bag of (\d+) models`)
+)
+
+// DemucsProgressState carries progress across the lines of one demucs run. A
+// bag of models prints one tqdm bar per sub-model and shift, each running
+// 0-100%. The model count comes from demucs's own notice when it prints one,
+// and the model table otherwise. It is safe to share between the stdout and
+// stderr readers.
+type DemucsProgressState struct {
+	mu             sync.Mutex
+	trackID        string
+	numModels      int
+	barsPerModel   int     // One bar per shift
+	currentBar     int     // 0-based index of the running bar across all models
+	lastBarPercent float64 // Last percentage of the current bar
+	lastOverall    float64 // Overall progress never moves backwards
+}
+
+// NewDemucsProgressState returns the starting state for separating trackID with opts
+func NewDemucsProgressState(trackID string, opts models.SeparationOptions) *DemucsProgressState {
+	return &DemucsProgressState{
+		trackID:      trackID,
+		numModels:    demucsModelCount(opts.Model),
+		barsPerModel: max(opts.Shifts, 1), // Demucs makes one pass even with --shifts 0
+	}
+}
+
+// ParseDemucsProgressLine turns one line of demucs output into a progress event
+// for the whole run. line is a single update: callers split tqdm's
+// carriage-return redraws apart first (see scanProgressLines). It reports false
+// for lines that aren't progress bars, after noting any bag size they announce.
+func ParseDemucsProgressLine(line string, state *DemucsProgressState) (models.ProgressEvent, bool) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
 
-		progressChan <- models.ProgressEvent{
-			TrackID:  trackID,
-			Type:     "demucs",
-			Status:   "processing",
-			Progress: overallProgress,
+	cleanLine := strings.TrimSpace(ansiRegex.ReplaceAllString(line, ""))
+
+	if bag := bagSizeRegex.FindStringSubmatch(cleanLine); bag != nil {
+		if n, err := strconv.Atoi(bag[1]); err == nil && n*state.barsPerModel > state.currentBar {
+			state.numModels = n
 		}
+		return models.ProgressEvent{}, false
 	}
 
-	// Read stderr (tqdm progress)
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		scanner := bufio.NewScanner(stderr)
-		for scanner.Scan() {
-			line := scanner.Text()
-			updates := strings.Split(line, "\r")
-			for _, update := range updates {
-				if update == "" {
-					continue
-				}
-				processDemucsOutput(update, trackID, &currentModel, &lastProgress, ansiRegex, progressChan)
-			}
+	matches := tqdmPercentRegex.FindStringSubmatch(cleanLine)
+	if matches == nil {
+		return models.ProgressEvent{}, false
+	}
+	barPercent, err := strconv.ParseFloat(matches[1], 64)
+	if err != nil || barPercent > 100 {
+		return models.ProgressEvent{}, false
+	}
+
+	// A large drop means the next bar started
+	totalBars := state.numModels * state.barsPerModel
+	if barPercent < state.lastBarPercent-50 && state.currentBar < totalBars-1 {
+		state.currentBar++
+	}
+	state.lastBarPercent = barPercent
+
+	// Completed bars count as 100%, the running one as its percentage, the rest as 0
+	overall := (float64(state.currentBar)*100 + barPercent) / float64(totalBars)
+	overall = min(max(overall, state.lastOverall), 100)
+	state.lastOverall = overall
+
+	// tqdm prints "[elapsed<remaining, rate]" for the current bar; each bar
+	// after it should take about as long as this one in total
+	var remaining int
+	if timing := tqdmTimingRegex.FindStringSubmatch(cleanLine); timing != nil {
+		elapsed, okElapsed := parseClock(timing[1])
+		left, okLeft := parseClock(timing[2])
+		if okElapsed && okLeft {
+			remaining = left + (totalBars-state.currentBar-1)*(elapsed+left)
 		}
-	}()
+	}
+
+	return models.ProgressEvent{
+		TrackID:          state.trackID,
+		Type:             "demucs",
+		Status:           "processing",
+		Progress:         overall,
+		Stage:            fmt.Sprintf("model %d of %d", state.currentBar/state.barsPerModel+1, state.numModels),
+		RemainingSeconds: remaining,
+	}, true
+}
+
+// demucsArgs returns the demucs arguments separating input into outputDir
+func demucsArgs(job *models.DemucsJob, device, outputDir, input string) []string {
+	args := []string{
+		"--device", device,
+		"-v",
+		"-o", outputDir,
+	}
+	if job.Model != "" {
+		args = append(args, "-n", job.Model)
+	}
+	if job.TwoStems != "" {
+		// Produces {stem}.wav and no_{stem}.wav instead of the four usual stems
+		args = append(args, "--two-stems="+job.TwoStems)
+	}
+	if job.Shifts > 0 {
+		args = append(args, "--shifts", strconv.Itoa(job.Shifts))
+	}
+	if job.Overlap > 0 {
+		args = append(args, "--overlap", strconv.FormatFloat(job.Overlap, 'f', -1, 64))
+	}
+	return append(args, input)
+}
+
+// dockerDemucsCmd builds a "docker exec" running demucs in the container,
+// setting the container up first if it isn't running
+func dockerDemucsCmd(ctx context.Context, job *models.DemucsJob, progressChan chan<- models.ProgressEvent) (*exec.Cmd, error) {
+	// A job that has to wait for container setup reports it
+	onStage := func(stage string) {
+		sendProgress(progressChan, models.ProgressEvent{
+			TrackID: job.Track.ID,
+			Type:    "demucs",
+			Status:  "pending",
+			Stage:   stage,
+		})
+	}
+	useGPU, err := ensureDockerContainer(onStage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to ensure Docker container: %w", err)
+	}
+
+	device := "cpu"
+	if useGPU {
+		device = "cuda"
+	}
 
-	// Read stdout (Docker messages) - discard but must read
-	wg.Add(1)
-	go func() {
+	// Paths as seen inside the container
+	containerInputPath := containerBaseAudioPath(job.Track.ID)
+	args := append([]string{"exec", "-e", "PYTHONUNBUFFERED=1", demucsConfig.ContainerName, "demucs"},
+		demucsArgs(job, device, containerDemucsStagingDir(job.Track.ID), containerInputPath)...)
+	cmd := execCommand(ctx, "docker", args...)
+
+	// Killing the docker exec client leaves demucs running in the container,
+	// so stop the in-container process too when the job is cancelled
+	cmd.Cancel = func() error {
+		execCommand(context.Background(), "docker", "exec", demucsConfig.ContainerName, "pkill", "-f", containerInputPath).Run()
+		return cmd.Process.Kill()
+	}
+	return cmd, nil
+}
+
+// localDemucsCmd builds a command running the host's demucs on the track's files directly
+func localDemucsCmd(ctx context.Context, job *models.DemucsJob) *exec.Cmd {
+	device := "cpu"
+	if demucsConfig.UseGPU {
+		device = "cuda"
+	}
+	command := localDemucsCommand()
+	args := append(command[1:], demucsArgs(job, device, demucsStagingDir(job.Track.ID), BaseAudioPath(job.Track.ID))...)
+	cmd := execCommand(ctx, command[0], args...)
+	cmd.Env = append(os.Environ(), "PYTHONUNBUFFERED=1")
+	return cmd
+}
+
+// scanProgressLines is a bufio.SplitFunc that ends a line at either "\r" or
+// "\n". tqdm redraws its bar with bare carriage returns, so splitting only on
+// newlines would pile a whole run's updates into one over-long token.
+func scanProgressLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// ProcessTrackWithDemucs separates audio using Demucs and reports progress.
+// Cancelling ctx stops the separation, including the process inside the container.
+func ProcessTrackWithDemucs(ctx context.Context, job *models.DemucsJob, progressChan chan<- models.ProgressEvent) error {
+	trackID := job.Track.ID
+
+	// Demucs writes to a staging directory, emptied of any interrupted run, and
+	// the stems are moved into place only if it succeeds
+	staging := demucsStagingDir(trackID)
+	if err := os.RemoveAll(staging); err != nil {
+		return fmt.Errorf("failed to clear Demucs output directory: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	var (
+		cmd *exec.Cmd
+		err error
+	)
+	if DemucsRunsLocally() {
+		cmd = localDemucsCmd(ctx, job)
+	} else if cmd, err = dockerDemucsCmd(ctx, job, progressChan); err != nil {
+		return err
+	}
+
+	// Create pipes
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("failed to create stderr pipe: %w", err)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to create stdout pipe: %w", err)
+	}
+
+	// Start command
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start demucs: %w", err)
+	}
+
+	var wg sync.WaitGroup
+
+	// Both streams feed the same state: stdout announces the bag size, stderr has the bars
+	state := NewDemucsProgressState(trackID, job.SeparationOptions)
+	readOutput := func(r io.Reader) {
 		defer wg.Done()
-		scanner := bufio.NewScanner(stdout)
+		// Drain whatever the scanner left (e.g. after an over-long line) so
+		// demucs never blocks writing to a full pipe
+		defer io.Copy(io.Discard, r)
+
+		scanner := bufio.NewScanner(r)
+		scanner.Split(scanProgressLines)
 		for scanner.Scan() {
-			_ = scanner.Text()
+			if event, ok := ParseDemucsProgressLine(scanner.Text(), state); ok {
+				sendProgress(progressChan, event)
+			}
 		}
-	}()
+	}
+	wg.Add(2)
+	go readOutput(stderr)
+	go readOutput(stdout)
 
-	cmdErr := cmd.Wait()
+	// Wait for the readers before cmd.Wait, which closes the pipes and would
+	// otherwise drop unread output; they end once the process exits or is killed
 	wg.Wait()
+	cmdErr := cmd.Wait()
 
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
 	if cmdErr != nil {
-		return fmt.Errorf("demucs processing failed: %w", cmdErr)
+		return demucsExitError(cmdErr)
 	}
 
-	fmt.Printf("Demucs processing completed: %s → songs/%s/\n", inputPath, trackID)
+	slog.Debug("Demucs process exited", "worker_type", "demucs", "track_id", trackID, "input", job.InputPath)
+	if err := collectStems(trackID); err != nil {
+		return fmt.Errorf("failed to collect stems: %w", err)
+	}
 	return nil
 }
@@ -0,0 +1,555 @@
+package worker
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"separate/server/models"
+)
+
+// fakeDocker replaces execCommand with a docker stand-in. inspectOutput is what
+// "docker inspect" prints; "docker ps" reports the container if exists is set.
+// It returns a pointer to the args of every "docker run" call.
+func fakeDocker(t *testing.T, exists bool, inspectOutput string) *[][]string {
+	t.Helper()
+	var runs [][]string
+	originalExec := execCommand
+	execCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		switch args[0] {
+		case "ps":
+			if exists {
+				return exec.CommandContext(ctx, "printf", "%s", demucsConfig.ContainerName)
+			}
+		case "inspect":
+			return exec.CommandContext(ctx, "printf", "%s", inspectOutput)
+		case "run":
+			runs = append(runs, args)
+		}
+		return exec.CommandContext(ctx, "true")
+	}
+	t.Cleanup(func() { execCommand = originalExec })
+	return &runs
+}
+
+// mountSource returns the host side of the -v flag in a docker run call
+func mountSource(t *testing.T, args []string) string {
+	t.Helper()
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == "-v" {
+			source, target, _ := strings.Cut(args[i+1], ":")
+			if target != containerSongsDir {
+				t.Errorf("Expected mount target %s, got %s", containerSongsDir, target)
+			}
+			return source
+		}
+	}
+	t.Fatalf("No -v flag in docker run args %v", args)
+	return ""
+}
+
+func TestDemucsContainerMountsSongsDir(t *testing.T) {
+	useTempSongsDir(t)
+	runs := fakeDocker(t, false, "")
+
+	if err := startDockerContainer(); err != nil {
+		t.Fatalf("startDockerContainer failed: %v", err)
+	}
+	if len(*runs) != 1 {
+		t.Fatalf("Expected one docker run, got %d", len(*runs))
+	}
+
+	// The mount must expose exactly where downloads are written, so the
+	// container path for a track resolves to its host file
+	source := mountSource(t, (*runs)[0])
+	if source != SongsDir() {
+		t.Errorf("Expected mount source %s, got %s", SongsDir(), source)
+	}
+	rel, err := filepath.Rel(source, BaseAudioPath("track1"))
+	if err != nil {
+		t.Fatalf("Rel failed: %v", err)
+	}
+	if got := containerSongsDir + "/" + filepath.ToSlash(rel); got != containerBaseAudioPath("track1") {
+		t.Errorf("Host file maps to %s in the container, but Demucs reads %s", got, containerBaseAudioPath("track1"))
+	}
+}
+
+func TestDemucsContainerRecreatedOnStaleMount(t *testing.T) {
+	useTempSongsDir(t)
+	runs := fakeDocker(t, true, "/somewhere/else/songs")
+
+	if err := startDockerContainer(); err != nil {
+		t.Fatalf("startDockerContainer failed: %v", err)
+	}
+	if len(*runs) != 1 {
+		t.Fatalf("Expected the container to be recreated, got %d docker runs", len(*runs))
+	}
+	if source := mountSource(t, (*runs)[0]); source != SongsDir() {
+		t.Errorf("Expected mount source %s, got %s", SongsDir(), source)
+	}
+}
+
+func TestDemucsContainerMemoryLimit(t *testing.T) {
+	useTempSongsDir(t)
+	runs := fakeDocker(t, false, "")
+
+	original := demucsConfig
+	defer func() { demucsConfig = original }()
+	if err := ConfigureDemucs(DemucsConfig{MemoryLimit: "bogus"}); err == nil {
+		t.Error("Expected an invalid memory limit to be rejected")
+	}
+	if err := ConfigureDemucs(DemucsConfig{MemoryLimit: "6g"}); err != nil {
+		t.Fatalf("ConfigureDemucs failed: %v", err)
+	}
+
+	if err := startDockerContainer(); err != nil {
+		t.Fatalf("startDockerContainer failed: %v", err)
+	}
+	args := (*runs)[0]
+	if i := slices.Index(args, "-m"); i < 0 || args[i+1] != "6g" {
+		t.Errorf("Expected -m 6g in docker run args %v", args)
+	}
+}
+
+func TestDemucsContainerNameAndImage(t *testing.T) {
+	useTempSongsDir(t)
+	runs := fakeDocker(t, false, "")
+
+	original := demucsConfig
+	defer func() { demucsConfig = original }()
+	if err := ConfigureDemucs(DemucsConfig{ContainerName: "demucs worker"}); err == nil {
+		t.Error("Expected a container name with a space to be rejected")
+	}
+	if err := ConfigureDemucs(DemucsConfig{}); err != nil {
+		t.Fatalf("ConfigureDemucs failed: %v", err)
+	}
+	if demucsConfig.ContainerName != defaultDemucsContainerName || demucsConfig.Image != defaultDemucsImage {
+		t.Errorf("Expected the defaults for an empty config, got %q and %q", demucsConfig.ContainerName, demucsConfig.Image)
+	}
+
+	if err := ConfigureDemucs(DemucsConfig{ContainerName: "demucs-2", Image: "example/demucs:4.0"}); err != nil {
+		t.Fatalf("ConfigureDemucs failed: %v", err)
+	}
+	if err := startDockerContainer(); err != nil {
+		t.Fatalf("startDockerContainer failed: %v", err)
+	}
+	args := (*runs)[0]
+	if i := slices.Index(args, "--name"); i < 0 || args[i+1] != "demucs-2" {
+		t.Errorf("Expected --name demucs-2 in docker run args %v", args)
+	}
+	if !slices.Contains(args, "example/demucs:4.0") {
+		t.Errorf("Expected image example/demucs:4.0 in docker run args %v", args)
+	}
+}
+
+func TestEnsureDockerContainerReportsSetupStages(t *testing.T) {
+	useTempSongsDir(t)
+	fakeDocker(t, false, "true")
+	containerReady = false
+	t.Cleanup(func() { containerReady = false })
+
+	var stages []string
+	onStage := func(stage string) { stages = append(stages, stage) }
+	if _, err := ensureDockerContainer(onStage); err != nil {
+		t.Fatalf("ensureDockerContainer failed: %v", err)
+	}
+	want := []string{stagePullingImage, stageCreatingContainer, stageContainerReady}
+	if !slices.Equal(stages, want) {
+		t.Errorf("Expected stages %v, got %v", want, stages)
+	}
+
+	// While the container runs, later jobs start without any setup events
+	stages = nil
+	if _, err := ensureDockerContainer(onStage); err != nil {
+		t.Fatalf("ensureDockerContainer failed: %v", err)
+	}
+	if len(stages) != 0 {
+		t.Errorf("Expected no stages once the container is ready, got %v", stages)
+	}
+}
+
+func TestEnsureDockerContainerRecreatesDeadContainer(t *testing.T) {
+	useTempSongsDir(t)
+	fakeDocker(t, false, "true")
+	containerReady = false
+	t.Cleanup(func() { containerReady = false })
+
+	if _, err := ensureDockerContainer(func(string) {}); err != nil {
+		t.Fatalf("ensureDockerContainer failed: %v", err)
+	}
+
+	// The container has since been removed: inspect no longer reports it running
+	runs := fakeDocker(t, false, "false")
+	if _, err := ensureDockerContainer(func(string) {}); err != nil {
+		t.Fatalf("ensureDockerContainer failed: %v", err)
+	}
+	if len(*runs) != 1 {
+		t.Errorf("Expected the dead container to be recreated, got %d docker runs", len(*runs))
+	}
+}
+
+func TestLocalDemucsRunsOnHostPaths(t *testing.T) {
+	useTempSongsDir(t)
+	original := demucsConfig
+	defer func() { demucsConfig = original }()
+	if err := ConfigureDemucs(DemucsConfig{Mode: "podman"}); err == nil {
+		t.Error("Expected an unknown mode to be rejected")
+	}
+	if err := ConfigureDemucs(DemucsConfig{Mode: DemucsModeLocal, LocalCommand: "/opt/venv/bin/python -m demucs"}); err != nil {
+		t.Fatalf("ConfigureDemucs failed: %v", err)
+	}
+
+	calls := fakeLocalDemucs(t, "htdemucs", "vocals", "drums", "bass", "other")
+
+	job := &models.DemucsJob{Track: models.TrackMetadata{ID: "track1"}}
+	if err := ProcessTrackWithDemucs(context.Background(), job, make(chan models.ProgressEvent, 10)); err != nil {
+		t.Fatalf("ProcessTrackWithDemucs failed: %v", err)
+	}
+	if len(*calls) != 1 {
+		t.Fatalf("Expected a single local command without docker, got %v", *calls)
+	}
+	want := []string{"/opt/venv/bin/python", "-m", "demucs", "--device", "cpu", "-v", "-o", demucsStagingDir("track1"), BaseAudioPath("track1")}
+	if !slices.Equal((*calls)[0], want) {
+		t.Errorf("Expected %v, got %v", want, (*calls)[0])
+	}
+}
+
+// fakeLocalDemucs replaces execCommand with a local demucs stand-in that writes
+// the given stems to {-o dir}/{model}/base/, as Demucs does. It returns the
+// commands run.
+func fakeLocalDemucs(t *testing.T, model string, stems ...string) *[][]string {
+	t.Helper()
+	var calls [][]string
+	originalExec := execCommand
+	execCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		calls = append(calls, append([]string{name}, args...))
+		if i := slices.Index(args, "-o"); i >= 0 {
+			dir := filepath.Join(args[i+1], model, "base")
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			for _, stem := range stems {
+				if err := os.WriteFile(filepath.Join(dir, stem+".wav"), []byte(stem), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		return exec.CommandContext(ctx, "true")
+	}
+	t.Cleanup(func() { execCommand = originalExec })
+	return &calls
+}
+
+func TestDemucsStemsAreNormalized(t *testing.T) {
+	useTempSongsDir(t)
+	original := demucsConfig
+	defer func() { demucsConfig = original }()
+	if err := ConfigureDemucs(DemucsConfig{Mode: DemucsModeLocal, LocalCommand: "demucs"}); err != nil {
+		t.Fatalf("ConfigureDemucs failed: %v", err)
+	}
+
+	// Stems of an earlier run, in both the legacy and the normalized layout
+	dir := TrackDir("track1")
+	for _, stale := range []string{filepath.Join("mdx_extra", "base", "vocals.wav"), filepath.Join("demucs", "no_vocals.wav")} {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, stale)), 0755)
+		os.WriteFile(filepath.Join(dir, stale), []byte("old"), 0644)
+	}
+	os.WriteFile(BaseAudioPath("track1"), []byte("mp3"), 0644)
+
+	fakeLocalDemucs(t, "htdemucs", "vocals", "drums", "bass", "other")
+	job := &models.DemucsJob{Track: models.TrackMetadata{ID: "track1"}}
+	if err := ProcessTrackWithDemucs(context.Background(), job, make(chan models.ProgressEvent, 10)); err != nil {
+		t.Fatalf("ProcessTrackWithDemucs failed: %v", err)
+	}
+
+	for _, stem := range []string{"vocals", "drums", "bass", "other"} {
+		data, err := os.ReadFile(filepath.Join(dir, "demucs", stem+".wav"))
+		if err != nil || string(data) != stem {
+			t.Errorf("Expected demucs/%s.wav from the new run, got %q, %v", stem, data, err)
+		}
+	}
+	entries, _ := os.ReadDir(dir)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if want := []string{"base.mp3", "demucs"}; !slices.Equal(names, want) {
+		t.Errorf("Expected only %v to be left, got %v", want, names)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "demucs", "no_vocals.wav")); err == nil {
+		t.Error("Expected stems of the earlier run to be replaced")
+	}
+	if stemDir, ok := StemDir("track1"); !ok || stemDir != filepath.Join(dir, "demucs") {
+		t.Errorf("Expected StemDir to be demucs/, got %q, %v", stemDir, ok)
+	}
+}
+
+func TestDemucsFailsWithoutStems(t *testing.T) {
+	useTempSongsDir(t)
+	original := demucsConfig
+	defer func() { demucsConfig = original }()
+	if err := ConfigureDemucs(DemucsConfig{Mode: DemucsModeLocal, LocalCommand: "demucs"}); err != nil {
+		t.Fatalf("ConfigureDemucs failed: %v", err)
+	}
+	os.MkdirAll(TrackDir("track1"), 0755)
+
+	fakeLocalDemucs(t, "htdemucs", "vocals")
+	job := &models.DemucsJob{Track: models.TrackMetadata{ID: "track1"}}
+	if err := ProcessTrackWithDemucs(context.Background(), job, make(chan models.ProgressEvent, 10)); err == nil {
+		t.Error("Expected a run with a single stem to fail")
+	}
+	if _, ok := StemDir("track1"); ok {
+		t.Error("Expected no stems after a failed run")
+	}
+}
+
+func TestPullProgressCountsLayers(t *testing.T) {
+	progress := newPullProgress()
+	output := `latest: Pulling from xserrat/facebook-demucs
+a1: Already exists
+b2: Pulling fs layer
+c3: Pulling fs layer
+d4: Pulling fs layer
+b2: Waiting
+c3: Download complete
+b2: Verifying Checksum
+b2: Download complete
+b2: Pull complete
+c3: Extracting`
+	for _, line := range strings.Split(output, "\n") {
+		progress.update(line)
+	}
+
+	// a1 and b2 are done, c3 is downloaded, d4 hasn't started: (2+2+1+0)/8
+	percent, complete, total := progress.snapshot()
+	if percent != 62 || complete != 2 || total != 4 {
+		t.Errorf("Expected 62%% with 2/4 layers complete, got %d%% with %d/%d", percent, complete, total)
+	}
+
+	for _, line := range []string{"c3: Pull complete", "d4: Pull complete", "Digest: sha256:abc", "Status: Downloaded newer image for xserrat/facebook-demucs:latest"} {
+		progress.update(line)
+	}
+	if percent, complete, total := progress.snapshot(); percent != 100 || complete != 4 || total != 4 {
+		t.Errorf("Expected 100%% with 4/4 layers complete, got %d%% with %d/%d", percent, complete, total)
+	}
+}
+
+func TestDemucsExitErrorDetectsOOM(t *testing.T) {
+	killed := exec.Command("sh", "-c", "exit 137").Run()
+	if err := demucsExitError(killed); !errors.Is(err, ErrDemucsOutOfMemory) {
+		t.Errorf("Expected an out-of-memory error for exit 137, got %v", err)
+	}
+
+	failed := exec.Command("sh", "-c", "exit 1").Run()
+	if err := demucsExitError(failed); errors.Is(err, ErrDemucsOutOfMemory) {
+		t.Errorf("Expected a generic failure for exit 1, got %v", err)
+	}
+}
+
+func TestDemucsProgressIsMonotonic(t *testing.T) {
+	// Two sub-models: the bag notice overrides the table's count for "htdemucs_ft"
+	bar := func(pct int, timing string) string {
+		return fmt.Sprintf("%3d%%|████      | 58.5/117.0 [%s, 2.1seconds/s]", pct, timing)
+	}
+	tests := []struct {
+		line      string
+		want      float64 // -1 means not a progress line
+		remaining int
+	}{
+		{"Selected model is a bag of 2 models. You will see that many progress bars per track.", -1, 0},
+		{"Separated tracks will be stored in /songs/t1", -1, 0},
+		{bar(0, "00:00<?"), 0, 0},
+		{bar(50, "00:30<00:30"), 25, 30 + 60},
+		{"\x1b[32m" + bar(100, "01:00<00:00") + "\x1b[0m", 50, 60},
+		{bar(0, "00:00<?"), 50, 0},
+		{bar(40, "00:20<00:30"), 70, 30},
+		{bar(30, "00:25<00:40"), 70, 40}, // Stray dip stays on the same sub-model and never moves backwards
+		{bar(100, "01:00<00:00"), 100, 0},
+		{bar(0, "00:00<?"), 100, 0}, // Extra bars past the bag size don't overshoot
+	}
+
+	state := NewDemucsProgressState("t1", models.SeparationOptions{Model: "htdemucs_ft"})
+	for i, tt := range tests {
+		got, ok := ParseDemucsProgressLine(tt.line, state)
+		if tt.want < 0 {
+			if ok {
+				t.Errorf("Line %d: expected no progress from %q, got %+v", i, tt.line, got)
+			}
+			continue
+		}
+		if !ok {
+			t.Fatalf("Line %d: expected progress from %q", i, tt.line)
+		}
+		if got.Progress != tt.want || got.RemainingSeconds != tt.remaining {
+			t.Errorf("Line %d: got %.1f%% (%ds left), want %.1f%% (%ds left)",
+				i, got.Progress, got.RemainingSeconds, tt.want, tt.remaining)
+		}
+	}
+}
+
+func TestParseDemucsProgressLine(t *testing.T) {
+	tests := []struct {
+		name  string
+		line  string
+		ok    bool
+		want  float64
+		stage string
+	}{
+		{"plain bar", " 42%|████▏     | 49.1/117.0 [00:21<00:30, 2.3seconds/s]", true, 42, "model 1 of 1"},
+		{"ansi codes", "\x1b[1m\x1b[32m 73%|███████▎  | 85.4/117.0\x1b[0m", true, 73, "model 1 of 1"},
+		{"no percentage", "Separated tracks will be stored in /songs/t1/htdemucs", false, 0, ""},
+		{"percentage mid-line", "Using 50% of available memory", false, 0, ""},
+		{"blank", "", false, 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ParseDemucsProgressLine(tt.line, NewDemucsProgressState("t1", models.SeparationOptions{Model: "htdemucs"}))
+			if ok != tt.ok {
+				t.Fatalf("Expected ok=%v, got %v (%+v)", tt.ok, ok, got)
+			}
+			if !ok {
+				return
+			}
+			if got.TrackID != "t1" || got.Type != "demucs" || got.Status != "processing" {
+				t.Errorf("Unexpected event fields: %+v", got)
+			}
+			if got.Progress != tt.want || got.Stage != tt.stage {
+				t.Errorf("Expected %.0f%% at %q, got %.1f%% at %q", tt.want, tt.stage, got.Progress, got.Stage)
+			}
+		})
+	}
+}
+
+func TestParseDemucsProgressLineModelTransition(t *testing.T) {
+	// htdemucs_ft is a bag of four: each bar's reset to 0% starts the next sub-model
+	state := NewDemucsProgressState("t1", models.SeparationOptions{Model: "htdemucs_ft"})
+	steps := []struct {
+		pct      int
+		progress float64
+		stage    string
+	}{
+		{80, 20, "model 1 of 4"},
+		{100, 25, "model 1 of 4"},
+		{0, 25, "model 2 of 4"},
+		{60, 40, "model 2 of 4"},
+		{3, 50.75, "model 3 of 4"},
+	}
+	for _, step := range steps {
+		got, ok := ParseDemucsProgressLine(fmt.Sprintf("%d%%|", step.pct), state)
+		if !ok {
+			t.Fatalf("Expected progress from a %d%% bar", step.pct)
+		}
+		if got.Progress != step.progress || got.Stage != step.stage {
+			t.Errorf("%d%% bar: expected %.0f%% at %q, got %.1f%% at %q",
+				step.pct, step.progress, step.stage, got.Progress, got.Stage)
+		}
+	}
+}
+
+func TestParseDemucsProgressLineCountsShiftBars(t *testing.T) {
+	// Each shift gets its own bar, so two shifts of one model run two bars
+	state := NewDemucsProgressState("t1", models.SeparationOptions{Model: "htdemucs", Shifts: 2})
+	steps := []struct {
+		line     string
+		progress float64
+		stage    string
+	}{
+		{"100%|██████████| 117.0/117.0 [01:00<00:00, 1.9seconds/s]", 50, "model 1 of 1"},
+		{"  0%|          | 0.0/117.0 [00:00<?, ?seconds/s]", 50, "model 1 of 1"},
+		{" 50%|█████     | 58.5/117.0 [00:30<00:30, 1.9seconds/s]", 75, "model 1 of 1"},
+		{"100%|██████████| 117.0/117.0 [01:00<00:00, 1.9seconds/s]", 100, "model 1 of 1"},
+	}
+	for _, step := range steps {
+		got, ok := ParseDemucsProgressLine(step.line, state)
+		if !ok {
+			t.Fatalf("Expected progress from %q", step.line)
+		}
+		if got.Progress != step.progress || got.Stage != step.stage {
+			t.Errorf("%q: expected %.0f%% at %q, got %.1f%% at %q", step.line, step.progress, step.stage, got.Progress, got.Stage)
+		}
+	}
+}
+
+func TestValidateSeparationOptionsQuality(t *testing.T) {
+	valid := []models.SeparationOptions{{}, {Shifts: 10, Overlap: 0.5}}
+	for _, opts := range valid {
+		if err := ValidateSeparationOptions(opts); err != nil {
+			t.Errorf("Expected %+v to be valid, got %v", opts, err)
+		}
+	}
+	invalid := []models.SeparationOptions{{Shifts: -1}, {Shifts: maxShifts + 1}, {Overlap: 1}, {Overlap: -0.1}}
+	for _, opts := range invalid {
+		if err := ValidateSeparationOptions(opts); err == nil {
+			t.Errorf("Expected %+v to be rejected", opts)
+		}
+	}
+}
+
+func TestScanProgressLinesSplitsCarriageReturns(t *testing.T) {
+	// tqdm redraws with bare carriage returns and only ends the bar with a newline
+	output := "  0%|          | 0.0/117.0\r 50%|█████     | 58.5/117.0\r100%|██████████| 117.0/117.0\n" +
+		"Separated tracks will be stored in /songs/t1"
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	scanner.Split(scanProgressLines)
+	state := NewDemucsProgressState("t1", models.SeparationOptions{Model: "htdemucs"})
+	var lines int
+	var progress []float64
+	for scanner.Scan() {
+		lines++
+		if event, ok := ParseDemucsProgressLine(scanner.Text(), state); ok {
+			progress = append(progress, event.Progress)
+		}
+	}
+	if lines != 4 {
+		t.Errorf("Expected 4 lines, got %d", lines)
+	}
+	if !slices.Equal(progress, []float64{0, 50, 100}) {
+		t.Errorf("Expected progress [0 50 100], got %v", progress)
+	}
+}
+
+func TestRemoveStemsKeepsBaseAudio(t *testing.T) {
+	useTempSongsDir(t)
+
+	dir := TrackDir("purge1")
+	for rel, size := range map[string]int{
+		"base.mp3":                  100,
+		"htdemucs/base/vocals.wav":  40,
+		"htdemucs/base/drums.wav":   60,
+		"mdx_extra_q/base/bass.wav": 5,
+	} {
+		path := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	freed, err := RemoveStems("purge1")
+	if err != nil {
+		t.Fatalf("RemoveStems failed: %v", err)
+	}
+	if freed != 105 {
+		t.Errorf("Expected 105 bytes freed, got %d", freed)
+	}
+	if _, err := os.Stat(BaseAudioPath("purge1")); err != nil {
+		t.Errorf("Expected base.mp3 to be kept: %v", err)
+	}
+	if HasDemucsOutput("purge1") {
+		t.Error("Expected no stems after purging")
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("Expected only base.mp3 to remain, got %d entries", len(entries))
+	}
+}
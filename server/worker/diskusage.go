@@ -0,0 +1,79 @@
+package worker
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TrackDiskUsage is the space one track's files take up
+type TrackDiskUsage struct {
+	BaseBytes  int64 // Downloaded audio
+	StemBytes  int64 // Demucs stems of every model the track was separated with
+	TotalBytes int64 // Everything in the track's directory, leftovers included
+}
+
+// ScanDiskUsage walks the songs directory and returns the usage of each track
+// directory in it, keyed by track ID. A missing songs directory is empty.
+func ScanDiskUsage() (map[string]TrackDiskUsage, error) {
+	entries, err := os.ReadDir(songsDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return map[string]TrackDiskUsage{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	usage := make(map[string]TrackDiskUsage, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		trackUsage, err := scanTrackDir(filepath.Join(songsDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		usage[entry.Name()] = trackUsage
+	}
+	return usage, nil
+}
+
+// scanTrackDir sums the regular files under one track directory. Stems are the
+// .wav files in its subdirectories: demucs/, or {model}/base/ for tracks
+// separated before that layout.
+func scanTrackDir(dir string) (TrackDiskUsage, error) {
+	var usage TrackDiskUsage
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// A file removed mid-scan (e.g. by a redownload) is simply not counted
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+
+		size := info.Size()
+		usage.TotalBytes += size
+		rel, _ := filepath.Rel(dir, path)
+		switch {
+		case rel == "base.mp3":
+			usage.BaseBytes += size
+		case filepath.Ext(rel) == ".wav" && strings.Contains(rel, string(filepath.Separator)):
+			usage.StemBytes += size
+		}
+		return nil
+	})
+	return usage, err
+}
@@ -0,0 +1,50 @@
+package worker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScanDiskUsage(t *testing.T) {
+	useTempSongsDir(t)
+
+	usage, err := ScanDiskUsage()
+	if err != nil || len(usage) != 0 {
+		t.Fatalf("Expected no usage before the songs directory exists, got %v, %v", usage, err)
+	}
+
+	write := func(rel string, size int) {
+		t.Helper()
+		path := filepath.Join(SongsDir(), rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("track1/base.mp3", 100)
+	write("track1/htdemucs/base/vocals.wav", 40)
+	write("track1/htdemucs/base/no_vocals.wav", 60)
+	write("track1/mdx_extra_q/base/drums.wav", 5)
+	write("track1/base.mp3.part", 7)
+	write("track2/base.mp3", 30)
+
+	usage, err = ScanDiskUsage()
+	if err != nil {
+		t.Fatalf("ScanDiskUsage failed: %v", err)
+	}
+	want := map[string]TrackDiskUsage{
+		"track1": {BaseBytes: 100, StemBytes: 105, TotalBytes: 212},
+		"track2": {BaseBytes: 30, TotalBytes: 30},
+	}
+	if len(usage) != len(want) {
+		t.Errorf("Expected %d tracks, got %v", len(want), usage)
+	}
+	for id, w := range want {
+		if usage[id] != w {
+			t.Errorf("%s: expected %+v, got %+v", id, w, usage[id])
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package worker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pullLogInterval is how often "docker pull" progress is logged
+const pullLogInterval = 5 * time.Second
+
+// Layer states in "docker pull" output, in the order a layer goes through them
+const (
+	layerPending    = iota // Pulling fs layer, Waiting, Downloading
+	layerDownloaded        // Download complete, Extracting
+	layerComplete          // Pull complete, Already exists
+)
+
+// pullProgress tracks "docker pull" output. Without a terminal docker prints no
+// byte counts, only a line per layer state change ("<layer>: Pulling fs layer",
+// "<layer>: Download complete", "<layer>: Pull complete", ...), so progress is
+// measured in layers, with a downloaded layer counting as half done.
+type pullProgress struct {
+	mu     sync.Mutex
+	layers map[string]int // Layer ID -> state
+}
+
+func newPullProgress() *pullProgress {
+	return &pullProgress{layers: make(map[string]int)}
+}
+
+// update records one line of pull output
+func (p *pullProgress) update(line string) {
+	layer, status, ok := strings.Cut(strings.TrimSpace(line), ": ")
+	if !ok || strings.ContainsAny(layer, " \t") || layer == "Digest" || layer == "Status" ||
+		strings.HasPrefix(status, "Pulling from ") {
+		// Not a layer line: "latest: Pulling from ...", the digest, the summary
+		return
+	}
+	state := layerPending
+	switch status {
+	case "Already exists", "Pull complete":
+		state = layerComplete
+	case "Download complete", "Verifying Checksum", "Extracting":
+		state = layerDownloaded
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if current, known := p.layers[layer]; !known || state > current {
+		p.layers[layer] = state
+	}
+}
+
+// snapshot returns the overall percentage and the finished and known layer counts
+func (p *pullProgress) snapshot() (percent, complete, total int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sum := 0
+	for _, state := range p.layers {
+		sum += state
+		if state == layerComplete {
+			complete++
+		}
+	}
+	total = len(p.layers)
+	if total > 0 {
+		percent = sum * 100 / (total * layerComplete)
+	}
+	return percent, complete, total
+}
+
+// pullImage runs "docker pull image", logging its progress through slog every
+// pullLogInterval instead of passing docker's raw output through. Docker can
+// go minutes without printing anything while a large layer downloads, so the
+// periodic line also shows the pull hasn't hung.
+func pullImage(image string) error {
+	cmd := execCommand(context.Background(), "docker", "pull", image)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	slog.Info("Pulling Docker image", "image", image)
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	progress := newPullProgress()
+	scanned := make(chan struct{})
+	go func() {
+		defer close(scanned)
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			progress.update(scanner.Text())
+		}
+	}()
+
+	ticker := time.NewTicker(pullLogInterval)
+	defer ticker.Stop()
+	for done := false; !done; {
+		select {
+		case <-scanned:
+			done = true
+		case <-ticker.C:
+			percent, complete, total := progress.snapshot()
+			slog.Info("Pulling Docker image", "image", image, "percent", percent,
+				"layers_complete", complete, "layers_total", total,
+				"elapsed", time.Since(start).Round(time.Second))
+		}
+	}
+
+	if err := cmd.Wait(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%w: %s", err, msg)
+		}
+		return err
+	}
+	_, _, total := progress.snapshot()
+	slog.Info("Pulled Docker image", "image", image, "layers", total,
+		"elapsed", time.Since(start).Round(time.Second))
+	return nil
+}
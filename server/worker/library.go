@@ -0,0 +1,95 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"separate/server/models"
+)
+
+// libraryDir, when set, gets a browsable {artist}/{album}/{title}.mp3 tree of
+// symlinks to the downloads. songsDir stays the canonical storage; the library
+// only points into it, so removing it loses nothing.
+var libraryDir string
+
+// SetLibraryDir resolves dir to an absolute path and links each completed
+// download under it. An empty dir disables the library. Call once at startup.
+func SetLibraryDir(dir string) error {
+	if dir == "" {
+		libraryDir = ""
+		return nil
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve library directory %q: %w", dir, err)
+	}
+	libraryDir = absDir
+	return nil
+}
+
+// LibraryDir returns the readable library directory, or "" if it is disabled
+func LibraryDir() string {
+	return libraryDir
+}
+
+// libraryPath returns where a track goes in the library, before any collision
+// handling
+func libraryPath(track models.TrackMetadata) string {
+	var artist string
+	if len(track.Artists) > 0 {
+		artist = track.Artists[0]
+	}
+	return filepath.Join(libraryDir,
+		safePathComponent(artist, "Unknown Artist"),
+		safePathComponent(track.Album, "Unknown Album"),
+		safePathComponent(track.Name, track.ID)+".mp3")
+}
+
+// safePathComponent is SanitizeFilename with a fallback for names that
+// sanitize to nothing
+func safePathComponent(name, fallback string) string {
+	if name = SanitizeFilename(name); name == "" {
+		return fallback
+	}
+	return name
+}
+
+// linkIntoLibrary links a track's downloaded audio into the library. Linking is
+// idempotent: a link already pointing at the track is kept. If another track
+// with the same artist, album and title holds the name, the track ID is added
+// to tell them apart.
+func linkIntoLibrary(track models.TrackMetadata) error {
+	if libraryDir == "" {
+		return nil
+	}
+	target := BaseAudioPath(track.ID)
+	linkPath := libraryPath(track)
+	if err := os.MkdirAll(filepath.Dir(linkPath), 0755); err != nil {
+		return fmt.Errorf("failed to create library directory: %w", err)
+	}
+
+	err := placeLink(target, linkPath)
+	if errors.Is(err, fs.ErrExist) {
+		err = placeLink(target, strings.TrimSuffix(linkPath, ".mp3")+" ("+track.ID+").mp3")
+	}
+	return err
+}
+
+// placeLink symlinks linkPath to target. It returns fs.ErrExist if linkPath is
+// taken by something other than a link to target.
+func placeLink(target, linkPath string) error {
+	if existing, err := os.Readlink(linkPath); err == nil && existing == target {
+		return nil
+	}
+	if err := os.Symlink(target, linkPath); err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return fmt.Errorf("%s: %w", linkPath, fs.ErrExist)
+		}
+		return fmt.Errorf("failed to link %s into library: %w", target, err)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package worker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"separate/server/models"
+)
+
+func TestLinkIntoLibrary(t *testing.T) {
+	useTempSongsDir(t)
+	original := libraryDir
+	if err := SetLibraryDir(filepath.Join(t.TempDir(), "library")); err != nil {
+		t.Fatalf("SetLibraryDir failed: %v", err)
+	}
+	t.Cleanup(func() { libraryDir = original })
+
+	writeBase := func(id string) {
+		if err := os.MkdirAll(TrackDir(id), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(BaseAudioPath(id), []byte(id), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readLink := func(path string) string {
+		t.Helper()
+		target, err := os.Readlink(path)
+		if err != nil {
+			t.Fatalf("Expected a library link at %s: %v", path, err)
+		}
+		return target
+	}
+
+	track := models.TrackMetadata{ID: "track1", Name: "Back In Black", Artists: []string{"AC/DC"}, Album: "Back In Black"}
+	writeBase(track.ID)
+	if err := linkIntoLibrary(track); err != nil {
+		t.Fatalf("linkIntoLibrary failed: %v", err)
+	}
+	path := filepath.Join(LibraryDir(), "AC_DC", "Back In Black", "Back In Black.mp3")
+	if target := readLink(path); target != BaseAudioPath(track.ID) {
+		t.Errorf("Expected the link to point at %s, got %s", BaseAudioPath(track.ID), target)
+	}
+
+	// Relinking the same track (e.g. after a redownload) keeps the link
+	if err := linkIntoLibrary(track); err != nil {
+		t.Fatalf("Relinking failed: %v", err)
+	}
+
+	// A different recording with the same names gets its ID added
+	other := track
+	other.ID = "track2"
+	writeBase(other.ID)
+	if err := linkIntoLibrary(other); err != nil {
+		t.Fatalf("linkIntoLibrary failed: %v", err)
+	}
+	otherPath := filepath.Join(LibraryDir(), "AC_DC", "Back In Black", "Back In Black (track2).mp3")
+	if target := readLink(otherPath); target != BaseAudioPath(other.ID) {
+		t.Errorf("Expected the link to point at %s, got %s", BaseAudioPath(other.ID), target)
+	}
+	if target := readLink(path); target != BaseAudioPath(track.ID) {
+		t.Errorf("Expected the first track's link to be untouched, got %s", target)
+	}
+}
+
+func TestLibraryPathFallbacks(t *testing.T) {
+	original := libraryDir
+	libraryDir = "/library"
+	t.Cleanup(func() { libraryDir = original })
+
+	got := libraryPath(models.TrackMetadata{ID: "track1", Name: "..", Album: "  "})
+	want := filepath.Join("/library", "Unknown Artist", "Unknown Album", "track1.mp3")
+	if got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}
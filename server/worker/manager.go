@@ -1,126 +1,486 @@
 package worker
 
 import (
-	"log"
-	"path/filepath"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"separate/server/core"
 	"separate/server/db"
 	"separate/server/models"
 )
 
+// ErrCancelled is the failure recorded when a user cancels a running job
+var ErrCancelled = errors.New("cancelled by user")
+
+// DefaultMaxAttempts is how many times a job runs before retries stop
+const DefaultMaxAttempts = 3
+
+// sendProgress passes an intermediate progress event to the broadcaster without
+// waiting. When its buffer is full the event is dropped: the next update
+// supersedes it, and stalling here would stall the yt-dlp or demucs output
+// reader and with it the subprocess. Events that change a track's state are
+// sent by the WorkerManager through ProgressBroadcaster.SendEvent, which waits.
+func sendProgress(progressChan chan<- models.ProgressEvent, event models.ProgressEvent) {
+	select {
+	case progressChan <- event:
+	default:
+	}
+}
+
+// activeJob is a job currently held by a worker
+type activeJob struct {
+	jobType string // "download" or "demucs"
+	cancel  context.CancelFunc
+}
+
+// JobCounts tallies jobs finished since the server started
+type JobCounts struct {
+	DownloadsCompleted int64
+	DownloadsFailed    int64
+	DemucsCompleted    int64
+	DemucsFailed       int64
+}
+
 type WorkerManager struct {
-	db          *db.DB
-	progress    *core.ProgressBroadcaster
-	demucsQueue chan *models.DemucsJob
+	db            *db.DB
+	progress      *core.ProgressBroadcaster
+	demucsQueue   chan *models.DemucsJob
+	downloadQueue *DownloadQueue // Set by StartWorkers; transient failures are retried through it
+
+	// activeMu guards active, the registry of tracks currently held by a worker,
+	// and queuedDemucs, the tracks with separations waiting on demucsQueue
+	activeMu     sync.Mutex
+	active       map[string]*activeJob // keyed by track ID
+	queuedDemucs map[string]int        // track ID -> jobs not yet picked up
+
+	playlistLimit *playlistLimiter
+	autoDemucs    bool
+	maxAttempts   int
+
+	downloadsCompleted atomic.Int64
+	downloadsFailed    atomic.Int64
+	demucsCompleted    atomic.Int64
+	demucsFailed       atomic.Int64
 }
 
 func NewWorkerManager(db *db.DB, progress *core.ProgressBroadcaster, demucsQueue chan *models.DemucsJob) *WorkerManager {
 	return &WorkerManager{
-		db:          db,
-		progress:    progress,
-		demucsQueue: demucsQueue,
+		db:           db,
+		progress:     progress,
+		demucsQueue:  demucsQueue,
+		active:       make(map[string]*activeJob),
+		queuedDemucs: make(map[string]int),
+
+		playlistLimit: newPlaylistLimiter(0),
+		autoDemucs:    true,
+		maxAttempts:   DefaultMaxAttempts,
+	}
+}
+
+// SetMaxDownloadsPerPlaylist caps how many downloads one playlist may run at
+// once, so a large playlist can't starve those queued after it. Zero (the
+// default) is unlimited. Call it before StartWorkers.
+func (wm *WorkerManager) SetMaxDownloadsPerPlaylist(n int) {
+	wm.playlistLimit = newPlaylistLimiter(n)
+}
+
+// SetAutoDemucs sets whether completed downloads are queued for separation
+// (the default) or left pending until separated on demand. Jobs may override
+// it. Call it before StartWorkers.
+func (wm *WorkerManager) SetAutoDemucs(enabled bool) {
+	wm.autoDemucs = enabled
+}
+
+// AutoDemucs reports whether completed downloads are queued for separation by
+// default
+func (wm *WorkerManager) AutoDemucs() bool {
+	return wm.autoDemucs
+}
+
+// SetMaxAttempts sets how many times a job may run before it is failed for good
+// and retries need forcing. Call it before StartWorkers.
+func (wm *WorkerManager) SetMaxAttempts(n int) {
+	wm.maxAttempts = n
+}
+
+// MaxAttempts returns how many times a job may run before retries stop
+func (wm *WorkerManager) MaxAttempts() int {
+	return wm.maxAttempts
+}
+
+// failureMessage is the error recorded for a failed job. On its last attempt
+// the message says the job was given up on, so it isn't mistaken for one that
+// a retry might fix.
+func (wm *WorkerManager) failureMessage(err error, attempt int) string {
+	if attempt >= wm.maxAttempts && !errors.Is(err, ErrCancelled) {
+		return fmt.Sprintf("gave up after %d attempts: %v", attempt, err)
+	}
+	return err.Error()
+}
+
+// beginAttempt marks a job in_progress and returns which attempt this is
+func (wm *WorkerManager) beginAttempt(trackID, jobType string) int {
+	attempt, err := wm.db.BeginAttempt(trackID, jobType)
+	if err != nil {
+		slog.Warn("Failed to record attempt", "worker_type", jobType, "track_id", trackID, "error", err)
+	}
+	return attempt
+}
+
+// IsActive reports whether a worker is currently processing the track
+func (wm *WorkerManager) IsActive(trackID string) bool {
+	wm.activeMu.Lock()
+	defer wm.activeMu.Unlock()
+	_, ok := wm.active[trackID]
+	return ok
+}
+
+// HasJob reports whether a worker is processing trackID or holds its download
+// parked until its playlist has a free slot. Jobs still on a DownloadQueue are
+// not covered; see DownloadQueue.Position.
+func (wm *WorkerManager) HasJob(trackID string) bool {
+	return wm.IsActive(trackID) || wm.playlistLimit.isParked(trackID)
+}
+
+// HasDemucsJob reports whether a separation for trackID is waiting on the
+// Demucs queue or running.
+func (wm *WorkerManager) HasDemucsJob(trackID string) bool {
+	wm.activeMu.Lock()
+	defer wm.activeMu.Unlock()
+	if wm.queuedDemucs[trackID] > 0 {
+		return true
+	}
+	job, ok := wm.active[trackID]
+	return ok && job.jobType == "demucs"
+}
+
+// ActiveJobs returns the tracks a worker is processing right now, mapped to
+// "download" or "demucs". Unlike in_progress in the database, this never
+// includes jobs orphaned by a crash.
+func (wm *WorkerManager) ActiveJobs() map[string]string {
+	wm.activeMu.Lock()
+	defer wm.activeMu.Unlock()
+	jobs := make(map[string]string, len(wm.active))
+	for trackID, job := range wm.active {
+		jobs[trackID] = job.jobType
+	}
+	return jobs
+}
+
+// JobCounts returns how many jobs have finished since start
+func (wm *WorkerManager) JobCounts() JobCounts {
+	return JobCounts{
+		DownloadsCompleted: wm.downloadsCompleted.Load(),
+		DownloadsFailed:    wm.downloadsFailed.Load(),
+		DemucsCompleted:    wm.demucsCompleted.Load(),
+		DemucsFailed:       wm.demucsFailed.Load(),
+	}
+}
+
+// DemucsQueueDepth returns the number of Demucs jobs waiting for a worker
+func (wm *WorkerManager) DemucsQueueDepth() int {
+	return len(wm.demucsQueue)
+}
+
+// QueueDemucs enqueues a Demucs separation job
+func (wm *WorkerManager) QueueDemucs(job *models.DemucsJob) {
+	wm.activeMu.Lock()
+	wm.queuedDemucs[job.Track.ID]++
+	wm.activeMu.Unlock()
+	wm.demucsQueue <- job
+}
+
+// Cancel stops the running job for a track. It reports false if no worker holds the track.
+func (wm *WorkerManager) Cancel(trackID string) bool {
+	wm.activeMu.Lock()
+	defer wm.activeMu.Unlock()
+	job, ok := wm.active[trackID]
+	if ok {
+		job.cancel()
+	}
+	return ok
+}
+
+// markActive registers a job and returns the context that cancels it. A Demucs
+// job leaves the queued set in the same step, so HasDemucsJob never misses it.
+func (wm *WorkerManager) markActive(trackID, jobType string) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	wm.activeMu.Lock()
+	wm.active[trackID] = &activeJob{jobType: jobType, cancel: cancel}
+	if jobType == "demucs" && wm.queuedDemucs[trackID] > 0 {
+		if wm.queuedDemucs[trackID]--; wm.queuedDemucs[trackID] == 0 {
+			delete(wm.queuedDemucs, trackID)
+		}
+	}
+	wm.activeMu.Unlock()
+	return ctx
+}
+
+func (wm *WorkerManager) markInactive(trackID string) {
+	wm.activeMu.Lock()
+	if job, ok := wm.active[trackID]; ok {
+		job.cancel()
+		delete(wm.active, trackID)
+	}
+	wm.activeMu.Unlock()
+}
+
+// failTrack marks a job failed in the database and notifies clients
+func (wm *WorkerManager) failTrack(trackID, jobType, message string) {
+	if jobType == "demucs" {
+		wm.demucsFailed.Add(1)
+		wm.db.UpdateDemucsStatus(trackID, "failed", message)
+	} else {
+		wm.downloadsFailed.Add(1)
+		wm.db.UpdateDownloadStatus(trackID, "failed", message)
+	}
+
+	wm.progress.SendEvent(models.ProgressEvent{
+		TrackID:  trackID,
+		Type:     jobType,
+		Status:   "failed",
+		Progress: 0,
+		Error:    message,
+	})
+}
+
+// StartWorkers launches the download and Demucs worker pools
+func (wm *WorkerManager) StartWorkers(downloadQueue *DownloadQueue, numDownloadWorkers, numDemucsWorkers int) {
+	wm.downloadQueue = downloadQueue
+	for i := 0; i < numDownloadWorkers; i++ {
+		go wm.DownloadWorker(downloadQueue)
+	}
+	slog.Info("Started workers", "worker_type", "download", "count", numDownloadWorkers)
+
+	for i := 0; i < numDemucsWorkers; i++ {
+		go wm.DemucsWorker(wm.demucsQueue)
 	}
+	slog.Info("Started workers", "worker_type", "demucs", "count", numDemucsWorkers)
+
+	go wm.watchPlaylistProgress()
 }
 
-// DownloadWorker processes download jobs
-func (wm *WorkerManager) DownloadWorker(jobQueue <-chan *models.DownloadJob) {
-	for job := range jobQueue {
-		artistsStr := strings.Join(job.Track.Artists, ", ")
-		log.Printf("Downloading track: %s by %s", job.Track.Name, artistsStr)
+// DownloadWorker processes download jobs until the queue is closed
+func (wm *WorkerManager) DownloadWorker(jobQueue *DownloadQueue) {
+	for {
+		job, ok := jobQueue.Next()
+		if !ok {
+			return
+		}
+		wm.sendQueuePositions(jobQueue)
+		wm.runDownload(job)
+	}
+}
+
+// runDownload processes job if its playlist has a free slot. A playlist at its
+// limit keeps the job for later and the worker moves on. Finishing a job hands
+// its slot straight to the playlist's next parked job, which runs here without
+// acquiring again.
+func (wm *WorkerManager) runDownload(job *models.DownloadJob) {
+	if !wm.playlistLimit.acquire(job) {
+		return
+	}
+	for job != nil {
+		wm.processDownload(job)
+		job = wm.playlistLimit.release(job)
+	}
+}
+
+// queuePositionUpdates bounds how many waiting tracks get a new position each
+// time a download starts. Further back, a track hears again once it moves up.
+const queuePositionUpdates = 20
+
+// sendQueuePositions re-sends "queued" events for the tracks at the front of
+// the queue now that every one of them has moved up a place
+func (wm *WorkerManager) sendQueuePositions(jobQueue *DownloadQueue) {
+	for i, trackID := range jobQueue.Waiting(queuePositionUpdates) {
+		wm.progress.SendEvent(models.ProgressEvent{
+			TrackID:       trackID,
+			Type:          "download",
+			Status:        "queued",
+			QueuePosition: i + 1,
+		})
+	}
+}
+
+// processDownload runs a single download job. A panic fails only this track;
+// the worker goroutine recovers and moves on to the next job.
+func (wm *WorkerManager) processDownload(job *models.DownloadJob) {
+	ctx := wm.markActive(job.Track.ID, "download")
+	defer wm.markInactive(job.Track.ID)
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("Worker panic", "worker_type", "download", "track_id", job.Track.ID, "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+			wm.failTrack(job.Track.ID, "download", fmt.Sprintf("worker panic: %v", r))
+		}
+	}()
+
+	slog.Info("Downloading track", "worker_type", "download", "track_id", job.Track.ID,
+		"track", job.Track.Name, "artists", strings.Join(job.Track.Artists, ", "))
+
+	// Send pending event
+	wm.progress.SendEvent(models.ProgressEvent{
+		TrackID:  job.Track.ID,
+		Type:     "download",
+		Status:   "pending",
+		Progress: 0,
+	})
+
+	// Mark as in_progress in database
+	attempt := wm.beginAttempt(job.Track.ID, "download")
+
+	// A manually pinned video skips the YouTube search
+	sourceURL, err := wm.db.GetSourceURL(job.Track.ID)
+	if err != nil {
+		slog.Warn("Failed to load source URL, searching instead", "worker_type", "download", "track_id", job.Track.ID, "error", err)
+	}
+
+	// Download with progress reporting
+	start := time.Now()
+	video, err := DownloadTrackFromSpotifyWithProgress(ctx, job.Track, sourceURL, wm.progress.Events())
+	elapsed := time.Since(start)
+	wm.db.SetDownloadDuration(job.Track.ID, elapsed)
+	if errors.Is(err, context.Canceled) {
+		err = ErrCancelled
+	}
+
+	if err != nil {
+		slog.Warn("Download failed", "worker_type", "download", "track_id", job.Track.ID,
+			"status", "failed", "attempt", attempt, "duration_ms", elapsed.Milliseconds(), "error", err)
+		wm.downloadsFailed.Add(1)
+		message := wm.failureMessage(err, attempt)
+		wm.db.UpdateDownloadStatus(job.Track.ID, "failed", message)
 
-		// Send pending event
+		// Send failed event
 		wm.progress.SendEvent(models.ProgressEvent{
 			TrackID:  job.Track.ID,
 			Type:     "download",
-			Status:   "pending",
+			Status:   "failed",
 			Progress: 0,
+			Error:    message,
+		})
+		wm.scheduleRetry(job, attempt, err)
+	} else {
+		outputPath := BaseAudioPath(job.Track.ID)
+		slog.Info("Downloaded track", "worker_type", "download", "track_id", job.Track.ID,
+			"status", "completed", "duration_ms", elapsed.Milliseconds(), "path", outputPath)
+		wm.downloadsCompleted.Add(1)
+		if err := wm.db.SetYouTubeMatch(job.Track.ID, video.VideoID, video.Title); err != nil {
+			slog.Warn("Failed to record YouTube match", "worker_type", "download", "track_id", job.Track.ID, "error", err)
+		}
+		wm.db.UpdateDownloadStatus(job.Track.ID, "completed", "")
+
+		// Send completed event
+		wm.progress.SendEvent(models.ProgressEvent{
+			TrackID:  job.Track.ID,
+			Type:     "download",
+			Status:   "completed",
+			Progress: 100,
 		})
 
-		// Mark as in_progress in database
-		wm.db.UpdateDownloadStatus(job.Track.ID, "in_progress", "")
-
-		// Download with progress reporting
-		err := DownloadTrackFromSpotifyWithProgress(job.Track, wm.progress.Events())
-
-		if err != nil {
-			log.Printf("Failed to download %s: %v", job.Track.Name, err)
-			wm.db.UpdateDownloadStatus(job.Track.ID, "failed", err.Error())
-
-			// Send failed event
-			wm.progress.SendEvent(models.ProgressEvent{
-				TrackID:  job.Track.ID,
-				Type:     "download",
-				Status:   "failed",
-				Progress: 0,
-				Error:    err.Error(),
-			})
-		} else {
-			outputPath := filepath.Join("songs", job.Track.ID, "base.mp3")
-			log.Printf("Downloaded: %s → %s", job.Track.Name, outputPath)
-			wm.db.UpdateDownloadStatus(job.Track.ID, "completed", "")
-
-			// Send completed event
-			wm.progress.SendEvent(models.ProgressEvent{
-				TrackID:  job.Track.ID,
-				Type:     "download",
-				Status:   "completed",
-				Progress: 100,
-			})
-
-			// Automatically queue Demucs processing
-			wm.demucsQueue <- &models.DemucsJob{
-				Track:     job.Track,
-				InputPath: outputPath,
-			}
+		// The readable library is a convenience; the download stands without it
+		if err := linkIntoLibrary(job.Track); err != nil {
+			slog.Warn("Failed to add track to library", "worker_type", "download", "track_id", job.Track.ID, "error", err)
 		}
+
+		autoDemucs := wm.autoDemucs
+		if job.AutoDemucs != nil {
+			autoDemucs = *job.AutoDemucs
+		}
+		if !autoDemucs {
+			slog.Debug("Leaving track for on-demand separation", "worker_type", "download", "track_id", job.Track.ID)
+			return
+		}
+
+		// Automatically queue Demucs processing
+		wm.QueueDemucs(&models.DemucsJob{
+			Track:             job.Track,
+			InputPath:         outputPath,
+			SeparationOptions: job.Separation,
+		})
 	}
 }
 
 // DemucsWorker processes Demucs separation jobs
 func (wm *WorkerManager) DemucsWorker(demucsQueue <-chan *models.DemucsJob) {
 	for job := range demucsQueue {
-		artistsStr := strings.Join(job.Track.Artists, ", ")
-		log.Printf("Processing Demucs: %s by %s", job.Track.Name, artistsStr)
+		wm.processDemucs(job)
+	}
+}
 
-		// Send pending event
+// processDemucs runs a single Demucs job. A panic fails only this track;
+// the worker goroutine recovers and moves on to the next job.
+func (wm *WorkerManager) processDemucs(job *models.DemucsJob) {
+	ctx := wm.markActive(job.Track.ID, "demucs")
+	defer wm.markInactive(job.Track.ID)
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("Worker panic", "worker_type", "demucs", "track_id", job.Track.ID, "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+			wm.failTrack(job.Track.ID, "demucs", fmt.Sprintf("worker panic: %v", r))
+		}
+	}()
+
+	slog.Info("Processing Demucs", "worker_type", "demucs", "track_id", job.Track.ID,
+		"track", job.Track.Name, "artists", strings.Join(job.Track.Artists, ", "))
+
+	// Send pending event
+	wm.progress.SendEvent(models.ProgressEvent{
+		TrackID:  job.Track.ID,
+		Type:     "demucs",
+		Status:   "pending",
+		Progress: 0,
+	})
+
+	// Mark as in_progress in database
+	attempt := wm.beginAttempt(job.Track.ID, "demucs")
+
+	// Process with Demucs and progress reporting
+	start := time.Now()
+	err := ProcessTrackWithDemucs(ctx, job, wm.progress.Events())
+	elapsed := time.Since(start)
+	wm.db.SetDemucsDuration(job.Track.ID, elapsed)
+	if errors.Is(err, context.Canceled) {
+		err = ErrCancelled
+	}
+
+	if err != nil {
+		slog.Warn("Demucs failed", "worker_type", "demucs", "track_id", job.Track.ID,
+			"status", "failed", "attempt", attempt, "duration_ms", elapsed.Milliseconds(), "error", err)
+		wm.demucsFailed.Add(1)
+		message := wm.failureMessage(err, attempt)
+		wm.db.UpdateDemucsStatus(job.Track.ID, "failed", message)
+
+		// Send failed event
 		wm.progress.SendEvent(models.ProgressEvent{
 			TrackID:  job.Track.ID,
 			Type:     "demucs",
-			Status:   "pending",
+			Status:   "failed",
 			Progress: 0,
+			Error:    message,
 		})
-
-		// Mark as in_progress in database
-		wm.db.UpdateDemucsStatus(job.Track.ID, "in_progress", "")
-
-		// Process with Demucs and progress reporting
-		err := ProcessTrackWithDemucs(job.Track, job.InputPath, wm.progress.Events())
-
-		if err != nil {
-			log.Printf("Failed to process Demucs for %s: %v", job.Track.Name, err)
-			wm.db.UpdateDemucsStatus(job.Track.ID, "failed", err.Error())
-
-			// Send failed event
-			wm.progress.SendEvent(models.ProgressEvent{
-				TrackID:  job.Track.ID,
-				Type:     "demucs",
-				Status:   "failed",
-				Progress: 0,
-				Error:    err.Error(),
-			})
-		} else {
-			log.Printf("Demucs completed: %s → songs/%s/mdx_extra_q/base/", job.Track.Name, job.Track.ID)
-			wm.db.UpdateDemucsStatus(job.Track.ID, "completed", "")
-
-			// Send completed event
-			wm.progress.SendEvent(models.ProgressEvent{
-				TrackID:  job.Track.ID,
-				Type:     "demucs",
-				Status:   "completed",
-				Progress: 100,
-			})
+	} else {
+		model := job.Model
+		if model == "" {
+			model = "mdx_extra_q"
 		}
+		slog.Info("Demucs completed", "worker_type", "demucs", "track_id", job.Track.ID,
+			"status", "completed", "duration_ms", elapsed.Milliseconds(), "model", model)
+		wm.demucsCompleted.Add(1)
+		wm.db.UpdateDemucsStatus(job.Track.ID, "completed", "")
+
+		// Send completed event
+		wm.progress.SendEvent(models.ProgressEvent{
+			TrackID:  job.Track.ID,
+			Type:     "demucs",
+			Status:   "completed",
+			Progress: 100,
+		})
 	}
 }
@@ -0,0 +1,354 @@
+package worker
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"separate/server/core"
+	"separate/server/db"
+	"separate/server/models"
+)
+
+func TestDownloadWorkerRecoversFromPanic(t *testing.T) {
+	database, err := db.InitDB(filepath.Join(t.TempDir(), "queue.db"))
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer database.Close()
+
+	tracks := []models.TrackMetadata{
+		{ID: "panic1", Name: "First", Artists: []string{"Artist"}},
+		{ID: "panic2", Name: "Second", Artists: []string{"Artist"}},
+	}
+	if err := database.SavePlaylistTracks("playlist", tracks); err != nil {
+		t.Fatalf("SavePlaylistTracks failed: %v", err)
+	}
+
+	// Fake command runner that blows up inside the worker
+	originalExec := execCommand
+	execCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		panic("fake runner exploded")
+	}
+	defer func() { execCommand = originalExec }()
+
+	wm := NewWorkerManager(database, core.NewProgressBroadcaster(), make(chan *models.DemucsJob, 10))
+
+	jobQueue := NewDownloadQueue(len(tracks))
+	for _, track := range tracks {
+		jobQueue.Enqueue(&models.DownloadJob{Track: track})
+	}
+	jobQueue.Close()
+
+	// Returns only if the worker survived the first panic and drained the queue
+	wm.DownloadWorker(jobQueue)
+
+	for _, track := range tracks {
+		state, err := database.GetTrack(track.ID)
+		if err != nil {
+			t.Fatalf("GetTrack(%s) failed: %v", track.ID, err)
+		}
+		if state.DownloadStatus != "failed" {
+			t.Errorf("Expected %s to be failed, got %s", track.ID, state.DownloadStatus)
+		}
+		if !strings.Contains(state.DownloadError, "worker panic") {
+			t.Errorf("Expected worker panic error for %s, got %q", track.ID, state.DownloadError)
+		}
+		if wm.IsActive(track.ID) {
+			t.Errorf("Expected %s to be removed from the active registry", track.ID)
+		}
+	}
+}
+
+func TestCancelStopsRunningDownload(t *testing.T) {
+	database, err := db.InitDB(filepath.Join(t.TempDir(), "queue.db"))
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer database.Close()
+
+	track := models.TrackMetadata{ID: "slow1", Name: "Slow", Artists: []string{"Artist"}}
+	if err := database.SavePlaylistTracks("playlist", []models.TrackMetadata{track}); err != nil {
+		t.Fatalf("SavePlaylistTracks failed: %v", err)
+	}
+
+	// Fake runner: every command hangs until its context is cancelled
+	originalExec := execCommand
+	execCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "sleep", "30")
+	}
+	defer func() { execCommand = originalExec }()
+
+	wm := NewWorkerManager(database, core.NewProgressBroadcaster(), make(chan *models.DemucsJob, 10))
+
+	done := make(chan struct{})
+	go func() {
+		wm.processDownload(&models.DownloadJob{Track: track})
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !wm.IsActive(track.ID) {
+		if time.Now().After(deadline) {
+			t.Fatal("Download never became active")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got := wm.ActiveJobs()[track.ID]; got != "download" {
+		t.Errorf("Expected an active download job, got %q", got)
+	}
+
+	if !wm.Cancel(track.ID) {
+		t.Fatal("Expected Cancel to find the running job")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Download did not stop after cancel")
+	}
+
+	state, err := database.GetTrack(track.ID)
+	if err != nil {
+		t.Fatalf("GetTrack failed: %v", err)
+	}
+	if state.DownloadStatus != "failed" || state.DownloadError != ErrCancelled.Error() {
+		t.Errorf("Expected failed/%q, got %s/%q", ErrCancelled, state.DownloadStatus, state.DownloadError)
+	}
+	if state.DownloadDurationMs == nil {
+		t.Error("Expected the download duration to be recorded")
+	}
+	if wm.Cancel(track.ID) {
+		t.Error("Expected Cancel to report no running job after completion")
+	}
+	if len(wm.ActiveJobs()) != 0 {
+		t.Errorf("Expected no active jobs after completion, got %v", wm.ActiveJobs())
+	}
+}
+
+func TestAutoDemucsCanBeDisabled(t *testing.T) {
+	useTempSongsDir(t)
+	database, err := db.InitDB(filepath.Join(t.TempDir(), "queue.db"))
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer database.Close()
+
+	tracks := []models.TrackMetadata{
+		{ID: "manual1", Name: "Manual", Artists: []string{"Artist"}},
+		{ID: "auto1", Name: "Auto", Artists: []string{"Artist"}},
+	}
+	if err := database.SavePlaylistTracks("playlist", tracks); err != nil {
+		t.Fatalf("SavePlaylistTracks failed: %v", err)
+	}
+
+	originalExec := execCommand
+	execCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		if name == "ffprobe" {
+			return fakeFFprobe(ctx, "audio", "200.0")
+		}
+		return exec.CommandContext(ctx, "true")
+	}
+	defer func() { execCommand = originalExec }()
+
+	demucsQueue := make(chan *models.DemucsJob, 10)
+	wm := NewWorkerManager(database, core.NewProgressBroadcaster(), demucsQueue)
+	wm.SetAutoDemucs(false)
+
+	const sourceURL = "https://www.youtube.com/watch?v=dQw4w9WgXcQ"
+	for _, track := range tracks {
+		if err := database.SetSourceURL(track.ID, sourceURL); err != nil {
+			t.Fatalf("SetSourceURL failed: %v", err)
+		}
+	}
+
+	wm.processDownload(&models.DownloadJob{Track: tracks[0]})
+	if len(demucsQueue) != 0 {
+		t.Fatal("Expected no separation to be queued with AUTO_DEMUCS off")
+	}
+	state, err := database.GetTrack(tracks[0].ID)
+	if err != nil {
+		t.Fatalf("GetTrack failed: %v", err)
+	}
+	if state.DownloadStatus != "completed" || state.DemucsStatus != "pending" {
+		t.Errorf("Expected completed/pending, got %s/%s", state.DownloadStatus, state.DemucsStatus)
+	}
+
+	// A request may still opt in
+	enabled := true
+	wm.processDownload(&models.DownloadJob{Track: tracks[1], AutoDemucs: &enabled})
+	if len(demucsQueue) != 1 || (<-demucsQueue).Track.ID != tracks[1].ID {
+		t.Error("Expected the opted-in track to be queued for separation")
+	}
+}
+
+func TestFailedJobsGiveUpAfterMaxAttempts(t *testing.T) {
+	useTempSongsDir(t)
+	database, err := db.InitDB(filepath.Join(t.TempDir(), "queue.db"))
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer database.Close()
+
+	track := models.TrackMetadata{ID: "unmatched1", Name: "Unmatched", Artists: []string{"Artist"}}
+	if err := database.SavePlaylistTracks("playlist", []models.TrackMetadata{track}); err != nil {
+		t.Fatalf("SavePlaylistTracks failed: %v", err)
+	}
+	if err := database.SetSourceURL(track.ID, "https://www.youtube.com/watch?v=dQw4w9WgXcQ"); err != nil {
+		t.Fatalf("SetSourceURL failed: %v", err)
+	}
+
+	// Every yt-dlp run fails
+	originalExec := execCommand
+	execCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "false")
+	}
+	defer func() { execCommand = originalExec }()
+
+	wm := NewWorkerManager(database, core.NewProgressBroadcaster(), make(chan *models.DemucsJob, 10))
+	wm.SetMaxAttempts(2)
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		wm.processDownload(&models.DownloadJob{Track: track})
+		state, err := database.GetTrack(track.ID)
+		if err != nil {
+			t.Fatalf("GetTrack failed: %v", err)
+		}
+		if state.DownloadStatus != "failed" || state.DownloadAttempts != attempt {
+			t.Fatalf("Expected failed after attempt %d, got %s after %d", attempt, state.DownloadStatus, state.DownloadAttempts)
+		}
+		gaveUp := strings.HasPrefix(state.DownloadError, "gave up after 2 attempts: ")
+		if gaveUp != (attempt == 2) {
+			t.Errorf("Attempt %d: unexpected error %q", attempt, state.DownloadError)
+		}
+	}
+}
+
+func TestDownloadWorkerRunsParkedJobs(t *testing.T) {
+	useTempSongsDir(t)
+	database, err := db.InitDB(filepath.Join(t.TempDir(), "queue.db"))
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer database.Close()
+
+	var jobs []*models.DownloadJob
+	for _, id := range []string{"first1", "parked1", "parked2"} {
+		track := models.TrackMetadata{ID: id, Name: id, Artists: []string{"Artist"}}
+		jobs = append(jobs, &models.DownloadJob{Track: track, PlaylistID: "playlist"})
+		if err := database.SavePlaylistTracks("playlist", []models.TrackMetadata{track}); err != nil {
+			t.Fatalf("SavePlaylistTracks failed: %v", err)
+		}
+	}
+
+	// The first download holds its slot until the others are parked; every
+	// download then fails fast
+	started, unblock := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	originalExec := execCommand
+	execCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		once.Do(func() { close(started) })
+		<-unblock
+		return exec.CommandContext(ctx, "false")
+	}
+	defer func() { execCommand = originalExec }()
+
+	wm := NewWorkerManager(database, core.NewProgressBroadcaster(), make(chan *models.DemucsJob, 10))
+	wm.SetMaxDownloadsPerPlaylist(1)
+
+	jobQueue := NewDownloadQueue(1)
+	jobQueue.Enqueue(jobs[0])
+	jobQueue.Close()
+	done := make(chan struct{})
+	go func() {
+		wm.DownloadWorker(jobQueue)
+		close(done)
+	}()
+
+	<-started
+	// Other workers pick up the rest while the playlist is at its limit
+	wm.runDownload(jobs[1])
+	wm.runDownload(jobs[2])
+	close(unblock)
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected the worker to run the parked jobs and return")
+	}
+	for _, job := range jobs {
+		state, err := database.GetTrack(job.Track.ID)
+		if err != nil {
+			t.Fatalf("GetTrack failed: %v", err)
+		}
+		if state.DownloadAttempts != 1 {
+			t.Errorf("Expected %s to run once, got %d attempts", job.Track.ID, state.DownloadAttempts)
+		}
+	}
+	if len(wm.playlistLimit.running) != 0 || len(wm.playlistLimit.parked) != 0 {
+		t.Errorf("Expected every slot back, got running=%v parked=%v", wm.playlistLimit.running, wm.playlistLimit.parked)
+	}
+}
+
+func TestHasDemucsOutput(t *testing.T) {
+	useTempSongsDir(t)
+
+	if HasDemucsOutput("track1") {
+		t.Error("Expected no output for a missing track directory")
+	}
+
+	stemDir := filepath.Join(TrackDir("track1"), "htdemucs", "base")
+	if err := os.MkdirAll(stemDir, 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	for _, stem := range []string{"vocals.wav", "no_vocals.wav"} {
+		if err := os.WriteFile(filepath.Join(stemDir, stem), []byte("RIFF"), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+
+	if !HasDemucsOutput("track1") {
+		t.Error("Expected stems to be detected")
+	}
+}
+
+func TestStemDirPrefersNewestModel(t *testing.T) {
+	useTempSongsDir(t)
+
+	for i, model := range []string{"mdx_extra", "htdemucs"} {
+		stemDir := filepath.Join(TrackDir("track1"), model, "base")
+		if err := os.MkdirAll(stemDir, 0755); err != nil {
+			t.Fatalf("MkdirAll failed: %v", err)
+		}
+		for _, stem := range []string{"vocals.wav", "no_vocals.wav"} {
+			if err := os.WriteFile(filepath.Join(stemDir, stem), []byte("RIFF"), 0644); err != nil {
+				t.Fatalf("WriteFile failed: %v", err)
+			}
+		}
+		modTime := time.Now().Add(time.Duration(i-2) * time.Hour)
+		if err := os.Chtimes(stemDir, modTime, modTime); err != nil {
+			t.Fatalf("Chtimes failed: %v", err)
+		}
+	}
+
+	dir, ok := StemDir("track1")
+	if !ok || filepath.Base(filepath.Dir(dir)) != "htdemucs" {
+		t.Errorf("Expected the newer htdemucs output, got %q (%v)", dir, ok)
+	}
+}
+
+// useTempSongsDir points the songs directory at a fresh temp directory for the test
+func useTempSongsDir(t *testing.T) {
+	t.Helper()
+	original := songsDir
+	if err := SetSongsDir(filepath.Join(t.TempDir(), "songs")); err != nil {
+		t.Fatalf("SetSongsDir failed: %v", err)
+	}
+	t.Cleanup(func() { songsDir = original })
+}
@@ -0,0 +1,144 @@
+package worker
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// defaultSongsDir is where track files live unless SONGS_DIR says otherwise
+const defaultSongsDir = "songs"
+
+// containerSongsDir is where songsDir is mounted inside the Demucs container
+const containerSongsDir = "/songs"
+
+// songsDir holds one subdirectory per track, laid out as
+//
+//	{id}/base.mp3           downloaded audio
+//	{id}/demucs/{stem}.wav  stems of the latest separation, e.g. vocals.wav
+//	                        or, for two-stem runs, vocals.wav and no_vocals.wav
+//	{id}/demucs.tmp/        Demucs output while a separation runs
+//
+// It is mounted into the Demucs container at containerSongsDir, so the layout
+// must match on both sides.
+var songsDir = defaultSongsDir
+
+const (
+	// stemsDirName holds a track's stems, whatever model produced them
+	stemsDirName = "demucs"
+	// demucsStagingDirName receives Demucs's own {model}/base/ output, which
+	// is moved to stemsDirName once the separation succeeds
+	demucsStagingDirName = "demucs.tmp"
+)
+
+// SetSongsDir resolves dir to an absolute path and uses it for all track files.
+// An empty dir selects the default. Call once at startup, before starting workers.
+func SetSongsDir(dir string) error {
+	if dir == "" {
+		dir = defaultSongsDir
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve songs directory %q: %w", dir, err)
+	}
+	songsDir = absDir
+	return nil
+}
+
+// SongsDir returns the directory holding all track files
+func SongsDir() string {
+	return songsDir
+}
+
+// TrackDir returns the directory holding a track's files
+func TrackDir(trackID string) string {
+	return filepath.Join(songsDir, trackID)
+}
+
+// BaseAudioPath returns where a track's downloaded audio is stored
+func BaseAudioPath(trackID string) string {
+	return filepath.Join(TrackDir(trackID), "base.mp3")
+}
+
+// stemsDir returns where a track's stems are kept
+func stemsDir(trackID string) string {
+	return filepath.Join(TrackDir(trackID), stemsDirName)
+}
+
+// demucsStagingDir returns where Demucs writes while separating a track
+func demucsStagingDir(trackID string) string {
+	return filepath.Join(TrackDir(trackID), demucsStagingDirName)
+}
+
+// containerTrackDir is TrackDir as seen from inside the Demucs container
+func containerTrackDir(trackID string) string {
+	return path.Join(containerSongsDir, trackID)
+}
+
+// containerBaseAudioPath is BaseAudioPath as seen from inside the Demucs container
+func containerBaseAudioPath(trackID string) string {
+	return path.Join(containerTrackDir(trackID), "base.mp3")
+}
+
+// containerDemucsStagingDir is demucsStagingDir as seen from inside the Demucs container
+func containerDemucsStagingDir(trackID string) string {
+	return path.Join(containerTrackDir(trackID), demucsStagingDirName)
+}
+
+// maxFilenameBytes keeps sanitized names well under the usual 255-byte limit,
+// leaving room for an extension or a disambiguating suffix
+const maxFilenameBytes = 200
+
+// reservedWindowsNames can't be used as file names on Windows, with or without
+// an extension
+var reservedWindowsNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// SanitizeFilename turns a Spotify-derived name (track, artist, album) into a
+// single path component that is valid on Linux, macOS and Windows: path
+// separators and other forbidden characters become "_", whitespace runs become
+// one space, leading and trailing dots and spaces go, reserved Windows names
+// get a "_" suffix, and the result is cut to maxFilenameBytes on a character
+// boundary. It returns "" if nothing usable is left, so callers pick a fallback.
+func SanitizeFilename(s string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range s {
+		switch {
+		case r == utf8.RuneError:
+			continue
+		case unicode.IsSpace(r):
+			space = true
+			continue
+		case unicode.IsControl(r) || strings.ContainsRune(`/\:*?"<>|`, r):
+			r = '_'
+		}
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		b.WriteRune(r)
+	}
+
+	// A leading dot hides the file; Windows drops trailing dots and spaces
+	name := strings.Trim(b.String(), ". ")
+	if len(name) > maxFilenameBytes {
+		cut := maxFilenameBytes
+		for cut > 0 && !utf8.RuneStart(name[cut]) {
+			cut--
+		}
+		name = strings.TrimRight(name[:cut], ". ")
+	}
+
+	stem, _, _ := strings.Cut(name, ".")
+	if reservedWindowsNames[strings.ToUpper(strings.TrimSpace(stem))] {
+		name = stem + "_" + strings.TrimPrefix(name, stem)
+	}
+	return name
+}
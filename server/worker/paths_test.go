@@ -0,0 +1,54 @@
+package worker
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "Back In Black", "Back In Black"},
+		{"slashes", "AC/DC", "AC_DC"},
+		{"backslash and colon", `Live: Side A\B`, "Live_ Side A_B"},
+		{"windows forbidden", `What? "Yes" <No> *|`, `What_ _Yes_ _No_ __`},
+		{"emoji kept", "Happy 😀 Song 🎸", "Happy 😀 Song 🎸"},
+		{"whitespace collapsed", "  Lots \t of\n\nspace  ", "Lots of space"},
+		{"control characters", "Tab\x00Null\x1b", "Tab_Null_"},
+		{"dots trimmed", "...hidden.", "hidden"},
+		{"only dots", "..", ""},
+		{"empty", "", ""},
+		{"reserved name", "CON", "CON_"},
+		{"reserved name lower case", "nul", "nul_"},
+		{"reserved name with extension", "aux.mp3", "aux_.mp3"},
+		{"reserved name as prefix", "Console", "Console"},
+		{"invalid utf-8 dropped", "Bad\xffByte", "BadByte"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SanitizeFilename(tt.in); got != tt.want {
+				t.Errorf("SanitizeFilename(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeFilenameTruncatesLongNames(t *testing.T) {
+	got := SanitizeFilename(strings.Repeat("a", 300))
+	if len(got) != maxFilenameBytes {
+		t.Errorf("Expected %d bytes, got %d", maxFilenameBytes, len(got))
+	}
+
+	// Four-byte emoji must not be cut in half
+	got = SanitizeFilename("a" + strings.Repeat("🎸", 100))
+	if len(got) > maxFilenameBytes || !utf8.ValidString(got) {
+		t.Errorf("Expected valid UTF-8 of at most %d bytes, got %d bytes (valid: %v)", maxFilenameBytes, len(got), utf8.ValidString(got))
+	}
+	if !strings.HasSuffix(got, "🎸") {
+		t.Errorf("Expected the cut to fall between emoji, got %q", got[len(got)-4:])
+	}
+}
@@ -0,0 +1,81 @@
+package worker
+
+import (
+	"sync"
+
+	"separate/server/models"
+)
+
+// playlistLimiter is a per-playlist semaphore that stops one large playlist
+// from occupying every download worker. A job whose playlist is at its limit
+// is parked rather than blocking the worker, which moves on to other
+// playlists; the parked job runs as soon as a job of its playlist finishes.
+type playlistLimiter struct {
+	mu      sync.Mutex
+	limit   int // Zero means unlimited
+	running map[string]int
+	parked  map[string][]*models.DownloadJob
+}
+
+func newPlaylistLimiter(limit int) *playlistLimiter {
+	return &playlistLimiter{
+		limit:   limit,
+		running: make(map[string]int),
+		parked:  make(map[string][]*models.DownloadJob),
+	}
+}
+
+// acquire takes a slot for job's playlist. It reports false, keeping the job
+// for later, if the playlist already has limit downloads running. Jobs outside
+// any playlist are never limited.
+func (l *playlistLimiter) acquire(job *models.DownloadJob) bool {
+	if l.limit <= 0 || job.PlaylistID == "" {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.running[job.PlaylistID] >= l.limit {
+		l.parked[job.PlaylistID] = append(l.parked[job.PlaylistID], job)
+		return false
+	}
+	l.running[job.PlaylistID]++
+	return true
+}
+
+// release gives back job's slot. If a job of the same playlist is parked, the
+// slot passes straight to it and it is returned for the caller to run next,
+// without calling acquire: the slot is already its own.
+func (l *playlistLimiter) release(job *models.DownloadJob) *models.DownloadJob {
+	if l.limit <= 0 || job.PlaylistID == "" {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if parked := l.parked[job.PlaylistID]; len(parked) > 0 {
+		next := parked[0]
+		if len(parked) == 1 {
+			delete(l.parked, job.PlaylistID)
+		} else {
+			l.parked[job.PlaylistID] = parked[1:]
+		}
+		return next
+	}
+	if l.running[job.PlaylistID]--; l.running[job.PlaylistID] <= 0 {
+		delete(l.running, job.PlaylistID)
+	}
+	return nil
+}
+
+// isParked reports whether a parked job is waiting to download trackID
+func (l *playlistLimiter) isParked(trackID string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, jobs := range l.parked {
+		for _, job := range jobs {
+			if job.Track.ID == trackID {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package worker
+
+import (
+	"log/slog"
+	"time"
+
+	"separate/server/models"
+)
+
+// playlistProgressDelay is how long playlist totals wait after a track changes
+// state before they are recomputed, so a burst of changes (a batch of retries,
+// workers finishing together) costs one query and one event per playlist
+const playlistProgressDelay = time.Second
+
+// watchPlaylistProgress broadcasts a "playlist" event with a playlist's totals
+// whenever one of its tracks changes state. It runs for the life of the server.
+func (wm *WorkerManager) watchPlaylistProgress() {
+	events := wm.progress.Subscribe(100)
+	changed := make(map[string]bool)
+	var flush <-chan time.Time
+	for {
+		select {
+		case event := <-events:
+			// Percentages within a job don't move the totals
+			if event.Type == "playlist" || event.Status == "downloading" || event.Status == "processing" {
+				continue
+			}
+			changed[event.TrackID] = true
+			if flush == nil {
+				flush = time.After(playlistProgressDelay)
+			}
+		case <-flush:
+			flush = nil
+			trackIDs := make([]string, 0, len(changed))
+			for trackID := range changed {
+				trackIDs = append(trackIDs, trackID)
+			}
+			clear(changed)
+			wm.sendPlaylistProgress(trackIDs)
+		}
+	}
+}
+
+// sendPlaylistProgress broadcasts the totals of every playlist holding one of trackIDs
+func (wm *WorkerManager) sendPlaylistProgress(trackIDs []string) {
+	summaries, err := wm.db.GetPlaylistSummariesForTracks(trackIDs, wm.autoDemucs)
+	if err != nil {
+		slog.Warn("Failed to compute playlist progress", "error", err)
+		return
+	}
+	for _, summary := range summaries {
+		wm.progress.SendEvent(playlistProgressEvent(summary))
+	}
+}
+
+// playlistProgressEvent summarizes a playlist as a "playlist" event. Each track
+// counts as two equal steps, download and separation; a playlist is completed
+// once no track has work left, even if some failed. A track auto-Demucs won't
+// separate is done once downloaded.
+func playlistProgressEvent(summary models.PlaylistSummary) models.ProgressEvent {
+	event := models.ProgressEvent{
+		Type:       "playlist",
+		Status:     "in_progress",
+		PlaylistID: summary.PlaylistID,
+		Completed:  summary.DemucsCompleted + summary.DemucsSkipped,
+		Failed:     summary.DownloadFailed + summary.DemucsFailed,
+		Total:      summary.TrackCount,
+	}
+	if summary.TrackCount > 0 {
+		done := summary.DownloadCompleted + summary.DemucsCompleted + summary.DemucsSkipped
+		event.Progress = float64(done) * 100 / float64(2*summary.TrackCount)
+	}
+	if event.Completed+event.Failed == event.Total {
+		event.Status = "completed"
+	}
+	return event
+}
@@ -0,0 +1,115 @@
+package worker
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"separate/server/core"
+	"separate/server/db"
+	"separate/server/models"
+)
+
+func TestPlaylistProgressEvents(t *testing.T) {
+	database, err := db.InitDB(filepath.Join(t.TempDir(), "queue.db"))
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer database.Close()
+
+	tracks := []models.TrackMetadata{
+		{ID: "agg1", Name: "First", Artists: []string{"Artist"}},
+		{ID: "agg2", Name: "Second", Artists: []string{"Artist"}},
+	}
+	if err := database.SavePlaylistTracks("playlist1", tracks); err != nil {
+		t.Fatalf("SavePlaylistTracks failed: %v", err)
+	}
+	if err := database.SavePlaylistTracks("other", []models.TrackMetadata{{ID: "lone", Name: "Lone"}}); err != nil {
+		t.Fatalf("SavePlaylistTracks failed: %v", err)
+	}
+
+	progress := core.NewProgressBroadcaster()
+	wm := NewWorkerManager(database, progress, make(chan *models.DemucsJob, 1))
+	go wm.watchPlaylistProgress()
+	client := progress.RegisterClient(map[string]bool{"agg1": true, "agg2": true, "playlist1": true})
+	defer progress.UnregisterClient(client)
+
+	nextPlaylistEvent := func() models.ProgressEvent {
+		t.Helper()
+		timeout := time.After(5 * playlistProgressDelay)
+		for {
+			select {
+			case event := <-client:
+				if event.Type == "playlist" {
+					return event
+				}
+			case <-timeout:
+				t.Fatal("Expected a playlist event")
+			}
+		}
+	}
+
+	// One track downloaded and separated, the other downloaded: 3 of 4 steps
+	database.UpdateDownloadStatus("agg1", "completed", "")
+	database.UpdateDemucsStatus("agg1", "completed", "")
+	database.UpdateDownloadStatus("agg2", "completed", "")
+	progress.SendEvent(models.ProgressEvent{TrackID: "agg1", Type: "demucs", Status: "completed", Progress: 100})
+	progress.SendEvent(models.ProgressEvent{TrackID: "agg2", Type: "download", Status: "completed", Progress: 100})
+
+	event := nextPlaylistEvent()
+	want := models.ProgressEvent{Type: "playlist", Status: "in_progress", PlaylistID: "playlist1", Progress: 75, Completed: 1, Total: 2}
+	if event != want {
+		t.Errorf("Expected %+v, got %+v", want, event)
+	}
+
+	// A failed track leaves nothing to wait for
+	database.UpdateDemucsStatus("agg2", "failed", "boom")
+	progress.SendEvent(models.ProgressEvent{TrackID: "agg2", Type: "demucs", Status: "failed", Error: "boom"})
+
+	event = nextPlaylistEvent()
+	want = models.ProgressEvent{Type: "playlist", Status: "completed", PlaylistID: "playlist1", Progress: 75, Completed: 1, Failed: 1, Total: 2}
+	if event != want {
+		t.Errorf("Expected %+v, got %+v", want, event)
+	}
+}
+
+func TestPlaylistCompletesWithoutAutoDemucs(t *testing.T) {
+	database, err := db.InitDB(filepath.Join(t.TempDir(), "queue.db"))
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer database.Close()
+
+	tracks := []models.TrackMetadata{
+		{ID: "plain1", Name: "Plain", Artists: []string{"Artist"}},
+		{ID: "separate1", Name: "Separate", Artists: []string{"Artist"}},
+	}
+	if err := database.SavePlaylistTracks("playlist1", tracks); err != nil {
+		t.Fatalf("SavePlaylistTracks failed: %v", err)
+	}
+	for _, track := range tracks {
+		database.UpdateDownloadStatus(track.ID, "completed", "")
+	}
+	// separate1 asked for separation despite AUTO_DEMUCS=false
+	autoDemucs := true
+	database.SetJobOptions([]string{"separate1"}, models.JobOptions{PlaylistID: "playlist1", AutoDemucs: &autoDemucs})
+
+	progressOf := func() models.ProgressEvent {
+		t.Helper()
+		summaries, err := database.GetPlaylistSummariesForTracks([]string{"plain1"}, false)
+		if err != nil || len(summaries) != 1 {
+			t.Fatalf("Expected one summary, got %v, %v", summaries, err)
+		}
+		return playlistProgressEvent(summaries[0])
+	}
+
+	event := progressOf()
+	if event.Status != "in_progress" || event.Completed != 1 || event.Progress != 75 {
+		t.Errorf("Expected plain1 done and separate1 awaiting separation, got %+v", event)
+	}
+
+	database.UpdateDemucsStatus("separate1", "completed", "")
+	if event := progressOf(); event.Status != "completed" || event.Completed != 2 || event.Progress != 100 {
+		t.Errorf("Expected the playlist to complete, got %+v", event)
+	}
+}
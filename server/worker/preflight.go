@@ -0,0 +1,80 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"separate/server/models"
+)
+
+// requiredTools returns the external programs the workers shell out to
+func requiredTools() []string {
+	if DemucsRunsLocally() {
+		return []string{"yt-dlp", "demucs"}
+	}
+	return []string{"yt-dlp", "docker"}
+}
+
+var (
+	preflightMu      sync.RWMutex
+	preflightResults = map[string]models.DependencyStatus{}
+)
+
+// Preflight runs "<tool> --version" for every required tool and records the
+// results for health reporting. Call once at startup so a missing install is
+// caught before the first job fails with an exec error.
+func Preflight() []models.DependencyStatus {
+	tools := requiredTools()
+	results := make([]models.DependencyStatus, 0, len(tools))
+	for _, tool := range tools {
+		status := models.DependencyStatus{Name: tool, Critical: true}
+		var version string
+		var err error
+		if tool == "demucs" {
+			// demucs has no --version flag; check that the configured command runs
+			err = CheckLocalDemucs(context.Background())
+		} else {
+			version, err = toolVersion(tool)
+		}
+		if err != nil {
+			status.Error = err.Error()
+		} else {
+			status.OK = true
+			status.Version = version
+		}
+		results = append(results, status)
+	}
+
+	preflightMu.Lock()
+	for _, status := range results {
+		preflightResults[status.Name] = status
+	}
+	preflightMu.Unlock()
+	return results
+}
+
+// ToolVersion returns the version Preflight detected for tool, or "" if it
+// wasn't found or Preflight hasn't run
+func ToolVersion(tool string) string {
+	preflightMu.RLock()
+	defer preflightMu.RUnlock()
+	return preflightResults[tool].Version
+}
+
+// toolVersion runs "<tool> --version" and returns the first line of its output
+func toolVersion(tool string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dependencyCheckTimeout)
+	defer cancel()
+
+	output, err := execCommand(ctx, tool, "--version").Output()
+	if err != nil {
+		return "", fmt.Errorf("%s --version failed (is %s installed?): %w", tool, tool, err)
+	}
+	version, _, _ := strings.Cut(strings.TrimSpace(string(output)), "\n")
+	if version == "" {
+		return "", fmt.Errorf("%s --version printed nothing", tool)
+	}
+	return version, nil
+}
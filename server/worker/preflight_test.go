@@ -0,0 +1,37 @@
+package worker
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+)
+
+func TestPreflightRecordsVersionsAndMissingTools(t *testing.T) {
+	originalExec := execCommand
+	execCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		if name == "docker" {
+			return exec.CommandContext(ctx, "docker-is-not-installed-here")
+		}
+		return exec.CommandContext(ctx, "printf", "%s", "2024.08.06\n")
+	}
+	defer func() { execCommand = originalExec }()
+
+	results := Preflight()
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results, got %d", len(results))
+	}
+
+	ytDlp, docker := results[0], results[1]
+	if !ytDlp.OK || ytDlp.Version != "2024.08.06" {
+		t.Errorf("Expected yt-dlp 2024.08.06, got %+v", ytDlp)
+	}
+	if docker.OK || docker.Error == "" || !docker.Critical {
+		t.Errorf("Expected docker to be reported missing, got %+v", docker)
+	}
+	if got := ToolVersion("yt-dlp"); got != "2024.08.06" {
+		t.Errorf("ToolVersion(yt-dlp) = %q", got)
+	}
+	if got := ToolVersion("docker"); got != "" {
+		t.Errorf("ToolVersion(docker) = %q, want empty", got)
+	}
+}
@@ -0,0 +1,67 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"separate/server/models"
+)
+
+// previewConcurrency caps parallel yt-dlp searches so a large playlist preview
+// doesn't get rate limited by YouTube
+const previewConcurrency = 4
+
+// PreviewMatches runs SearchYouTube for each track without downloading anything.
+// Results are in track order; a track whose search failed carries the error.
+func PreviewMatches(ctx context.Context, tracks []models.TrackMetadata) []models.MatchPreview {
+	previews := make([]models.MatchPreview, len(tracks))
+	indexes := make(chan int)
+
+	var wg sync.WaitGroup
+	for i := 0; i < previewConcurrency && i < len(tracks); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range indexes {
+				previews[idx] = previewMatch(ctx, tracks[idx])
+			}
+		}()
+	}
+
+	for i := range tracks {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	return previews
+}
+
+// previewMatch searches for one track and describes the chosen video
+func previewMatch(ctx context.Context, track models.TrackMetadata) models.MatchPreview {
+	preview := models.MatchPreview{TrackID: track.ID, SpotifyName: track.Name}
+	if ctx.Err() != nil {
+		preview.Error = ctx.Err().Error()
+		return preview
+	}
+
+	result, err := SearchYouTube(ctx, track)
+	if err != nil {
+		if errors.Is(err, ErrNoYouTubeMatch) {
+			preview.Error = "no YouTube match"
+		} else {
+			preview.Error = err.Error()
+		}
+		return preview
+	}
+
+	preview.MatchedTitle = result.Title
+	preview.MatchedURL = result.URL
+	if result.Duration > 0 && track.DurationMs > 0 {
+		delta := (result.Duration - time.Duration(track.DurationMs)*time.Millisecond).Seconds()
+		preview.DurationDelta = &delta
+	}
+	return preview
+}
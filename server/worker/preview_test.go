@@ -0,0 +1,58 @@
+package worker
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"separate/server/models"
+)
+
+func TestPreviewMatchesKeepsTrackOrder(t *testing.T) {
+	originalExec := execCommand
+	execCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		query := args[len(args)-1]
+		switch {
+		case strings.Contains(query, "Missing"):
+			return exec.CommandContext(ctx, "true")
+		case strings.Contains(query, "Second"):
+			return exec.CommandContext(ctx, "printf", "%s", "vid2\t183\tSecond (Official Video)\n")
+		default:
+			return exec.CommandContext(ctx, "printf", "%s", "vidN\tNA\tSomething\n")
+		}
+	}
+	defer func() { execCommand = originalExec }()
+
+	var tracks []models.TrackMetadata
+	for i := 0; i < 2*previewConcurrency; i++ {
+		tracks = append(tracks, models.TrackMetadata{ID: "t" + string(rune('a'+i)), Name: "Filler", Artists: []string{"A"}})
+	}
+	tracks[1] = models.TrackMetadata{ID: "second", Name: "Second", Artists: []string{"A"}, DurationMs: 180000}
+	tracks[2] = models.TrackMetadata{ID: "missing", Name: "Missing", Artists: []string{"A"}}
+
+	previews := PreviewMatches(context.Background(), tracks)
+	if len(previews) != len(tracks) {
+		t.Fatalf("Expected %d previews, got %d", len(tracks), len(previews))
+	}
+	for i, preview := range previews {
+		if preview.TrackID != tracks[i].ID {
+			t.Errorf("Preview %d is for %s, want %s", i, preview.TrackID, tracks[i].ID)
+		}
+	}
+
+	second := previews[1]
+	if second.MatchedURL != "https://www.youtube.com/watch?v=vid2" || second.MatchedTitle != "Second (Official Video)" {
+		t.Errorf("Unexpected match: %+v", second)
+	}
+	if second.DurationDelta == nil || *second.DurationDelta != 3 {
+		t.Errorf("Expected a +3s duration delta, got %v", second.DurationDelta)
+	}
+
+	if missing := previews[2]; missing.Error == "" || missing.MatchedURL != "" {
+		t.Errorf("Expected an error and no match for the missing track, got %+v", missing)
+	}
+	if previews[0].DurationDelta != nil {
+		t.Error("Expected no duration delta when durations are unknown")
+	}
+}
@@ -0,0 +1,91 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// ErrInvalidAudio means yt-dlp finished but left something that isn't the
+// track's audio: a non-audio file, or one far shorter or longer than the track
+var ErrInvalidAudio = errors.New("downloaded file is not valid audio")
+
+const (
+	// minDurationDrift is how far a download may be from the Spotify duration
+	// before it is rejected; longer tracks get durationDriftRatio of their length
+	minDurationDrift   = 30 * time.Second
+	durationDriftRatio = 0.25
+)
+
+// probeResult is the part of "ffprobe -of json" output we read
+type probeResult struct {
+	Streams []struct {
+		CodecType string `json:"codec_type"`
+	} `json:"streams"`
+	Format struct {
+		Duration string `json:"duration"`
+	} `json:"format"`
+}
+
+// probeAudio returns the duration of the audio in path, or ErrInvalidAudio if
+// ffprobe can't decode it or finds no audio stream
+func probeAudio(ctx context.Context, path string) (time.Duration, error) {
+	cmd := execCommand(ctx, "ffprobe", "-v", "error",
+		"-show_entries", "stream=codec_type:format=duration", "-of", "json", path)
+	output, err := cmd.Output()
+	if err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return 0, err
+		}
+		return 0, fmt.Errorf("%w: ffprobe could not read it: %v", ErrInvalidAudio, err)
+	}
+
+	var result probeResult
+	if err := json.Unmarshal(output, &result); err != nil {
+		return 0, fmt.Errorf("%w: unexpected ffprobe output: %v", ErrInvalidAudio, err)
+	}
+	hasAudio := false
+	for _, stream := range result.Streams {
+		if stream.CodecType == "audio" {
+			hasAudio = true
+		}
+	}
+	if !hasAudio {
+		return 0, fmt.Errorf("%w: no audio stream", ErrInvalidAudio)
+	}
+
+	seconds, err := strconv.ParseFloat(result.Format.Duration, 64)
+	if err != nil || seconds <= 0 {
+		return 0, fmt.Errorf("%w: no duration reported", ErrInvalidAudio)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// validateAudio checks that path is decodable audio whose duration is close to
+// expected (zero skips the duration check). Without ffprobe installed the check
+// is skipped, since the download itself may well be fine.
+func validateAudio(ctx context.Context, trackID, path string, expected time.Duration) error {
+	duration, err := probeAudio(ctx, path)
+	if errors.Is(err, exec.ErrNotFound) {
+		slog.Warn("ffprobe not found, skipping audio validation", "worker_type", "download", "track_id", trackID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if expected <= 0 {
+		return nil
+	}
+	allowed := max(minDurationDrift, time.Duration(float64(expected)*durationDriftRatio))
+	if diff := (duration - expected).Abs(); diff > allowed {
+		return fmt.Errorf("%w: duration %s is %s off the expected %s",
+			ErrInvalidAudio, duration.Round(time.Second), diff.Round(time.Second), expected.Round(time.Second))
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package worker
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"separate/server/models"
+)
+
+// lowPriorityEvery makes every Nth pick prefer the low tier, so a steady stream
+// of high-priority jobs slows the backlog down but never starves it
+const lowPriorityEvery = 4
+
+// DownloadQueue is a two-tier download queue. Workers take high-priority jobs
+// first; when the preferred tier is empty they fall through to the other one.
+type DownloadQueue struct {
+	high  chan *models.DownloadJob
+	low   chan *models.DownloadJob
+	picks atomic.Uint64
+
+	// orderMu guards the track IDs waiting in each tier, oldest first.
+	// Channels can't be inspected, so this mirrors them for queue positions.
+	orderMu   sync.Mutex
+	highOrder []string
+	lowOrder  []string
+}
+
+// NewDownloadQueue creates a queue holding up to capacity jobs per tier
+func NewDownloadQueue(capacity int) *DownloadQueue {
+	return &DownloadQueue{
+		high: make(chan *models.DownloadJob, capacity),
+		low:  make(chan *models.DownloadJob, capacity),
+	}
+}
+
+// Enqueue adds a job to the tier matching its priority, blocking if that tier is
+// full. It returns the job's 1-based position in the queue.
+func (q *DownloadQueue) Enqueue(job *models.DownloadJob) int {
+	q.orderMu.Lock()
+	if job.Priority >= models.PriorityHigh {
+		q.highOrder = append(q.highOrder, job.Track.ID)
+	} else {
+		q.lowOrder = append(q.lowOrder, job.Track.ID)
+	}
+	position := q.positionLocked(job.Track.ID)
+	q.orderMu.Unlock()
+
+	if job.Priority >= models.PriorityHigh {
+		q.high <- job
+	} else {
+		q.low <- job
+	}
+	return position
+}
+
+// Position returns how many jobs will run before the track's, plus one, or 0 if
+// the track isn't queued. High-priority jobs count as ahead of every
+// low-priority one, so a backlog position is an upper bound: every
+// lowPriorityEvery-th pick goes to the backlog anyway.
+func (q *DownloadQueue) Position(trackID string) int {
+	q.orderMu.Lock()
+	defer q.orderMu.Unlock()
+	return q.positionLocked(trackID)
+}
+
+func (q *DownloadQueue) positionLocked(trackID string) int {
+	if i := slices.Index(q.highOrder, trackID); i >= 0 {
+		return i + 1
+	}
+	if i := slices.Index(q.lowOrder, trackID); i >= 0 {
+		return len(q.highOrder) + i + 1
+	}
+	return 0
+}
+
+// Waiting returns up to limit queued track IDs in position order
+func (q *DownloadQueue) Waiting(limit int) []string {
+	q.orderMu.Lock()
+	defer q.orderMu.Unlock()
+	waiting := make([]string, 0, min(limit, len(q.highOrder)+len(q.lowOrder)))
+	for _, order := range [][]string{q.highOrder, q.lowOrder} {
+		for _, trackID := range order {
+			if len(waiting) == limit {
+				return waiting
+			}
+			waiting = append(waiting, trackID)
+		}
+	}
+	return waiting
+}
+
+// taken drops a job handed to a worker from its tier's order
+func (q *DownloadQueue) taken(job *models.DownloadJob) {
+	q.orderMu.Lock()
+	defer q.orderMu.Unlock()
+	order := &q.lowOrder
+	if job.Priority >= models.PriorityHigh {
+		order = &q.highOrder
+	}
+	if i := slices.Index(*order, job.Track.ID); i >= 0 {
+		*order = slices.Delete(*order, i, i+1)
+	}
+}
+
+// Len returns the number of jobs waiting in both tiers
+func (q *DownloadQueue) Len() int {
+	return len(q.high) + len(q.low)
+}
+
+// Close stops the queue; Next drains remaining jobs and then reports false
+func (q *DownloadQueue) Close() {
+	close(q.high)
+	close(q.low)
+}
+
+// Next blocks until a job is available, preferring the high tier except on
+// every lowPriorityEvery-th call. It reports false once the queue is closed and empty.
+func (q *DownloadQueue) Next() (*models.DownloadJob, bool) {
+	job, ok := q.next()
+	if ok {
+		q.taken(job)
+	}
+	return job, ok
+}
+
+func (q *DownloadQueue) next() (*models.DownloadJob, bool) {
+	first, second := q.high, q.low
+	if q.picks.Add(1)%lowPriorityEvery == 0 {
+		first, second = q.low, q.high
+	}
+
+	// A nil channel is never ready, so closed tiers drop out of the selects
+	for first != nil || second != nil {
+		select {
+		case job, ok := <-first:
+			if ok {
+				return job, true
+			}
+			first = nil
+			continue
+		default:
+		}
+
+		select {
+		case job, ok := <-second:
+			if ok {
+				return job, true
+			}
+			second = nil
+			continue
+		default:
+		}
+
+		// Both tiers empty: take whichever fills first
+		select {
+		case job, ok := <-first:
+			if ok {
+				return job, true
+			}
+			first = nil
+		case job, ok := <-second:
+			if ok {
+				return job, true
+			}
+			second = nil
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,123 @@
+package worker
+
+import (
+	"testing"
+
+	"separate/server/models"
+)
+
+func TestDownloadQueuePrefersHighWithoutStarvingLow(t *testing.T) {
+	q := NewDownloadQueue(20)
+	for i := 0; i < 8; i++ {
+		q.Enqueue(&models.DownloadJob{Track: models.TrackMetadata{ID: "low"}, Priority: models.PriorityLow})
+	}
+	for i := 0; i < 8; i++ {
+		q.Enqueue(&models.DownloadJob{Track: models.TrackMetadata{ID: "high"}, Priority: models.PriorityHigh})
+	}
+	if q.Len() != 16 {
+		t.Fatalf("Expected 16 queued jobs, got %d", q.Len())
+	}
+
+	var order []string
+	for i := 0; i < 8; i++ {
+		job, ok := q.Next()
+		if !ok {
+			t.Fatal("Queue closed unexpectedly")
+		}
+		order = append(order, job.Track.ID)
+	}
+
+	// Every lowPriorityEvery-th pick goes to the backlog
+	lows := 0
+	for i, id := range order {
+		wantLow := (i+1)%lowPriorityEvery == 0
+		if (id == "low") != wantLow {
+			t.Errorf("Pick %d: got %s, order %v", i+1, id, order)
+		}
+		if id == "low" {
+			lows++
+		}
+	}
+	if lows != 8/lowPriorityEvery {
+		t.Errorf("Expected %d low-priority picks, got %d", 8/lowPriorityEvery, lows)
+	}
+}
+
+func TestDownloadQueueDrainsAfterClose(t *testing.T) {
+	q := NewDownloadQueue(4)
+	q.Enqueue(&models.DownloadJob{Priority: models.PriorityLow})
+	q.Enqueue(&models.DownloadJob{Priority: models.PriorityHigh})
+	q.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, ok := q.Next(); !ok {
+			t.Fatalf("Expected queued job %d to be delivered after close", i+1)
+		}
+	}
+	if _, ok := q.Next(); ok {
+		t.Error("Expected Next to report false once closed and empty")
+	}
+}
+
+func TestDownloadQueuePositions(t *testing.T) {
+	q := NewDownloadQueue(10)
+	if got := q.Enqueue(&models.DownloadJob{Track: models.TrackMetadata{ID: "backlog"}, Priority: models.PriorityLow}); got != 1 {
+		t.Errorf("Expected first job at position 1, got %d", got)
+	}
+	q.Enqueue(&models.DownloadJob{Track: models.TrackMetadata{ID: "a"}, Priority: models.PriorityHigh})
+	if got := q.Enqueue(&models.DownloadJob{Track: models.TrackMetadata{ID: "b"}, Priority: models.PriorityHigh}); got != 2 {
+		t.Errorf("Expected b at position 2, got %d", got)
+	}
+
+	// High-priority jobs count as ahead of the backlog
+	if got := q.Position("backlog"); got != 3 {
+		t.Errorf("Expected backlog at position 3, got %d", got)
+	}
+	if got := q.Waiting(2); len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Errorf("Expected Waiting(2) = [a b], got %v", got)
+	}
+
+	job, _ := q.Next()
+	if job.Track.ID != "a" {
+		t.Fatalf("Expected a first, got %s", job.Track.ID)
+	}
+	if got := q.Position("a"); got != 0 {
+		t.Errorf("Expected a taken job to have no position, got %d", got)
+	}
+	if got := q.Position("b"); got != 1 {
+		t.Errorf("Expected b to move up to position 1, got %d", got)
+	}
+	if got := q.Position("backlog"); got != 2 {
+		t.Errorf("Expected backlog to move up to position 2, got %d", got)
+	}
+}
+
+func TestPlaylistLimiterParksJobsOverTheLimit(t *testing.T) {
+	l := newPlaylistLimiter(2)
+	job := func(id, playlistID string) *models.DownloadJob {
+		return &models.DownloadJob{Track: models.TrackMetadata{ID: id}, PlaylistID: playlistID}
+	}
+	a1, a2, a3 := job("a1", "big"), job("a2", "big"), job("a3", "big")
+
+	if !l.acquire(a1) || !l.acquire(a2) {
+		t.Fatal("Expected the first two jobs of a playlist to run")
+	}
+	if l.acquire(a3) {
+		t.Fatal("Expected the third job to be parked at the limit")
+	}
+	if !l.acquire(job("b1", "small")) || !l.acquire(job("single", "")) {
+		t.Error("Expected other playlists and single tracks to run regardless")
+	}
+
+	// Finishing a job hands its slot to the parked one
+	if next := l.release(a1); next != a3 {
+		t.Fatalf("Expected a3 to run next, got %v", next)
+	}
+	if next := l.release(a2); next != nil {
+		t.Errorf("Expected no parked job, got %s", next.Track.ID)
+	}
+	l.release(a3)
+	if l.running["big"] != 0 {
+		t.Errorf("Expected every slot back, %d still held", l.running["big"])
+	}
+}
@@ -0,0 +1,135 @@
+package worker
+
+import (
+	"context"
+	"log/slog"
+
+	"separate/server/core"
+	"separate/server/models"
+)
+
+// ResumeJobs picks up where the previous run left off. It first checks the
+// database against the songs directory, resetting jobs whose files are missing
+// and those interrupted mid-run, then queues every pending job. Call it before
+// StartWorkers.
+func (wm *WorkerManager) ResumeJobs(downloadQueue *DownloadQueue, spotify *core.SpotifyClient) {
+	slog.Info("Verifying download status against files")
+	if err := wm.db.VerifyDownloadStatus(HasBaseAudio); err != nil {
+		slog.Warn("Failed to verify download status", "error", err)
+	}
+
+	// Interrupted Demucs runs are re-queued unless their stems already landed
+	if err := wm.db.VerifyDemucsStatus(HasDemucsOutput); err != nil {
+		slog.Warn("Failed to verify Demucs status", "error", err)
+	}
+
+	wm.resumeDownloads(downloadQueue, spotify)
+	wm.resumeDemucs()
+}
+
+// resumeDownloads queues pending downloads. The database keeps only track
+// names, so their metadata is fetched from Spotify again.
+func (wm *WorkerManager) resumeDownloads(downloadQueue *DownloadQueue, spotify *core.SpotifyClient) {
+	pending, err := wm.db.GetPendingDownloadJobs()
+	if err != nil {
+		slog.Warn("Failed to load pending jobs", "worker_type", "download", "error", err)
+		return
+	}
+	slog.Info("Loading pending jobs from database", "worker_type", "download", "count", len(pending))
+	if len(pending) == 0 {
+		return
+	}
+
+	token, err := spotify.GetAccessToken(context.Background())
+	if err != nil {
+		slog.Error("Failed to get token for reloading jobs", "error", err)
+		return
+	}
+	// Batch lookups (50 IDs per request) instead of one round-trip per track;
+	// results keep the oldest-first order from the database
+	tracks, err := spotify.GetTracksMetadata(context.Background(), pending, token)
+	if err != nil {
+		slog.Error("Failed to fetch metadata for pending jobs", "error", err)
+		return
+	}
+	wm.failUnavailable(pending, tracks)
+
+	options, err := wm.db.GetJobOptions(pending)
+	if err != nil {
+		slog.Warn("Failed to load job options, using defaults", "worker_type", "download", "error", err)
+	}
+	for _, track := range tracks {
+		opts := options[track.ID]
+		// Resumed backlog yields to newly requested tracks
+		downloadQueue.Enqueue(&models.DownloadJob{
+			Track:      track,
+			Separation: opts.Separation,
+			Priority:   models.PriorityLow,
+			PlaylistID: opts.PlaylistID,
+			AutoDemucs: opts.AutoDemucs,
+		})
+	}
+}
+
+// resumeDemucs queues downloaded tracks awaiting separation. Tracks queued
+// without auto-Demucs, by AUTO_DEMUCS or their own request, wait to be
+// separated on demand.
+func (wm *WorkerManager) resumeDemucs() {
+	pending, err := wm.db.GetPendingDemucsJobs()
+	if err != nil {
+		slog.Warn("Failed to load pending jobs", "worker_type", "demucs", "error", err)
+		return
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	trackIDs := make([]string, len(pending))
+	for i, track := range pending {
+		trackIDs[i] = track.ID
+	}
+	options, err := wm.db.GetJobOptions(trackIDs)
+	if err != nil {
+		slog.Warn("Failed to load job options, using defaults", "worker_type", "demucs", "error", err)
+	}
+
+	queued := 0
+	for _, track := range pending {
+		opts := options[track.ID]
+		autoDemucs := wm.autoDemucs
+		if opts.AutoDemucs != nil {
+			autoDemucs = *opts.AutoDemucs
+		}
+		if !autoDemucs {
+			continue
+		}
+		wm.QueueDemucs(&models.DemucsJob{
+			Track:             track,
+			InputPath:         BaseAudioPath(track.ID),
+			SeparationOptions: opts.Separation,
+		})
+		queued++
+	}
+	slog.Info("Loading pending jobs from database", "worker_type", "demucs", "count", queued)
+}
+
+// unavailableTrackError is recorded for pending tracks Spotify no longer returns
+const unavailableTrackError = "track is no longer available on Spotify"
+
+// failUnavailable marks pending downloads Spotify returned no metadata for as
+// failed. Nothing would queue them otherwise, leaving them pending forever.
+func (wm *WorkerManager) failUnavailable(pending []string, found []models.TrackMetadata) {
+	returned := make(map[string]bool, len(found))
+	for _, track := range found {
+		returned[track.ID] = true
+	}
+	for _, trackID := range pending {
+		if returned[trackID] {
+			continue
+		}
+		slog.Warn("Pending track is no longer on Spotify", "worker_type", "download", "track_id", trackID)
+		if err := wm.db.UpdateDownloadStatus(trackID, "failed", unavailableTrackError); err != nil {
+			slog.Error("Failed to mark track unavailable", "worker_type", "download", "track_id", trackID, "error", err)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package worker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"separate/server/core"
+	"separate/server/db"
+	"separate/server/models"
+)
+
+func TestResumeJobsRequeuesInterruptedSeparation(t *testing.T) {
+	useTempSongsDir(t)
+	database, err := db.InitDB(filepath.Join(t.TempDir(), "queue.db"))
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer database.Close()
+
+	tracks := []models.TrackMetadata{
+		{ID: "interrupted1", Name: "Interrupted", Artists: []string{"Artist"}},
+		{ID: "finished1", Name: "Finished", Artists: []string{"Artist"}},
+	}
+	if err := database.SavePlaylistTracks("playlist", tracks); err != nil {
+		t.Fatalf("SavePlaylistTracks failed: %v", err)
+	}
+	// Both were downloaded and separating when the server stopped; only one
+	// got as far as writing its stems
+	for _, track := range tracks {
+		os.MkdirAll(TrackDir(track.ID), 0755)
+		os.WriteFile(BaseAudioPath(track.ID), make([]byte, minAudioBytes), 0644)
+		database.UpdateDemucsStatus(track.ID, "in_progress", "")
+	}
+	os.MkdirAll(stemsDir("finished1"), 0755)
+	for _, stem := range []string{"vocals", "no_vocals"} {
+		os.WriteFile(filepath.Join(stemsDir("finished1"), stem+".wav"), []byte(stem), 0644)
+	}
+
+	demucsQueue := make(chan *models.DemucsJob, 10)
+	wm := NewWorkerManager(database, core.NewProgressBroadcaster(), demucsQueue)
+	// No download is pending, so Spotify is never asked for metadata
+	wm.ResumeJobs(NewDownloadQueue(10), nil)
+
+	if len(demucsQueue) != 1 {
+		t.Fatalf("Expected one separation to be queued, got %d", len(demucsQueue))
+	}
+	if job := <-demucsQueue; job.Track.ID != "interrupted1" || job.InputPath != BaseAudioPath("interrupted1") {
+		t.Errorf("Expected interrupted1 to be queued from its base audio, got %+v", job)
+	}
+	for id, want := range map[string]string{"interrupted1": "pending", "finished1": "completed"} {
+		state, err := database.GetTrack(id)
+		if err != nil {
+			t.Fatalf("GetTrack failed: %v", err)
+		}
+		if state.DownloadStatus != "completed" || state.DemucsStatus != want {
+			t.Errorf("Expected %s to be completed/%s, got %s/%s", id, want, state.DownloadStatus, state.DemucsStatus)
+		}
+	}
+}
+
+func TestResumeFailsTracksMissingFromSpotify(t *testing.T) {
+	database, err := db.InitDB(filepath.Join(t.TempDir(), "queue.db"))
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer database.Close()
+
+	tracks := []models.TrackMetadata{
+		{ID: "found1", Name: "Found", Artists: []string{"Artist"}},
+		{ID: "removed1", Name: "Removed", Artists: []string{"Artist"}},
+	}
+	if err := database.SavePlaylistTracks("playlist", tracks); err != nil {
+		t.Fatalf("SavePlaylistTracks failed: %v", err)
+	}
+
+	wm := NewWorkerManager(database, core.NewProgressBroadcaster(), make(chan *models.DemucsJob, 1))
+	// Spotify only returned metadata for found1
+	wm.failUnavailable([]string{"found1", "removed1"}, tracks[:1])
+
+	for id, want := range map[string]string{"found1": "pending", "removed1": "failed"} {
+		state, err := database.GetTrack(id)
+		if err != nil {
+			t.Fatalf("GetTrack failed: %v", err)
+		}
+		if state.DownloadStatus != want {
+			t.Errorf("Expected %s to be %s, got %s", id, want, state.DownloadStatus)
+		}
+	}
+	if state, _ := database.GetTrack("removed1"); state.DownloadError != unavailableTrackError {
+		t.Errorf("Expected removed1 to record why it failed, got %q", state.DownloadError)
+	}
+}
+
+func TestResumeJobsUsesStoredOptions(t *testing.T) {
+	useTempSongsDir(t)
+	database, err := db.InitDB(filepath.Join(t.TempDir(), "queue.db"))
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer database.Close()
+
+	tracks := []models.TrackMetadata{
+		{ID: "requested1", Name: "Requested", Artists: []string{"Artist"}},
+		{ID: "default1", Name: "Default", Artists: []string{"Artist"}},
+	}
+	if err := database.SavePlaylistTracks("playlist", tracks); err != nil {
+		t.Fatalf("SavePlaylistTracks failed: %v", err)
+	}
+	for _, track := range tracks {
+		os.MkdirAll(TrackDir(track.ID), 0755)
+		os.WriteFile(BaseAudioPath(track.ID), make([]byte, minAudioBytes), 0644)
+		database.UpdateDownloadStatus(track.ID, "completed", "")
+	}
+	// Only requested1 asked for separation, with its own options
+	autoDemucs := true
+	opts := models.JobOptions{PlaylistID: "playlist", Separation: models.SeparationOptions{TwoStems: "vocals"}, AutoDemucs: &autoDemucs}
+	if err := database.SetJobOptions([]string{"requested1"}, opts); err != nil {
+		t.Fatalf("SetJobOptions failed: %v", err)
+	}
+
+	demucsQueue := make(chan *models.DemucsJob, 10)
+	wm := NewWorkerManager(database, core.NewProgressBroadcaster(), demucsQueue)
+	wm.SetAutoDemucs(false)
+	wm.ResumeJobs(NewDownloadQueue(10), nil)
+
+	if len(demucsQueue) != 1 {
+		t.Fatalf("Expected one separation to be queued, got %d", len(demucsQueue))
+	}
+	if job := <-demucsQueue; job.Track.ID != "requested1" || job.TwoStems != "vocals" {
+		t.Errorf("Expected requested1 to be separated with its options, got %+v", job)
+	}
+}
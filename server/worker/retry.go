@@ -0,0 +1,68 @@
+package worker
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+
+	"separate/server/models"
+)
+
+// Automatic retries wait downloadRetryBaseDelay after the first failure,
+// doubling each time up to downloadRetryMaxDelay (replaced in tests)
+var (
+	downloadRetryBaseDelay = 30 * time.Second
+	downloadRetryMaxDelay  = 10 * time.Minute
+)
+
+// isTransient reports whether a failed download may succeed if simply run
+// again: network errors, throttling and yt-dlp hiccups. A search that found
+// nothing, a bad file or a cancellation would fail the same way.
+func isTransient(err error) bool {
+	return errors.Is(err, ErrDownloadFailed) && !errors.Is(err, ErrCancelled)
+}
+
+// downloadRetryDelay returns how long to wait before running a download again
+// after its attempt-th try (1-based) failed
+func downloadRetryDelay(attempt int) time.Duration {
+	delay := downloadRetryBaseDelay
+	for i := 1; i < attempt && delay < downloadRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, downloadRetryMaxDelay)
+}
+
+// scheduleRetry queues a failed download again after a backoff if the failure
+// is transient and the job has attempts left
+func (wm *WorkerManager) scheduleRetry(job *models.DownloadJob, attempt int, err error) {
+	if wm.downloadQueue == nil || attempt >= wm.maxAttempts || !isTransient(err) {
+		return
+	}
+
+	delay := downloadRetryDelay(attempt)
+	slog.Info("Scheduling download retry", "worker_type", "download", "track_id", job.Track.ID,
+		"attempt", attempt, "delay_ms", delay.Milliseconds())
+	time.AfterFunc(delay, func() { wm.retryDownload(job) })
+}
+
+// retryDownload re-queues a download whose backoff has passed. The track stays
+// failed while it waits, so a manual retry, a reset or a deletion in the
+// meantime takes precedence: only a job still failed is queued.
+func (wm *WorkerManager) retryDownload(job *models.DownloadJob) {
+	reset, err := wm.db.ResetFailedForRetry(job.Track.ID, "download")
+	if err != nil {
+		slog.Error("Failed to reset track for retry", "worker_type", "download", "track_id", job.Track.ID, "error", err)
+		return
+	}
+	if !reset {
+		return
+	}
+
+	position := wm.downloadQueue.Enqueue(job)
+	wm.progress.SendEvent(models.ProgressEvent{
+		TrackID:       job.Track.ID,
+		Type:          "download",
+		Status:        "queued",
+		QueuePosition: position,
+	})
+}
@@ -0,0 +1,107 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"separate/server/core"
+	"separate/server/db"
+	"separate/server/models"
+)
+
+func TestIsTransient(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{fmt.Errorf("%w: yt-dlp exited: exit status 1", ErrDownloadFailed), true},
+		{fmt.Errorf("%w: yt-dlp timed out after 10m0s", ErrDownloadFailed), true},
+		{ErrNoYouTubeMatch, false},
+		{fmt.Errorf("%w: no audio stream", ErrInvalidAudio), false},
+		{ErrCancelled, false},
+		{errors.New("something else"), false},
+	}
+	for _, c := range cases {
+		if got := isTransient(c.err); got != c.want {
+			t.Errorf("isTransient(%q) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+func TestDownloadRetryDelayBacksOff(t *testing.T) {
+	for attempt, want := range map[int]time.Duration{
+		1:  30 * time.Second,
+		2:  time.Minute,
+		3:  2 * time.Minute,
+		10: 10 * time.Minute,
+	} {
+		if got := downloadRetryDelay(attempt); got != want {
+			t.Errorf("downloadRetryDelay(%d) = %v, want %v", attempt, got, want)
+		}
+	}
+}
+
+func TestTransientDownloadFailureIsRetried(t *testing.T) {
+	useTempSongsDir(t)
+	database, err := db.InitDB(filepath.Join(t.TempDir(), "queue.db"))
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer database.Close()
+
+	track := models.TrackMetadata{ID: "flaky1", Name: "Flaky", Artists: []string{"Artist"}}
+	if err := database.SavePlaylistTracks("playlist", []models.TrackMetadata{track}); err != nil {
+		t.Fatalf("SavePlaylistTracks failed: %v", err)
+	}
+	if err := database.SetSourceURL(track.ID, "https://www.youtube.com/watch?v=dQw4w9WgXcQ"); err != nil {
+		t.Fatalf("SetSourceURL failed: %v", err)
+	}
+
+	// yt-dlp exits with an error, as it does when the network drops
+	originalExec := execCommand
+	execCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "false")
+	}
+	defer func() { execCommand = originalExec }()
+	originalDelay := downloadRetryBaseDelay
+	downloadRetryBaseDelay = 10 * time.Millisecond
+	defer func() { downloadRetryBaseDelay = originalDelay }()
+
+	queue := NewDownloadQueue(10)
+	wm := NewWorkerManager(database, core.NewProgressBroadcaster(), make(chan *models.DemucsJob, 10))
+	wm.downloadQueue = queue
+	wm.SetMaxAttempts(2)
+
+	job := &models.DownloadJob{Track: track, PlaylistID: "playlist"}
+	wm.processDownload(job)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for queue.Len() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the failed download to be queued again")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	retried, _ := queue.Next()
+	if retried != job {
+		t.Errorf("Expected the original job to be re-queued, got %+v", retried)
+	}
+	if state, _ := database.GetTrack(track.ID); state.DownloadStatus != "pending" {
+		t.Errorf("Expected the retried track to be pending, got %s", state.DownloadStatus)
+	}
+
+	// The second attempt is the last, so it is not retried
+	wm.processDownload(retried)
+	time.Sleep(100 * time.Millisecond)
+	if queue.Len() != 0 {
+		t.Error("Expected no retry once the attempts are used up")
+	}
+	if state, _ := database.GetTrack(track.ID); state.DownloadStatus != "failed" {
+		t.Errorf("Expected the track to stay failed, got %s", state.DownloadStatus)
+	}
+}
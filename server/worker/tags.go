@@ -0,0 +1,101 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"separate/server/models"
+)
+
+// albumArtTimeout bounds the cover image download
+const albumArtTimeout = 30 * time.Second
+
+// buildTagArgs builds the ffmpeg arguments that copy inputPath to outputPath with
+// ID3 tags from the Spotify metadata. Empty fields are left untagged, and the
+// cover image is embedded only when coverPath is set.
+func buildTagArgs(inputPath, outputPath, coverPath string, track models.TrackMetadata) []string {
+	args := []string{"-y", "-loglevel", "error", "-i", inputPath}
+	if coverPath != "" {
+		args = append(args, "-i", coverPath, "-map", "0:a", "-map", "1:0",
+			"-metadata:s:v", "title=Album cover", "-metadata:s:v", "comment=Cover (front)")
+	} else {
+		args = append(args, "-map", "0")
+	}
+	args = append(args, "-c", "copy", "-id3v2_version", "3")
+
+	tags := []struct{ key, value string }{
+		{"title", track.Name},
+		{"artist", strings.Join(track.Artists, ", ")},
+		{"album", track.Album},
+		{"date", track.ReleaseDate},
+		{"TSRC", track.ISRC},
+	}
+	for _, tag := range tags {
+		if tag.value != "" {
+			args = append(args, "-metadata", tag.key+"="+tag.value)
+		}
+	}
+	return append(args, outputPath)
+}
+
+// tagMP3 writes ID3 tags (and cover art, if coverPath is set) into an MP3 in
+// place. ffmpeg writes a tagged copy alongside it, which then replaces the
+// original so a failure never leaves a half-written file behind.
+func tagMP3(ctx context.Context, path, coverPath string, track models.TrackMetadata) error {
+	taggedPath := strings.TrimSuffix(path, ".mp3") + ".tagged.mp3"
+
+	cmd := execCommand(ctx, "ffmpeg", buildTagArgs(path, taggedPath, coverPath, track)...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(taggedPath)
+		return fmt.Errorf("ffmpeg tagging failed: %w\nOutput: %s", err, string(output))
+	}
+
+	if err := os.Rename(taggedPath, path); err != nil {
+		os.Remove(taggedPath)
+		return fmt.Errorf("failed to replace tagged file: %w", err)
+	}
+	return nil
+}
+
+// downloadAlbumArt fetches a cover image to dest, honoring the yt-dlp proxy setting
+func downloadAlbumArt(ctx context.Context, imageURL, dest string) error {
+	client := &http.Client{Timeout: albumArtTimeout}
+	if ytDlpConfig.ProxyURL != "" {
+		proxyURL, err := url.Parse(ytDlpConfig.ProxyURL)
+		if err != nil {
+			return fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		client.Transport = &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imageURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch album art: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch album art: status %d", resp.StatusCode)
+	}
+
+	file, err := os.Create(dest)
+	if err != nil {
+		return fmt.Errorf("failed to create cover file: %w", err)
+	}
+	if _, err := io.Copy(file, resp.Body); err != nil {
+		file.Close()
+		os.Remove(dest)
+		return fmt.Errorf("failed to write cover file: %w", err)
+	}
+	return file.Close()
+}
@@ -0,0 +1,75 @@
+package worker
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"separate/server/models"
+)
+
+func TestTagMP3WritesMetadata(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "base.mp3")
+	if err := os.WriteFile(path, []byte("audio"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var gotArgs []string
+	originalExec := execCommand
+	execCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		gotArgs = args
+		// Stand in for ffmpeg by writing the tagged copy
+		return exec.CommandContext(ctx, "cp", path, args[len(args)-1])
+	}
+	defer func() { execCommand = originalExec }()
+
+	track := models.TrackMetadata{
+		Name:        "Don't Start Now (feat. Someone)",
+		Artists:     []string{"Dua Lipa", "DaBaby", "AC/DC"},
+		Album:       "Future Nostalgia",
+		ReleaseDate: "2020-03-27",
+	}
+	if err := tagMP3(context.Background(), path, "", track); err != nil {
+		t.Fatalf("tagMP3 failed: %v", err)
+	}
+
+	joined := strings.Join(gotArgs, "\n")
+	for _, want := range []string{
+		"title=Don't Start Now (feat. Someone)",
+		"artist=Dua Lipa, DaBaby, AC/DC",
+		"album=Future Nostalgia",
+		"date=2020-03-27",
+	} {
+		if !strings.Contains(joined, "\n"+want+"\n") {
+			t.Errorf("Expected ffmpeg argument %q, got %v", want, gotArgs)
+		}
+	}
+	if strings.Contains(joined, "TSRC=") {
+		t.Error("Expected empty ISRC to be left untagged")
+	}
+	if strings.Contains(joined, "1:0") {
+		t.Error("Expected no cover stream without album art")
+	}
+
+	// The tagged copy replaces the original
+	if _, err := os.Stat(filepath.Join(dir, "base.tagged.mp3")); !os.IsNotExist(err) {
+		t.Error("Expected temporary tagged file to be renamed away")
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "audio" {
+		t.Errorf("Expected base.mp3 to survive tagging, got %q (%v)", data, err)
+	}
+}
+
+func TestBuildTagArgsEmbedsCover(t *testing.T) {
+	args := buildTagArgs("in.mp3", "out.mp3", "cover.jpg", models.TrackMetadata{Name: "Song"})
+	joined := strings.Join(args, " ")
+	for _, want := range []string{"-i in.mp3 -i cover.jpg", "-map 0:a -map 1:0", "comment=Cover (front)"} {
+		if !strings.Contains(joined, want) {
+			t.Errorf("Expected %q in ffmpeg args: %s", want, joined)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package worker
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// youTubeVideoIDPattern matches an 11-character YouTube video ID
+var youTubeVideoIDPattern = regexp.MustCompile(`^[0-9A-Za-z_-]{11}$`)
+
+// ParseYouTubeURL validates a YouTube video link and returns it in the canonical
+// https://www.youtube.com/watch?v=<id> form. It accepts youtube.com, m.youtube.com
+// and music.youtube.com watch/shorts links as well as youtu.be short links.
+func ParseYouTubeURL(input string) (string, error) {
+	s := strings.TrimSpace(input)
+	if !strings.Contains(s, "://") {
+		s = "https://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return "", fmt.Errorf("invalid YouTube URL: %q", input)
+	}
+
+	var videoID string
+	switch strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.") {
+	case "youtu.be":
+		videoID = strings.Trim(u.Path, "/")
+	case "youtube.com", "m.youtube.com", "music.youtube.com":
+		if shortID, ok := strings.CutPrefix(u.Path, "/shorts/"); ok {
+			videoID = strings.Trim(shortID, "/")
+		} else if u.Path == "/watch" {
+			videoID = u.Query().Get("v")
+		}
+	default:
+		return "", fmt.Errorf("not a YouTube URL: %q", input)
+	}
+
+	if !youTubeVideoIDPattern.MatchString(videoID) {
+		return "", fmt.Errorf("URL is not a YouTube video link: %q", input)
+	}
+	return "https://www.youtube.com/watch?v=" + videoID, nil
+}
+
+// youTubeVideoID returns the ID of the video a YouTube link points at, or "" if
+// it isn't a valid video link
+func youTubeVideoID(link string) string {
+	canonical, err := ParseYouTubeURL(link)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(canonical, "https://www.youtube.com/watch?v=")
+}
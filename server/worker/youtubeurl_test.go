@@ -0,0 +1,42 @@
+package worker
+
+import "testing"
+
+func TestParseYouTubeURL(t *testing.T) {
+	const want = "https://www.youtube.com/watch?v=dQw4w9WgXcQ"
+
+	valid := []string{
+		"https://www.youtube.com/watch?v=dQw4w9WgXcQ",
+		"https://youtube.com/watch?v=dQw4w9WgXcQ&t=42s",
+		"http://m.youtube.com/watch?feature=share&v=dQw4w9WgXcQ",
+		"https://music.youtube.com/watch?v=dQw4w9WgXcQ&list=RDAMVM",
+		"https://youtu.be/dQw4w9WgXcQ?si=abc",
+		"https://www.youtube.com/shorts/dQw4w9WgXcQ",
+		" youtu.be/dQw4w9WgXcQ\n",
+	}
+	for _, input := range valid {
+		got, err := ParseYouTubeURL(input)
+		if err != nil {
+			t.Errorf("ParseYouTubeURL(%q) returned error: %v", input, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("ParseYouTubeURL(%q) = %q, want %q", input, got, want)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"dQw4w9WgXcQ",
+		"https://vimeo.com/watch?v=dQw4w9WgXcQ",
+		"https://www.youtube.com.evil.example/watch?v=dQw4w9WgXcQ",
+		"https://www.youtube.com/watch?v=short",
+		"https://www.youtube.com/playlist?list=PL123",
+		"ftp://youtube.com/watch?v=dQw4w9WgXcQ",
+	}
+	for _, input := range invalid {
+		if got, err := ParseYouTubeURL(input); err == nil {
+			t.Errorf("ParseYouTubeURL(%q) = %q, want error", input, got)
+		}
+	}
+}
@@ -2,101 +2,311 @@ package worker
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"separate/server/models"
 )
 
+var (
+	// ErrNoYouTubeMatch means the search ran but found nothing; retrying will not help
+	ErrNoYouTubeMatch = errors.New("no YouTube match found")
+	// ErrDownloadFailed covers network and yt-dlp failures that may succeed on retry
+	ErrDownloadFailed = errors.New("download failed")
+)
+
+// execCommand builds external commands; tests replace it with a fake runner
+var execCommand = exec.CommandContext
+
+// defaultDownloadTimeout is how long a single yt-dlp download may run before it is killed
+const defaultDownloadTimeout = 10 * time.Minute
+
+// pipeWaitDelay bounds how long Wait waits for I/O to finish after yt-dlp exits
+const pipeWaitDelay = 5 * time.Second
+
+// proxySocketTimeout bounds each yt-dlp network read when a proxy is set, so an
+// unreachable proxy fails the job instead of stalling the worker
+const proxySocketTimeout = "30"
+
+// YtDlpConfig controls how yt-dlp is invoked
+type YtDlpConfig struct {
+	ProxyURL        string        // Passed to yt-dlp as --proxy when set
+	DownloadTimeout time.Duration // Kill a download that runs longer than this (default 10m)
+}
+
+var ytDlpConfig YtDlpConfig
+
+// ConfigureYtDlp applies yt-dlp settings; call before starting workers
+func ConfigureYtDlp(config YtDlpConfig) {
+	ytDlpConfig = config
+}
+
+func downloadTimeout() time.Duration {
+	if ytDlpConfig.DownloadTimeout > 0 {
+		return ytDlpConfig.DownloadTimeout
+	}
+	return defaultDownloadTimeout
+}
+
+// ytDlpNetworkArgs returns the flags shared by every yt-dlp invocation
+func ytDlpNetworkArgs() []string {
+	if ytDlpConfig.ProxyURL == "" {
+		return nil
+	}
+	return []string{"--proxy", ytDlpConfig.ProxyURL, "--socket-timeout", proxySocketTimeout}
+}
+
 // buildYtDlpArgsWithPath builds yt-dlp arguments with a specific output path
 func buildYtDlpArgsWithPath(url, outputPath string) []string {
 	return []string{"-x", "--audio-format", "mp3", "-o", outputPath, url}
 }
 
+// minAudioBytes is the smallest base.mp3 taken as a finished download; even a
+// few seconds of MP3 is larger, so anything smaller was cut short
+const minAudioBytes = 16 << 10
+
+// HasBaseAudio reports whether a track has a downloaded base.mp3 large enough
+// to be complete
+func HasBaseAudio(trackID string) bool {
+	info, err := os.Stat(BaseAudioPath(trackID))
+	return err == nil && info.Mode().IsRegular() && info.Size() >= minAudioBytes
+}
+
+// removePartialDownload deletes what a failed download leaves in the track
+// directory: base.mp3 and yt-dlp's intermediates (base.mp3.part, base.mp3.ytdl,
+// base.temp.mp3, ...). Stems and other files are kept.
+func removePartialDownload(trackID string) {
+	trackDir := TrackDir(trackID)
+	var leftovers []string
+	for _, pattern := range []string{"base.*", "*.part", "*.ytdl"} {
+		matches, _ := filepath.Glob(filepath.Join(trackDir, pattern))
+		leftovers = append(leftovers, matches...)
+	}
+	for _, path := range leftovers {
+		if err := os.RemoveAll(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Failed to remove partial download", "worker_type", "download", "track_id", trackID, "path", path, "error", err)
+		}
+	}
+}
+
+// CheckYtDlp verifies that yt-dlp is on PATH
+func CheckYtDlp() error {
+	if _, err := exec.LookPath("yt-dlp"); err != nil {
+		return fmt.Errorf("yt-dlp not found on PATH: %w", err)
+	}
+	return nil
+}
+
+const (
+	// searchCandidates is how many YouTube results are compared against the track duration
+	searchCandidates = 5
+	// durationTolerance is how far a result may be from the Spotify duration and still match
+	durationTolerance = 5 * time.Second
+)
+
 // YouTubeSearchResult represents a YouTube search result
 type YouTubeSearchResult struct {
-	VideoID string
-	Title   string
-	URL     string
+	VideoID  string
+	Title    string
+	URL      string
+	Duration time.Duration // zero when yt-dlp did not report one
 }
 
-// SearchYouTube searches YouTube for a track and returns the top result
-func SearchYouTube(track models.TrackMetadata) (*YouTubeSearchResult, error) {
+// SearchYouTube searches YouTube for a track and returns the result whose
+// duration is closest to the Spotify duration, falling back to the top result.
+// When the track has an ISRC, YouTube Music is searched by ISRC first since it
+// identifies the exact recording; artist and title are only used if that finds nothing.
+func SearchYouTube(ctx context.Context, track models.TrackMetadata) (*YouTubeSearchResult, error) {
+	target := time.Duration(track.DurationMs) * time.Millisecond
+
+	if track.ISRC != "" {
+		isrcURL := "https://music.youtube.com/search?q=" + url.QueryEscape(track.ISRC)
+		candidates, err := searchCandidatesFor(ctx, isrcURL, "--playlist-items", fmt.Sprintf("1:%d", searchCandidates))
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err == nil && len(candidates) > 0 {
+			best := closestByDuration(candidates, target)
+			return &best, nil
+		}
+		slog.Debug("ISRC search found nothing, falling back to text search", "track_id", track.ID, "isrc", track.ISRC)
+	}
+
 	// Build search query from track metadata
 	query := fmt.Sprintf("%s %s", strings.Join(track.Artists, " "), track.Name)
-	searchQuery := fmt.Sprintf("ytsearch1:%s", query)
+	candidates, err := searchCandidatesFor(ctx, fmt.Sprintf("ytsearch%d:%s", searchCandidates, query))
+	if err != nil {
+		return nil, err
+	}
+
+	best := closestByDuration(candidates, target)
+	return &best, nil
+}
 
-	// Use yt-dlp to search and get video ID and title
-	cmd := exec.Command("yt-dlp", "--get-id", "--get-title", searchQuery)
+// searchCandidatesFor runs a yt-dlp search for target and parses each result
+func searchCandidatesFor(ctx context.Context, target string, extraArgs ...string) ([]YouTubeSearchResult, error) {
+	// Use yt-dlp to list candidates as "id<TAB>duration<TAB>title", one per line.
+	// The title is JSON-encoded so newlines and tabs in it can't split the line.
+	args := append(ytDlpNetworkArgs(), "--print", searchPrintFormat)
+	args = append(args, extraArgs...)
+	args = append(args, target)
+	cmd := execCommand(ctx, "yt-dlp", args...)
 
 	output, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
 	if err != nil {
-		return nil, fmt.Errorf("youtube search failed: %w\nOutput: %s", err, string(output))
+		return nil, fmt.Errorf("%w: youtube search failed: %v\nOutput: %s", ErrDownloadFailed, err, string(output))
 	}
 
-	// Parse output: filter out warning lines, then get title and video ID
-	allLines := strings.Split(strings.TrimSpace(string(output)), "\n")
-	var contentLines []string
-	for _, line := range allLines {
+	return parseSearchOutput(string(output))
+}
+
+// searchPrintFormat is the yt-dlp --print template parseSearchOutput reads
+const searchPrintFormat = "%(id)s\t%(duration)s\t%(title)j"
+
+// parseSearchOutput parses yt-dlp's searchPrintFormat output, skipping the
+// WARNING and "[extractor]" lines it mixes in. Output with no result lines
+// means the search came up empty (ErrNoYouTubeMatch).
+func parseSearchOutput(raw string) ([]YouTubeSearchResult, error) {
+	var candidates []YouTubeSearchResult
+	contentLines := 0
+	for _, line := range strings.Split(strings.TrimSpace(raw), "\n") {
 		// Skip warning and info lines
-		if !strings.HasPrefix(line, "WARNING:") && !strings.HasPrefix(line, "[") && line != "" {
-			contentLines = append(contentLines, line)
+		if strings.HasPrefix(line, "WARNING:") || strings.HasPrefix(line, "[") || line == "" {
+			continue
+		}
+		contentLines++
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) != 3 || fields[0] == "" {
+			continue
 		}
+		// Older yt-dlp builds without the "j" conversion print the title as is
+		title := fields[2]
+		if err := json.Unmarshal([]byte(title), &title); err != nil {
+			title = fields[2]
+		}
+		result := YouTubeSearchResult{
+			VideoID: fields[0],
+			Title:   title,
+			URL:     fmt.Sprintf("https://www.youtube.com/watch?v=%s", fields[0]),
+		}
+		// Live streams and some uploads report "NA"
+		if seconds, err := strconv.ParseFloat(fields[1], 64); err == nil {
+			result.Duration = time.Duration(seconds * float64(time.Second))
+		}
+		candidates = append(candidates, result)
 	}
 
-	if len(contentLines) < 2 {
-		return nil, fmt.Errorf("unexpected yt-dlp output format: %s", string(output))
+	if contentLines == 0 {
+		return nil, ErrNoYouTubeMatch
 	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("yt-dlp printed no tab-delimited results (expected %q): %s", searchPrintFormat, raw)
+	}
+	return candidates, nil
+}
 
-	title := contentLines[0]
-	videoID := contentLines[1]
-	url := fmt.Sprintf("https://www.youtube.com/watch?v=%s", videoID)
+// closestByDuration picks the candidate nearest to target within durationTolerance.
+// If none is close enough (or target is unknown) the first candidate wins.
+func closestByDuration(candidates []YouTubeSearchResult, target time.Duration) YouTubeSearchResult {
+	if target <= 0 {
+		return candidates[0]
+	}
+
+	bestIdx := -1
+	var bestDiff time.Duration
+	for i, c := range candidates {
+		if c.Duration <= 0 {
+			continue
+		}
+		diff := c.Duration - target
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff <= durationTolerance && (bestIdx < 0 || diff < bestDiff) {
+			bestIdx, bestDiff = i, diff
+		}
+	}
 
-	return &YouTubeSearchResult{
-		VideoID: videoID,
-		Title:   title,
-		URL:     url,
-	}, nil
+	if bestIdx < 0 {
+		return candidates[0]
+	}
+	return candidates[bestIdx]
 }
 
-// DownloadTrackFromSpotifyWithProgress downloads and reports progress
-func DownloadTrackFromSpotifyWithProgress(track models.TrackMetadata, progressChan chan<- models.ProgressEvent) error {
-	// Search YouTube for the track
-	result, err := SearchYouTube(track)
-	if err != nil {
-		return fmt.Errorf("failed to search YouTube: %w", err)
+// DownloadTrackFromSpotifyWithProgress downloads and reports progress. The video is
+// found with SearchYouTube unless sourceURL names it explicitly, and is returned
+// on success so the match can be audited; a pinned video has no Title.
+// Cancelling ctx kills the yt-dlp process, as does exceeding the download timeout.
+func DownloadTrackFromSpotifyWithProgress(ctx context.Context, track models.TrackMetadata, sourceURL string, progressChan chan<- models.ProgressEvent) (*YouTubeSearchResult, error) {
+	video := &YouTubeSearchResult{VideoID: youTubeVideoID(sourceURL), URL: sourceURL}
+	if sourceURL == "" {
+		// Search YouTube for the track
+		result, err := SearchYouTube(ctx, track)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if errors.Is(err, ErrNoYouTubeMatch) {
+			return nil, err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to search YouTube: %w", err)
+		}
+		video = result
 	}
 
 	// Create directory structure
-	trackDir := filepath.Join("songs", track.ID)
+	trackDir := TrackDir(track.ID)
 	if err := os.MkdirAll(trackDir, 0755); err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
+		return nil, fmt.Errorf("failed to create directory: %w", err)
 	}
 
 	// Build command (each worker spawns its own yt-dlp process)
-	outputPath := filepath.Join(trackDir, "base.mp3")
-	args := buildYtDlpArgsWithPath(result.URL, outputPath)
+	outputPath := BaseAudioPath(track.ID)
+	args := append(ytDlpNetworkArgs(), buildYtDlpArgsWithPath(video.URL, outputPath)...)
 	args = append(args, "--progress") // Force progress output even when piped
 	args = append(args, "--newline")  // Force newline after each progress update
-	cmd := exec.Command("yt-dlp", args...)
+
+	timeout := downloadTimeout()
+	downloadCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := execCommand(downloadCtx, "yt-dlp", args...)
+	cmd.WaitDelay = pipeWaitDelay
 
 	// Get stdout pipe (progress goes to stdout with --progress flag)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		return fmt.Errorf("failed to create stdout pipe: %w", err)
+		return nil, fmt.Errorf("failed to create stdout pipe: %w", err)
 	}
 
 	// Start command
 	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start yt-dlp: %w", err)
+		return nil, fmt.Errorf("failed to start yt-dlp: %w", err)
 	}
 
 	// Parse progress from stdout in a separate goroutine
+	var wg sync.WaitGroup
+	wg.Add(1)
 	go func() {
+		defer wg.Done()
+		// Drain whatever the scanner left (e.g. after an over-long line) so
+		// yt-dlp never blocks writing to a full pipe
+		defer io.Copy(io.Discard, stdout)
+
 		scanner := bufio.NewScanner(stdout)
 		for scanner.Scan() {
 			line := scanner.Text()
@@ -106,24 +316,78 @@ func DownloadTrackFromSpotifyWithProgress(track models.TrackMetadata, progressCh
 				progress := parseProgress(line)
 				if progress >= 0 {
 					// Send event with this track's ID
-					progressChan <- models.ProgressEvent{
-						TrackID:  track.ID,
-						Type:     "download",
-						Status:   "downloading",
-						Progress: progress,
-					}
+					remaining, _ := parseETA(line)
+					sendProgress(progressChan, models.ProgressEvent{
+						TrackID:          track.ID,
+						Type:             "download",
+						Status:           "downloading",
+						Progress:         progress,
+						Stage:            "downloading",
+						RemainingSeconds: remaining,
+					})
 				}
 			}
+
+			// The download is done; ffmpeg is converting it to MP3
+			if strings.HasPrefix(line, "[ExtractAudio]") {
+				sendProgress(progressChan, models.ProgressEvent{
+					TrackID:  track.ID,
+					Type:     "download",
+					Status:   "downloading",
+					Progress: 100,
+					Stage:    "extracting audio",
+				})
+			}
 		}
 	}()
 
+	// Wait for the reader before cmd.Wait, which closes the pipe and would
+	// otherwise drop unread output; the reader ends once yt-dlp exits or is killed
+	wg.Wait()
+
 	// Wait for command to finish
 	if err := cmd.Wait(); err != nil {
-		return fmt.Errorf("yt-dlp download failed: %w", err)
+		// Don't leave a truncated base.mp3 that would later pass for a download
+		removePartialDownload(track.ID)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if downloadCtx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("%w: yt-dlp timed out after %s", ErrDownloadFailed, timeout)
+		}
+		return nil, fmt.Errorf("%w: yt-dlp exited: %v", ErrDownloadFailed, err)
 	}
 
-	fmt.Printf("Downloaded: %s by %s -> %s\n", track.Name, strings.Join(track.Artists, ", "), outputPath)
-	return nil
+	slog.Debug("yt-dlp finished", "worker_type", "download", "track_id", track.ID, "path", outputPath)
+
+	// yt-dlp can exit cleanly with a truncated file or something that isn't audio at all
+	if err := validateAudio(ctx, track.ID, outputPath, time.Duration(track.DurationMs)*time.Millisecond); err != nil {
+		removePartialDownload(track.ID)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	// Tags and cover art are a nicety: the audio is usable without them, so
+	// failures here are only logged
+	var coverPath string
+	if track.AlbumArtURL != "" {
+		coverPath = filepath.Join(trackDir, "cover.jpg")
+		if err := downloadAlbumArt(ctx, track.AlbumArtURL, coverPath); err != nil {
+			slog.Warn("Failed to download album art", "worker_type", "download", "track_id", track.ID, "error", err)
+			coverPath = ""
+		} else {
+			defer os.Remove(coverPath)
+		}
+	}
+	if err := tagMP3(ctx, outputPath, coverPath, track); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		slog.Warn("Failed to tag MP3", "worker_type", "download", "track_id", track.ID, "error", err)
+	}
+	return video, nil
 }
 
 // parseProgress extracts percentage from yt-dlp output line
@@ -140,3 +404,34 @@ func parseProgress(line string) float64 {
 	}
 	return -1
 }
+
+// parseETA extracts the time remaining from a yt-dlp progress line.
+// It reports false when yt-dlp doesn't know yet ("ETA Unknown") or prints none.
+func parseETA(line string) (int, bool) {
+	// Example: "[download]   42.8% of ~5.23MiB at  1.15MiB/s ETA 00:02"
+	parts := strings.Fields(line)
+	for i, part := range parts {
+		if part == "ETA" && i+1 < len(parts) {
+			return parseClock(parts[i+1])
+		}
+	}
+	return 0, false
+}
+
+// parseClock converts an "MM:SS" or "HH:MM:SS" duration, as printed by yt-dlp
+// and tqdm, to seconds
+func parseClock(clock string) (int, bool) {
+	fields := strings.Split(clock, ":")
+	if len(fields) < 2 || len(fields) > 3 {
+		return 0, false
+	}
+	seconds := 0
+	for _, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 0 {
+			return 0, false
+		}
+		seconds = seconds*60 + n
+	}
+	return seconds, true
+}
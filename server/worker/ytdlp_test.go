@@ -1,10 +1,15 @@
 package worker
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/joho/godotenv"
 
@@ -16,6 +21,12 @@ func init() {
 	_ = godotenv.Load("../../.env")
 }
 
+// fakeFFprobe prints ffprobe's JSON for a file with one stream of codecType and the given duration
+func fakeFFprobe(ctx context.Context, codecType, duration string) *exec.Cmd {
+	output := fmt.Sprintf(`{"streams": [{"codec_type": %q}], "format": {"duration": %q}}`, codecType, duration)
+	return exec.CommandContext(ctx, "printf", "%s", output)
+}
+
 func TestSearchYouTubeIntegration(t *testing.T) {
 	if testing.Short() {
 		t.Skip("Skipping integration test in short mode")
@@ -27,7 +38,7 @@ func TestSearchYouTubeIntegration(t *testing.T) {
 		Album:   "Melodrama",
 	}
 
-	result, err := SearchYouTube(track)
+	result, err := SearchYouTube(context.Background(), track)
 	if err != nil {
 		t.Fatalf("SearchYouTube failed: %v", err)
 	}
@@ -54,6 +65,397 @@ func TestSearchYouTubeIntegration(t *testing.T) {
 	t.Logf("URL: %s", result.URL)
 }
 
+func TestSearchYouTubePicksClosestDuration(t *testing.T) {
+	output := "WARNING: some extractor warning\n" +
+		"ext1\t612\tThe Louvre (Extended Mix)\n" +
+		"live1\tNA\tThe Louvre (Live)\n" +
+		"real1\t287\tLorde - The Louvre\n" +
+		"near1\t281\tThe Louvre (Audio)\n"
+
+	originalExec := execCommand
+	execCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "printf", "%s", output)
+	}
+	defer func() { execCommand = originalExec }()
+
+	track := models.TrackMetadata{Name: "The Louvre", Artists: []string{"Lorde"}, DurationMs: 286000}
+	result, err := SearchYouTube(context.Background(), track)
+	if err != nil {
+		t.Fatalf("SearchYouTube failed: %v", err)
+	}
+	if result.VideoID != "real1" {
+		t.Errorf("Expected closest match real1, got %s (%s)", result.VideoID, result.Title)
+	}
+
+	// Nothing within tolerance: fall back to the top result
+	track.DurationMs = 120000
+	result, err = SearchYouTube(context.Background(), track)
+	if err != nil {
+		t.Fatalf("SearchYouTube failed: %v", err)
+	}
+	if result.VideoID != "ext1" {
+		t.Errorf("Expected fallback to first result ext1, got %s", result.VideoID)
+	}
+}
+
+func TestSearchYouTubePrefersISRC(t *testing.T) {
+	var searched []string
+	originalExec := execCommand
+	execCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		target := args[len(args)-1]
+		searched = append(searched, target)
+		if strings.HasPrefix(target, "https://music.youtube.com/") {
+			return exec.CommandContext(ctx, "printf", "%s", "isrc1\t287\tThe Louvre\n")
+		}
+		return exec.CommandContext(ctx, "printf", "%s", "text1\t287\tThe Louvre (Cover)\n")
+	}
+	defer func() { execCommand = originalExec }()
+
+	track := models.TrackMetadata{Name: "The Louvre", Artists: []string{"Lorde"}, DurationMs: 286000, ISRC: "USUM71703692"}
+	result, err := SearchYouTube(context.Background(), track)
+	if err != nil {
+		t.Fatalf("SearchYouTube failed: %v", err)
+	}
+	if result.VideoID != "isrc1" || len(searched) != 1 {
+		t.Errorf("Expected a single ISRC search returning isrc1, got %s after %v", result.VideoID, searched)
+	}
+
+	// An empty ISRC search falls back to artist and title
+	searched = nil
+	execCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		target := args[len(args)-1]
+		searched = append(searched, target)
+		if strings.HasPrefix(target, "https://music.youtube.com/") {
+			return exec.CommandContext(ctx, "true")
+		}
+		return exec.CommandContext(ctx, "printf", "%s", "text1\t287\tThe Louvre\n")
+	}
+	result, err = SearchYouTube(context.Background(), track)
+	if err != nil {
+		t.Fatalf("SearchYouTube failed: %v", err)
+	}
+	if result.VideoID != "text1" || len(searched) != 2 {
+		t.Errorf("Expected fallback to text search returning text1, got %s after %v", result.VideoID, searched)
+	}
+}
+
+func TestSearchYouTubeNoResults(t *testing.T) {
+	originalExec := execCommand
+	execCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		// yt-dlp prints only warnings and exits 0 when a search is empty
+		return exec.CommandContext(ctx, "printf", "%s", "WARNING: [youtube:search] no results\n")
+	}
+	defer func() { execCommand = originalExec }()
+
+	track := models.TrackMetadata{ID: "nomatch1", Name: "Obscure", Artists: []string{"Nobody"}}
+	_, err := DownloadTrackFromSpotifyWithProgress(context.Background(), track, "", make(chan models.ProgressEvent, 1))
+	if !errors.Is(err, ErrNoYouTubeMatch) {
+		t.Fatalf("Expected ErrNoYouTubeMatch, got %v", err)
+	}
+	if errors.Is(err, ErrDownloadFailed) {
+		t.Error("A missing match should not be reported as a download failure")
+	}
+}
+
+func TestParseSearchOutput(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		wantIDs []string
+		wantErr error // nil with no IDs means any error
+	}{
+		{
+			name:    "results",
+			raw:     "abc123\t287\tLorde - The Louvre\nxyz789\t281.5\tThe Louvre (Audio)\n",
+			wantIDs: []string{"abc123", "xyz789"},
+		},
+		{
+			name:    "leading warnings",
+			raw:     "WARNING: [youtube] Falling back to generic n function search\nWARNING: unable to extract chapters\nabc123\t287\tThe Louvre\n",
+			wantIDs: []string{"abc123"},
+		},
+		{
+			name:    "interleaved info lines",
+			raw:     "[youtube:search] Extracting URL: ytsearch5:lorde the louvre\nabc123\t287\tThe Louvre\n[youtube] xyz789: Downloading webpage\nxyz789\tNA\tThe Louvre (Live)\n",
+			wantIDs: []string{"abc123", "xyz789"},
+		},
+		{name: "empty", raw: "", wantErr: ErrNoYouTubeMatch},
+		{name: "only warnings", raw: "WARNING: [youtube:search] no results\n", wantErr: ErrNoYouTubeMatch},
+		{name: "malformed", raw: "Lorde - The Louvre\nabc123\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSearchOutput(tt.raw)
+			if tt.wantIDs == nil {
+				if err == nil || (tt.wantErr != nil && !errors.Is(err, tt.wantErr)) {
+					t.Fatalf("Expected error %v, got %v (results %+v)", tt.wantErr, err, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseSearchOutput failed: %v", err)
+			}
+			var ids []string
+			for _, result := range got {
+				ids = append(ids, result.VideoID)
+				if result.URL != "https://www.youtube.com/watch?v="+result.VideoID || result.Title == "" {
+					t.Errorf("Unexpected result %+v", result)
+				}
+			}
+			if strings.Join(ids, ",") != strings.Join(tt.wantIDs, ",") {
+				t.Errorf("Expected IDs %v, got %v", tt.wantIDs, ids)
+			}
+		})
+	}
+
+	// Durations are parsed when reported and left zero for "NA"
+	got, _ := parseSearchOutput("abc123\t281.5\tThe Louvre\nxyz789\tNA\tThe Louvre (Live)\n")
+	if got[0].Duration != 281500*time.Millisecond || got[1].Duration != 0 {
+		t.Errorf("Expected durations 281.5s and 0, got %v and %v", got[0].Duration, got[1].Duration)
+	}
+}
+
+func TestParseSearchOutputUnusualTitles(t *testing.T) {
+	// Titles arrive JSON-encoded, so embedded newlines, tabs and brackets stay on one line
+	raw := "WARNING: unable to extract chapters\n" +
+		"emoji1\t201\t\"🔥 Lorde – The Louvre 🎧 (Lyrics) 💿\"\n" +
+		"multi1\t287\t\"The Louvre\\n[Official Audio]\\tHD\"\n" +
+		"swap01\t287\t\"abc123\"\n"
+	got, err := parseSearchOutput(raw)
+	if err != nil {
+		t.Fatalf("parseSearchOutput failed: %v", err)
+	}
+	want := []YouTubeSearchResult{
+		{VideoID: "emoji1", Title: "🔥 Lorde – The Louvre 🎧 (Lyrics) 💿"},
+		{VideoID: "multi1", Title: "The Louvre\n[Official Audio]\tHD"},
+		{VideoID: "swap01", Title: "abc123"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d results, got %+v", len(want), got)
+	}
+	for i := range want {
+		if got[i].VideoID != want[i].VideoID || got[i].Title != want[i].Title {
+			t.Errorf("Result %d: expected %q/%q, got %q/%q", i, want[i].VideoID, want[i].Title, got[i].VideoID, got[i].Title)
+		}
+	}
+
+	// A yt-dlp that ignores the template prints the bare title and id on separate lines
+	if _, err := parseSearchOutput("The Louvre\nabc123\n"); err == nil || !strings.Contains(err.Error(), "tab-delimited") {
+		t.Errorf("Expected a tab-delimited format error, got %v", err)
+	}
+}
+
+func TestDownloadTimesOutStalledYtDlp(t *testing.T) {
+	useTempSongsDir(t)
+
+	originalExec := execCommand
+	execCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		if strings.Contains(strings.Join(args, " "), "watch?v=vid1") {
+			// The download itself hangs on a dead connection
+			return exec.CommandContext(ctx, "sleep", "30")
+		}
+		return exec.CommandContext(ctx, "printf", "%s", "vid1\t200\tStalled\n")
+	}
+	defer func() { execCommand = originalExec }()
+
+	originalConfig := ytDlpConfig
+	ConfigureYtDlp(YtDlpConfig{DownloadTimeout: 100 * time.Millisecond})
+	defer ConfigureYtDlp(originalConfig)
+
+	start := time.Now()
+	track := models.TrackMetadata{ID: "stalled1", Name: "Stalled", Artists: []string{"Artist"}}
+	_, err := DownloadTrackFromSpotifyWithProgress(context.Background(), track, "", make(chan models.ProgressEvent, 10))
+	if !errors.Is(err, ErrDownloadFailed) || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("Expected a timeout download failure, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Download took %v to time out", elapsed)
+	}
+}
+
+func TestFailedDownloadRemovesPartialFiles(t *testing.T) {
+	useTempSongsDir(t)
+
+	trackDir := TrackDir("partial1")
+	stemDir := filepath.Join(trackDir, "htdemucs", "base")
+	if err := os.MkdirAll(stemDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	originalExec := execCommand
+	execCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		// yt-dlp dies mid-download, leaving its temp files and a truncated output behind
+		script := "cd " + trackDir + " && printf partial > base.mp3 && touch base.mp3.part base.mp3.ytdl base.temp.mp3 && exit 1"
+		return exec.CommandContext(ctx, "sh", "-c", script)
+	}
+	defer func() { execCommand = originalExec }()
+
+	track := models.TrackMetadata{ID: "partial1", Name: "Song", Artists: []string{"Artist"}}
+	_, err := DownloadTrackFromSpotifyWithProgress(context.Background(), track, "https://www.youtube.com/watch?v=dQw4w9WgXcQ", make(chan models.ProgressEvent, 10))
+	if !errors.Is(err, ErrDownloadFailed) {
+		t.Fatalf("Expected a download failure, got %v", err)
+	}
+
+	entries, err := os.ReadDir(trackDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	for _, entry := range entries {
+		left = append(left, entry.Name())
+	}
+	if len(left) != 1 || left[0] != "htdemucs" {
+		t.Errorf("Expected only the stems to remain, found %v", left)
+	}
+	if HasBaseAudio("partial1") {
+		t.Error("Expected no base audio after a failed download")
+	}
+}
+
+func TestDownloadRejectsInvalidAudio(t *testing.T) {
+	useTempSongsDir(t)
+
+	tests := []struct {
+		name      string
+		codecType string
+		duration  string
+		wantErr   bool
+	}{
+		{"matching audio", "audio", "290.1", false},
+		{"slideshow video", "video", "290.1", true},
+		{"truncated", "audio", "41.5", true},
+		{"within tolerance", "audio", "310", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalExec := execCommand
+			execCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+				if name == "ffprobe" {
+					return fakeFFprobe(ctx, tt.codecType, tt.duration)
+				}
+				return exec.CommandContext(ctx, "sh", "-c", "printf audio > "+BaseAudioPath("probe1"))
+			}
+			defer func() { execCommand = originalExec }()
+
+			track := models.TrackMetadata{ID: "probe1", Name: "Song", Artists: []string{"Artist"}, DurationMs: 287000}
+			_, err := DownloadTrackFromSpotifyWithProgress(context.Background(), track, "https://www.youtube.com/watch?v=dQw4w9WgXcQ", make(chan models.ProgressEvent, 10))
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("Expected the download to pass validation, got %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidAudio) {
+				t.Fatalf("Expected ErrInvalidAudio, got %v", err)
+			}
+			if _, statErr := os.Stat(BaseAudioPath("probe1")); !os.IsNotExist(statErr) {
+				t.Error("Expected the invalid file to be removed")
+			}
+		})
+	}
+}
+
+func TestHasBaseAudioRejectsTinyFiles(t *testing.T) {
+	useTempSongsDir(t)
+	if err := os.MkdirAll(TrackDir("tiny1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(BaseAudioPath("tiny1"), []byte("<html>error</html>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if HasBaseAudio("tiny1") {
+		t.Error("Expected a tiny file to count as incomplete")
+	}
+
+	if err := os.WriteFile(BaseAudioPath("tiny1"), make([]byte, minAudioBytes), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !HasBaseAudio("tiny1") {
+		t.Error("Expected a full-size file to count as downloaded")
+	}
+}
+
+func TestDownloadReadsAllProgressBeforeReturning(t *testing.T) {
+	useTempSongsDir(t)
+
+	progressLines := "[download]   10.0% of 3.00MiB\n" +
+		"[download]   55.5% of 3.00MiB\n" +
+		"[download]  100.0% of 3.00MiB\n" +
+		"[ExtractAudio] Destination: base.mp3\n"
+
+	originalExec := execCommand
+	execCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		if name == "ffprobe" {
+			return fakeFFprobe(ctx, "audio", "200.0")
+		}
+		if strings.Contains(strings.Join(args, " "), "watch?v=vid1") {
+			return exec.CommandContext(ctx, "printf", "%s", progressLines)
+		}
+		return exec.CommandContext(ctx, "printf", "%s", "vid1\t200\tSong\n")
+	}
+	defer func() { execCommand = originalExec }()
+
+	// Buffered for exactly the expected events so none can arrive after return
+	progressChan := make(chan models.ProgressEvent, 4)
+	track := models.TrackMetadata{ID: "fake1", Name: "Song", Artists: []string{"Artist"}}
+	video, err := DownloadTrackFromSpotifyWithProgress(context.Background(), track, "", progressChan)
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if video.VideoID != "vid1" || video.Title != "Song" {
+		t.Errorf("Expected the matched video vid1 \"Song\", got %+v", video)
+	}
+
+	if len(progressChan) != 4 {
+		t.Fatalf("Expected 4 progress events before return, got %d", len(progressChan))
+	}
+	want := []struct {
+		progress float64
+		stage    string
+	}{{10, "downloading"}, {55.5, "downloading"}, {100, "downloading"}, {100, "extracting audio"}}
+	for i, w := range want {
+		event := <-progressChan
+		if event.Progress != w.progress || event.Stage != w.stage {
+			t.Errorf("Event %d: expected %v/%q, got %v/%q", i, w.progress, w.stage, event.Progress, event.Stage)
+		}
+	}
+}
+
+func TestDownloadDoesNotBlockOnFullProgressChannel(t *testing.T) {
+	useTempSongsDir(t)
+
+	originalExec := execCommand
+	execCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		if name == "ffprobe" {
+			return fakeFFprobe(ctx, "audio", "200.0")
+		}
+		if strings.Contains(strings.Join(args, " "), "watch?v=vid1") {
+			return exec.CommandContext(ctx, "printf", "%s", "[download]   10.0% of 3.00MiB\n[download]  100.0% of 3.00MiB\n")
+		}
+		return exec.CommandContext(ctx, "printf", "%s", "vid1\t200\tSong\n")
+	}
+	defer func() { execCommand = originalExec }()
+
+	// Nobody reads this channel, like a broadcaster stuck behind a burst
+	progressChan := make(chan models.ProgressEvent)
+	done := make(chan error, 1)
+	go func() {
+		track := models.TrackMetadata{ID: "full1", Name: "Song", Artists: []string{"Artist"}}
+		_, err := DownloadTrackFromSpotifyWithProgress(context.Background(), track, "", progressChan)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Download failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Download stalled on a full progress channel")
+	}
+}
+
 func TestDownloadTrackFromSpotifyIntegration(t *testing.T) {
 	if testing.Short() {
 		t.Skip("Skipping integration test in short mode")
@@ -74,7 +476,7 @@ func TestDownloadTrackFromSpotifyIntegration(t *testing.T) {
 		}
 	}()
 
-	err := DownloadTrackFromSpotifyWithProgress(track, progressChan)
+	_, err := DownloadTrackFromSpotifyWithProgress(context.Background(), track, "", progressChan)
 	if err != nil {
 		t.Fatalf("DownloadTrackFromSpotify failed: %v", err)
 	}
@@ -91,3 +493,52 @@ func TestDownloadTrackFromSpotifyIntegration(t *testing.T) {
 		os.RemoveAll("songs")
 	}
 }
+
+func TestDownloadFromSourceURLSkipsSearch(t *testing.T) {
+	useTempSongsDir(t)
+
+	const sourceURL = "https://www.youtube.com/watch?v=dQw4w9WgXcQ"
+	var downloaded bool
+	originalExec := execCommand
+	execCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		joined := strings.Join(args, " ")
+		if strings.Contains(joined, "ytsearch") || strings.Contains(joined, "--print") {
+			t.Errorf("Unexpected YouTube search: %s", joined)
+		}
+		if strings.Contains(joined, sourceURL) {
+			downloaded = true
+		}
+		if name == "ffprobe" {
+			return fakeFFprobe(ctx, "audio", "200.0")
+		}
+		return exec.CommandContext(ctx, "true")
+	}
+	defer func() { execCommand = originalExec }()
+
+	track := models.TrackMetadata{ID: "pinned1", Name: "Song", Artists: []string{"Artist"}}
+	if _, err := DownloadTrackFromSpotifyWithProgress(context.Background(), track, sourceURL, make(chan models.ProgressEvent, 10)); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if !downloaded {
+		t.Error("Expected yt-dlp to download the pinned URL")
+	}
+}
+
+func TestParseETA(t *testing.T) {
+	tests := []struct {
+		line   string
+		want   int
+		wantOK bool
+	}{
+		{"[download]   42.8% of ~5.23MiB at  1.15MiB/s ETA 00:02", 2, true},
+		{"[download]    1.0% of 95.00MiB at 500.00KiB/s ETA 01:03:05", 3785, true},
+		{"[download]    0.0% of ~5.23MiB at Unknown B/s ETA Unknown", 0, false},
+		{"[download]  100.0% of 5.23MiB in 00:00:04 at 1.20MiB/s", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseETA(tt.line)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("parseETA(%q) = %d, %v; want %d, %v", tt.line, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}